@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -43,17 +44,58 @@ var (
 )
 
 var (
-	reposMap = make(map[string]struct{}, 4)
-
-	tokenPtr       = flag.String("token", os.Getenv("GCRCLEANER_TOKEN"), "Authentication token")
-	recursivePtr   = flag.Bool("recursive", false, "Clean all sub-repositories under the -repo root")
-	gracePtr       = flag.Duration("grace", 0, "Grace period")
-	tagFilterAny   = flag.String("tag-filter-any", "", "Delete images where any tag matches this regular expression")
-	tagFilterAll   = flag.String("tag-filter-all", "", "Delete images where all tags match this regular expression")
-	keepPtr        = flag.Int64("keep", 0, "Minimum to keep")
-	dryRunPtr      = flag.Bool("dry-run", false, "Do a noop on delete api call")
-	concurrencyPtr = flag.Int64("concurrency", 20, "Concurrent requests (defaults to number of CPUs)")
-	versionPtr     = flag.Bool("version", false, "Print version information and exit")
+	reposMap             = make(map[string]struct{}, 4)
+	protectedTags        []string
+	mediaTypes           []string
+	excludeMediaTypes    []string
+	artifactTypes        []string
+	excludeArtifactTypes []string
+	kubeconfigs          []string
+	kubeContexts         []string
+
+	tokenPtr         = flag.String("token", os.Getenv("GCRCLEANER_TOKEN"), "Authentication token")
+	recursivePtr     = flag.Bool("recursive", false, "Clean all sub-repositories under the -repo root")
+	gracePtr         = durationFlag("grace", 0, "Grace period (e.g. 12h, 30d, or 2w)")
+	untaggedPtr      = durationFlag("untagged-grace", 0, "Grace period for untagged images (defaults to -grace)")
+	taggedPtr        = durationFlag("tagged-grace", 0, "Grace period for tagged images (defaults to -grace)")
+	olderThanPtr     = flag.String("older-than", "", "Only delete images uploaded before this RFC 3339 timestamp")
+	newerThanPtr     = flag.String("newer-than", "", "Only delete images uploaded after this RFC 3339 timestamp")
+	tagFilterExpr    = flag.String("tag-filter", "", "Delete images that match this tag filter expression, e.g. \"any(^pr-) and not any(^release-)\"")
+	tagFilterAny     = flag.String("tag-filter-any", "", "Delete images where any tag matches this regular expression")
+	tagFilterAll     = flag.String("tag-filter-all", "", "Delete images where all tags match this regular expression")
+	expressionPtr    = flag.String("expression", "", "Delete images for which this CEL expression is true, instead of using the tag filters")
+	keepPtr          = flag.Int64("keep", 0, "Minimum to keep")
+	keepDailyPtr     = flag.Int64("keep-daily", 0, "Keep the newest image of each of this many days, including today")
+	keepWeeklyPtr    = flag.Int64("keep-weekly", 0, "Keep the newest image of each of this many weeks, including this week")
+	keepMonthlyPtr   = flag.Int64("keep-monthly", 0, "Keep the newest image of each of this many months, including this month")
+	keepYearlyPtr    = flag.Int64("keep-yearly", 0, "Keep the newest image of each of this many years, including this year")
+	keepGroupByPtr   = flag.String("keep-group-by", "", "Apply -keep to each family of images, where the family is the capture group named \"group\" in this regular expression")
+	semverPtr        = flag.Bool("semver", false, "Keep images tagged with semantic versions by release line instead of by age")
+	semverMajorsPtr  = flag.Int64("semver-keep-majors", 0, "With -semver, number of newest major versions to keep (0 keeps all)")
+	semverMinorsPtr  = flag.Int64("semver-keep-minors", 0, "With -semver, number of newest minor versions to keep per major (0 keeps all)")
+	semverPatchPtr   = flag.Int64("semver-keep-patches", 0, "With -semver, number of newest patch versions to keep per minor (0 keeps all)")
+	semverPrePtr     = durationFlag("semver-prerelease-grace", 0, "With -semver, how long to keep prerelease versions (0 keeps all)")
+	timeSourcePtr    = flag.String("time-source", "", "Where the time of each image comes from for -grace and -keep: created, uploaded, annotation, label, or tag")
+	timeLabelPtr     = flag.String("time-source-label", "", "With -time-source=label, the label that contains the time")
+	timePatternPtr   = flag.String("time-source-pattern", "", "With -time-source=tag, the regular expression that matches the time in a tag")
+	timeLayoutPtr    = flag.String("time-source-layout", "", "With -time-source=label or tag, the Go time layout of the time (e.g. 20060102)")
+	untagOnlyPtr     = flag.Bool("untag-only", false, "Only remove the tags that match the tag filter from images that also have other tags")
+	retentionPtr     = flag.Bool("retention-labels", false, "Keep images labeled gcr-cleaner.keep=true and delete images after their gcr-cleaner.expires-after label")
+	orphansPtr       = flag.Bool("delete-orphans", false, "Delete signatures and other artifacts whose image is not in the same repository")
+	inUsePtr         = flag.Bool("protect-in-use", false, "Never delete images used by workloads in the Kubernetes clusters of -kube-context (defaults to the current context)")
+	quotaPtr         = sizeFlag("quota", 0, "Delete the oldest matching images only until each repository fits in this size (e.g. 50GiB)")
+	policyFilePtr    = flag.String("policy-file", "", "Path to a YAML or JSON file of per-repository policies")
+	metadataDirPtr   = flag.String("metadata-cache-dir", os.Getenv("GCRCLEANER_METADATA_CACHE_DIR"), "Directory in which to cache fetched labels and sizes across runs")
+	dryRunPtr        = flag.Bool("dry-run", false, "Do a noop on delete api call")
+	hubUserPtr       = flag.String("dockerhub-username", os.Getenv("GCRCLEANER_DOCKERHUB_USERNAME"), "Docker Hub username, enables deleting from Docker Hub")
+	hubTokenPtr      = flag.String("dockerhub-token", os.Getenv("GCRCLEANER_DOCKERHUB_TOKEN"), "Docker Hub password or personal access token")
+	hubNamespacesPtr = flag.String("dockerhub-namespaces", os.Getenv("GCRCLEANER_DOCKERHUB_NAMESPACES"), "Comma-separated Docker Hub organizations or users to search with -recursive (defaults to -dockerhub-username)")
+	githubTokenPtr   = flag.String("github-token", os.Getenv("GCRCLEANER_GITHUB_TOKEN"), "GitHub token for deleting from ghcr.io (defaults to the -token or keychain credentials)")
+	githubOwnersPtr  = flag.String("github-owners", os.Getenv("GCRCLEANER_GITHUB_OWNERS"), "Comma-separated GitHub organizations or users to search on ghcr.io with -recursive")
+	arAPIPtr         = flag.Bool("artifact-registry-api", false, "Use the Artifact Registry API instead of the Docker API for *-docker.pkg.dev")
+	ecrAPIPtr        = flag.Bool("ecr-api", false, "Use the ECR API with AWS SDK credentials instead of the Docker API for *.dkr.ecr.*.amazonaws.com")
+	concurrencyPtr   = flag.Int64("concurrency", 20, "Concurrent requests (defaults to number of CPUs)")
+	versionPtr       = flag.Bool("version", false, "Print version information and exit")
 )
 
 func main() {
@@ -72,6 +114,55 @@ func main() {
 		return nil
 	})
 
+	flag.Func("protect-tag", "Never delete images with a tag that matches this regular expression (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			protectedTags = append(protectedTags, t)
+		}
+		return nil
+	})
+
+	flag.Func("media-type", "Only clean manifests with a media type that matches this pattern (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			mediaTypes = append(mediaTypes, t)
+		}
+		return nil
+	})
+
+	flag.Func("exclude-media-type", "Never clean manifests with a media type that matches this pattern (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			excludeMediaTypes = append(excludeMediaTypes, t)
+		}
+		return nil
+	})
+
+	flag.Func("artifact-type", "Only clean artifacts with an artifact type that matches this pattern (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			artifactTypes = append(artifactTypes, t)
+		}
+		return nil
+	})
+
+	flag.Func("exclude-artifact-type", "Never clean artifacts with an artifact type that matches this pattern (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			excludeArtifactTypes = append(excludeArtifactTypes, t)
+		}
+		return nil
+	})
+
+	flag.Func("kubeconfig", "Path to a kubeconfig file for -protect-in-use (may be repeated, defaults to $KUBECONFIG or ~/.kube/config)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			kubeconfigs = append(kubeconfigs, t)
+		}
+		return nil
+	})
+
+	flag.Func("kube-context", "Kubeconfig context of a cluster for -protect-in-use (may be repeated)", func(s string) error {
+		if t := strings.TrimSpace(s); t != "" {
+			kubeContexts = append(kubeContexts, t)
+		}
+		return nil
+	})
+
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n\n", os.Args[0])
@@ -121,29 +212,162 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 	}
 	sort.Strings(repos)
 
-	tagFilter, err := gcrcleaner.BuildTagFilter(*tagFilterAny, *tagFilterAll)
+	tagFilter, err := gcrcleaner.BuildTagFilterExpr(*tagFilterExpr, *tagFilterAny, *tagFilterAll)
 	if err != nil {
 		return fmt.Errorf("failed to parse tag filter: %w", err)
 	}
 
+	expression, err := gcrcleaner.BuildExpression(*expressionPtr)
+	if err != nil {
+		return fmt.Errorf("failed to parse expression: %w", err)
+	}
+
+	protected, err := gcrcleaner.BuildProtectedTags(protectedTags)
+	if err != nil {
+		return fmt.Errorf("failed to parse protected tags: %w", err)
+	}
+
+	keepGroup, err := gcrcleaner.BuildKeepGroup(*keepGroupByPtr)
+	if err != nil {
+		return fmt.Errorf("failed to parse keep group: %w", err)
+	}
+
+	var buckets *gcrcleaner.Buckets
+	if *keepDailyPtr != 0 || *keepWeeklyPtr != 0 || *keepMonthlyPtr != 0 || *keepYearlyPtr != 0 {
+		if *keepDailyPtr < 0 || *keepWeeklyPtr < 0 || *keepMonthlyPtr < 0 || *keepYearlyPtr < 0 {
+			return fmt.Errorf("bucket counts must be positive")
+		}
+		buckets = &gcrcleaner.Buckets{
+			Daily:   *keepDailyPtr,
+			Weekly:  *keepWeeklyPtr,
+			Monthly: *keepMonthlyPtr,
+			Yearly:  *keepYearlyPtr,
+		}
+	}
+
+	var semver *gcrcleaner.SemverPolicy
+	if *semverPtr {
+		if *semverMajorsPtr < 0 || *semverMinorsPtr < 0 || *semverPatchPtr < 0 {
+			return fmt.Errorf("semver keep counts must be positive")
+		}
+		semver = &gcrcleaner.SemverPolicy{
+			KeepMajors:      *semverMajorsPtr,
+			KeepMinors:      *semverMinorsPtr,
+			KeepPatches:     *semverPatchPtr,
+			PrereleaseGrace: *semverPrePtr,
+		}
+	}
+
+	timeSource, err := gcrcleaner.BuildTimeSource(*timeSourcePtr, *timeLabelPtr, *timePatternPtr, *timeLayoutPtr)
+	if err != nil {
+		return fmt.Errorf("failed to parse time source: %w", err)
+	}
+
+	typeFilter, err := gcrcleaner.BuildTypeFilter(mediaTypes, excludeMediaTypes, artifactTypes, excludeArtifactTypes)
+	if err != nil {
+		return fmt.Errorf("failed to parse type filter: %w", err)
+	}
+
+	if *quotaPtr < 0 {
+		return fmt.Errorf("-quota must not be negative")
+	}
+
+	var olderThan, newerThan time.Time
+	if *olderThanPtr != "" {
+		olderThan, err = time.Parse(time.RFC3339, *olderThanPtr)
+		if err != nil {
+			return fmt.Errorf("failed to parse -older-than: %w", err)
+		}
+	}
+	if *newerThanPtr != "" {
+		newerThan, err = time.Parse(time.RFC3339, *newerThanPtr)
+		if err != nil {
+			return fmt.Errorf("failed to parse -newer-than: %w", err)
+		}
+	}
+	if !olderThan.IsZero() && !newerThan.IsZero() && !newerThan.Before(olderThan) {
+		return fmt.Errorf("-newer-than must be before -older-than")
+	}
+
+	basePolicy := &gcrcleaner.Policy{
+		Name:            "default",
+		Grace:           *gracePtr,
+		UntaggedGrace:   *untaggedPtr,
+		TaggedGrace:     *taggedPtr,
+		OlderThan:       olderThan,
+		NewerThan:       newerThan,
+		Keep:            *keepPtr,
+		KeepGroup:       keepGroup,
+		Buckets:         buckets,
+		TagFilter:       tagFilter,
+		Expression:      expression,
+		ProtectedTags:   protected,
+		Semver:          semver,
+		UntagOnly:       *untagOnlyPtr,
+		TimeSource:      timeSource,
+		TypeFilter:      typeFilter,
+		RetentionLabels: *retentionPtr,
+		DeleteOrphans:   *orphansPtr,
+		Quota:           *quotaPtr,
+		DryRun:          *dryRunPtr,
+	}
+
+	var policies *gcrcleaner.PolicyConfig
+	if *policyFilePtr != "" {
+		policies, err = gcrcleaner.LoadPolicyConfig(*policyFilePtr)
+		if err != nil {
+			return err
+		}
+	}
+
 	keychain := gcrauthn.NewMultiKeychain(
 		bearerkeychain.New(*tokenPtr),
 		gcrauthn.DefaultKeychain,
 		gcrgoogle.Keychain,
 	)
 
-	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, *concurrencyPtr)
+	registryConfig := &gcrcleaner.RegistryConfig{
+		GHCR:                &gcrcleaner.GHCRConfig{Token: *githubTokenPtr},
+		ArtifactRegistryAPI: *arAPIPtr,
+		ECRAPI:              *ecrAPIPtr,
+	}
+	if v := *githubOwnersPtr; v != "" {
+		registryConfig.GHCR.Owners = strings.Split(v, ",")
+	}
+	if *hubUserPtr != "" {
+		registryConfig.DockerHub = &gcrcleaner.DockerHubConfig{
+			Username: *hubUserPtr,
+			Token:    *hubTokenPtr,
+		}
+		if v := *hubNamespacesPtr; v != "" {
+			registryConfig.DockerHub.Namespaces = strings.Split(v, ",")
+		}
+	}
+
+	registry, err := gcrcleaner.NewRegistry(registryConfig, keychain, logger, *concurrencyPtr)
 	if err != nil {
-		return fmt.Errorf("failed to create cleaner: %w", err)
+		return fmt.Errorf("failed to create registry: %w", err)
 	}
 
-	// Convert duration to a negative value, since we're about to "add" it to the
-	// since time.
-	sub := time.Duration(*gracePtr)
-	if *gracePtr > 0 {
-		sub = sub * -1
+	cleanerOpts := []gcrcleaner.CleanerOption{gcrcleaner.WithRegistry(registry)}
+	if v := *metadataDirPtr; v != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithMetadataCacheDir(v))
 	}
-	since := time.Now().UTC().Add(sub)
+	if *inUsePtr || len(kubeconfigs) > 0 || len(kubeContexts) > 0 {
+		clusters, err := gcrcleaner.LoadKubernetesClusters(kubeconfigs, kubeContexts)
+		if err != nil {
+			return fmt.Errorf("failed to load kubernetes clusters: %w", err)
+		}
+		lister := gcrcleaner.NewKubernetesInUseLister(clusters, logger, time.Minute)
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithInUseLister(lister))
+	}
+
+	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, *concurrencyPtr, cleanerOpts...)
+	if err != nil {
+		return fmt.Errorf("failed to create cleaner: %w", err)
+	}
+
+	since := basePolicy.Since(time.Now())
 
 	// Gather the repositories.
 	if *recursivePtr {
@@ -168,30 +392,221 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 			"actually be cleaned!\n\n")
 	}
 
-	fmt.Fprintf(stdout, "Deleting refs older than %s on %d repo(s)...\n\n",
-		since.Format(time.RFC3339), len(repos))
+	fmt.Fprintf(stdout, "Deleting refs older than %s%s on %d repo(s)...\n\n",
+		since.Format(time.RFC3339), newerThanText(basePolicy), len(repos))
+
+	// List the images in use once, so every repository is cleaned against the
+	// same images. If they cannot be listed, nothing is deleted, since any image
+	// could be in use.
+	inUse, err := cleaner.ListInUse(ctx)
+	if err != nil {
+		return err
+	}
 
 	// Do the deletion.
 	var errs []error
+	var reclaimable int64
 	for i, repo := range repos {
 		fmt.Fprintf(stdout, "%s\n", repo)
-		deleted, err := cleaner.Clean(ctx, repo, since, *keepPtr, tagFilter, *dryRunPtr)
+
+		policy := policies.Resolve(repo, basePolicy)
+		if policies != nil {
+			fmt.Fprintf(stdout, "  policy %s: refs older than %s%s, keep %d\n",
+				policy.Name, policy.Since(time.Now()).Format(time.RFC3339), newerThanText(policy), policy.Keep)
+			if policy.Semver != nil {
+				fmt.Fprintf(stdout, "  semver: %s\n", policy.Semver)
+			}
+			if policy.Expression != nil {
+				fmt.Fprintf(stdout, "  expression: %s\n", policy.Expression)
+			}
+			if policy.TypeFilter != nil {
+				fmt.Fprintf(stdout, "  type filter: %s\n", policy.TypeFilter)
+			}
+			if policy.Quota > 0 {
+				fmt.Fprintf(stdout, "  quota: %s\n", gcrcleaner.FormatSize(policy.Quota))
+			}
+		}
+
+		result, err := cleaner.CleanWithResult(ctx, repo, policy, gcrcleaner.WithInUseImages(inUse))
 		if err != nil {
 			errs = append(errs, err)
+			result = &gcrcleaner.CleanResult{}
 		}
 
-		if len(deleted) > 0 {
-			for _, val := range deleted {
-				fmt.Fprintf(stdout, "  ✓ %s\n", val)
+		for _, ref := range result.Kept {
+			switch {
+			case ref.Protected != "":
+				fmt.Fprintf(stdout, "  • %s %q kept by protected tag %s%s\n", ref.Digest, ref.Tags, ref.Protected, keptType(ref))
+			case ref.Label != "":
+				fmt.Fprintf(stdout, "  • %s %q kept by label %s%s\n", ref.Digest, ref.Tags, ref.Label, keptType(ref))
+			case ref.InUse != "":
+				fmt.Fprintf(stdout, "  • %s %q kept because in use by %s%s\n", ref.Digest, ref.Tags, ref.InUse, keptType(ref))
+			case len(ref.NotUntagged) > 0:
+				fmt.Fprintf(stdout, "  • %s %q kept because the registry cannot remove %q%s\n", ref.Digest, ref.Tags, ref.NotUntagged, keptType(ref))
+			default:
+				fmt.Fprintf(stdout, "  • %s kept for %s%s\n", ref.Digest, ref.Bucket, keptType(ref))
 			}
+		}
+
+		if len(result.Deleted) > 0 {
+			printDeleted(result.Deleted)
 		} else {
 			fmt.Fprintf(stdout, "  ✗ no refs were deleted\n")
 		}
 
+		if result.Size != nil {
+			fmt.Fprintf(stdout, "  size: %s\n", result.Size)
+			reclaimable += result.Size.Reclaimable
+		}
+
 		if i != len(repos)-1 {
 			fmt.Fprintf(stdout, "\n")
 		}
 	}
 
+	verb := "Reclaimed"
+	if *dryRunPtr {
+		verb = "Would reclaim"
+	}
+	fmt.Fprintf(stdout, "\n%s %s in %d repo(s)\n", verb, gcrcleaner.FormatSize(reclaimable), len(repos))
+
 	return gcrcleaner.ErrsToError(errs)
 }
+
+// printDeleted prints the deleted refs. Supporting artifacts (signatures,
+// attestations, SBOMs, and referrers) are grouped under their subject if the
+// subject was also deleted.
+func printDeleted(deleted []*gcrcleaner.DeletedRef) {
+	deletedDigests := make(map[string]struct{}, len(deleted))
+	for _, ref := range deleted {
+		if !ref.Untagged {
+			deletedDigests[ref.Digest] = struct{}{}
+		}
+	}
+
+	artifacts := make(map[string][]*gcrcleaner.DeletedRef)
+	for _, ref := range deleted {
+		if _, ok := deletedDigests[ref.Subject]; ok {
+			artifacts[ref.Subject] = append(artifacts[ref.Subject], ref)
+		}
+	}
+
+	for _, ref := range deleted {
+		if _, ok := deletedDigests[ref.Subject]; ok {
+			continue
+		}
+
+		switch {
+		case ref.Untagged:
+			fmt.Fprintf(stdout, "  ✓ %s (untagged, %s kept)%s%s\n", ref, ref.Digest, threshold(ref), deletedType(ref))
+		case ref.Subject != "":
+			fmt.Fprintf(stdout, "  ✓ %s (orphaned artifact of %s)%s%s\n", ref, ref.Subject, threshold(ref), deletedType(ref))
+		default:
+			fmt.Fprintf(stdout, "  ✓ %s%s%s\n", ref, threshold(ref), deletedType(ref))
+		}
+
+		// Print artifacts below the digest of their subject.
+		if ref.Ref == ref.Digest {
+			printArtifacts(artifacts, ref.Digest, "      ")
+		}
+	}
+}
+
+// newerThanText describes the newer_than cutoff of the policy, if any.
+func newerThanText(policy *gcrcleaner.Policy) string {
+	if policy.NewerThan.IsZero() {
+		return ""
+	}
+	return " and newer than " + policy.NewerThan.UTC().Format(time.RFC3339)
+}
+
+// durationValue is a flag.Value for durations that also accepts days and
+// weeks.
+type durationValue time.Duration
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationValue) Set(s string) error {
+	v, err := gcrcleaner.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+// durationFlag defines a duration flag that also accepts days and weeks.
+func durationFlag(name string, value time.Duration, usage string) *time.Duration {
+	p := new(time.Duration)
+	*p = value
+	flag.Var((*durationValue)(p), name, usage)
+	return p
+}
+
+// sizeValue is a flag.Value for sizes in bytes that also accepts units.
+type sizeValue int64
+
+func (s *sizeValue) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeValue) Set(v string) error {
+	n, err := gcrcleaner.ParseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeValue(n)
+	return nil
+}
+
+// sizeFlag defines a size flag that accepts units such as GB and GiB.
+func sizeFlag(name string, value int64, usage string) *int64 {
+	p := new(int64)
+	*p = value
+	flag.Var((*sizeValue)(p), name, usage)
+	return p
+}
+
+// threshold formats the grace period that applied to the ref, if any.
+func threshold(ref *gcrcleaner.DeletedRef) string {
+	if ref.Threshold == "" {
+		return ""
+	}
+	return " [" + ref.Threshold + "]"
+}
+
+// deletedType describes the media type and artifact type of the deleted ref in
+// dry-run mode.
+func deletedType(ref *gcrcleaner.DeletedRef) string {
+	return typeText(ref.MediaType, ref.ArtifactType)
+}
+
+// keptType describes the media type of the kept image in dry-run mode.
+func keptType(ref *gcrcleaner.KeptRef) string {
+	return typeText(ref.MediaType, "")
+}
+
+// typeText describes the media type and artifact type in dry-run mode, so
+// the effect of type filters can be checked before anything is deleted.
+func typeText(mediaType, artifactType string) string {
+	if !*dryRunPtr || mediaType == "" {
+		return ""
+	}
+	if artifactType != "" {
+		return " (" + mediaType + ", " + artifactType + ")"
+	}
+	return " (" + mediaType + ")"
+}
+
+// printArtifacts prints the artifacts of the given subject, recursing into
+// artifacts of artifacts.
+func printArtifacts(artifacts map[string][]*gcrcleaner.DeletedRef, subject, indent string) {
+	for _, ref := range artifacts[subject] {
+		fmt.Fprintf(stdout, "%s↳ %s%s\n", indent, ref, deletedType(ref))
+		if ref.Ref == ref.Digest {
+			printArtifacts(artifacts, ref.Digest, indent+"  ")
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -83,12 +84,41 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 		gcrgoogle.Keychain,
 	)
 
-	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, concurrency)
+	registryConfig, err := registryConfig()
+	if err != nil {
+		return err
+	}
+
+	registry, err := gcrcleaner.NewRegistry(registryConfig, keychain, logger, concurrency)
+	if err != nil {
+		return fmt.Errorf("failed to create registry: %w", err)
+	}
+
+	cleanerOpts := []gcrcleaner.CleanerOption{gcrcleaner.WithRegistry(registry)}
+	if v := os.Getenv("GCRCLEANER_METADATA_CACHE_DIR"); v != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithMetadataCacheDir(v))
+	}
+	if lister, err := newInUseLister(logger); err != nil {
+		return fmt.Errorf("failed to create in-use lister: %w", err)
+	} else if lister != nil {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithInUseLister(lister))
+	}
+
+	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, concurrency, cleanerOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create cleaner: %w", err)
 	}
 
-	cleanerServer, err := gcrcleaner.NewServer(cleaner)
+	var serverOpts []gcrcleaner.ServerOption
+	if pth := os.Getenv("GCRCLEANER_POLICY_FILE"); pth != "" {
+		policies, err := gcrcleaner.LoadPolicyConfig(pth)
+		if err != nil {
+			return fmt.Errorf("failed to load policy file: %w", err)
+		}
+		serverOpts = append(serverOpts, gcrcleaner.WithPolicyConfig(policies))
+	}
+
+	cleanerServer, err := gcrcleaner.NewServer(cleaner, serverOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
 	}
@@ -131,3 +161,69 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 
 	return nil
 }
+
+// newInUseLister builds the lister of the images used in Kubernetes clusters,
+// if enabled. Setting the contexts enables it. The kubeconfig comes from the
+// KUBECONFIG environment variable, or the in-cluster configuration.
+func newInUseLister(logger *gcrcleaner.Logger) (gcrcleaner.InUseLister, error) {
+	var contexts []string
+	if v := os.Getenv("GCRCLEANER_KUBE_CONTEXTS"); v != "" {
+		contexts = strings.Split(v, ",")
+	}
+
+	enabled := len(contexts) > 0
+	if v := os.Getenv("GCRCLEANER_PROTECT_IN_USE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GCRCLEANER_PROTECT_IN_USE: %w", err)
+		}
+		enabled = enabled || b
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	clusters, err := gcrcleaner.LoadKubernetesClusters(nil, contexts)
+	if err != nil {
+		return nil, err
+	}
+	return gcrcleaner.NewKubernetesInUseLister(clusters, logger, time.Minute), nil
+}
+
+// registryConfig builds the configuration of the registries used by the cleaner
+// from the environment.
+func registryConfig() (*gcrcleaner.RegistryConfig, error) {
+	cfg := &gcrcleaner.RegistryConfig{
+		GHCR: &gcrcleaner.GHCRConfig{Token: os.Getenv("GCRCLEANER_GITHUB_TOKEN")},
+	}
+	if v := os.Getenv("GCRCLEANER_GITHUB_OWNERS"); v != "" {
+		cfg.GHCR.Owners = strings.Split(v, ",")
+	}
+
+	if username := os.Getenv("GCRCLEANER_DOCKERHUB_USERNAME"); username != "" {
+		cfg.DockerHub = &gcrcleaner.DockerHubConfig{
+			Username: username,
+			Token:    os.Getenv("GCRCLEANER_DOCKERHUB_TOKEN"),
+		}
+		if v := os.Getenv("GCRCLEANER_DOCKERHUB_NAMESPACES"); v != "" {
+			cfg.DockerHub.Namespaces = strings.Split(v, ",")
+		}
+	}
+
+	if v := os.Getenv("GCRCLEANER_ARTIFACT_REGISTRY_API"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GCRCLEANER_ARTIFACT_REGISTRY_API: %w", err)
+		}
+		cfg.ArtifactRegistryAPI = enabled
+	}
+	if v := os.Getenv("GCRCLEANER_ECR_API"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GCRCLEANER_ECR_API: %w", err)
+		}
+		cfg.ECRAPI = enabled
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,470 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// ArtifactRegistryHostPattern matches the registry hosts of Artifact Registry
+// Docker repositories.
+const ArtifactRegistryHostPattern = "*-docker.pkg.dev"
+
+// arHostRe extracts the location from an Artifact Registry host.
+var arHostRe = regexp.MustCompile(`^([a-z0-9-]+)-docker\.pkg\.dev$`)
+
+// defaultArtifactRegistryURL is the base URL of the Artifact Registry API.
+const defaultArtifactRegistryURL = "https://artifactregistry.googleapis.com"
+
+// arPageSize is the number of results to request per page.
+const arPageSize = 1000
+
+// arBatchSize is the maximum number of versions to delete in a single
+// batchDelete request.
+const arBatchSize = 1000
+
+// arOperationPollInterval is how often to check whether a long-running
+// operation has finished.
+const arOperationPollInterval = 1 * time.Second
+
+var (
+	_ Registry        = (*ArtifactRegistry)(nil)
+	_ BatchDeleter    = (*ArtifactRegistry)(nil)
+	_ ScopedCataloger = (*ArtifactRegistry)(nil)
+	_ BlobFetcher     = (*ArtifactRegistry)(nil)
+	_ ReferrersLister = (*ArtifactRegistry)(nil)
+)
+
+// ArtifactRegistryConfig is the configuration for an ArtifactRegistry.
+type ArtifactRegistryConfig struct {
+	// URL is the base URL of the Artifact Registry API. The default is
+	// https://artifactregistry.googleapis.com.
+	URL string
+}
+
+// ArtifactRegistry is a Registry for Artifact Registry that uses the Artifact
+// Registry API instead of the Docker registry API. Each image is a package and
+// each manifest is a version of that package. Versions are deleted in batches,
+// and child repositories are listed per project instead of across the entire
+// host. Manifests are still fetched using the registry API.
+type ArtifactRegistry struct {
+	baseURL     string
+	keychain    gcrauthn.Keychain
+	logger      *Logger
+	concurrency int64
+
+	manifests    Registry
+	client       *http.Client
+	pollInterval time.Duration
+}
+
+// NewArtifactRegistry creates a new Artifact Registry. Credentials for the API
+// are resolved from the keychain. The manifests registry is used to fetch
+// manifests, usually a RemoteRegistry.
+func NewArtifactRegistry(cfg *ArtifactRegistryConfig, keychain gcrauthn.Keychain, logger *Logger, concurrency int64, manifests Registry) *ArtifactRegistry {
+	if cfg == nil {
+		cfg = &ArtifactRegistryConfig{}
+	}
+
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultArtifactRegistryURL
+	}
+
+	return &ArtifactRegistry{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		keychain:    keychain,
+		logger:      logger,
+		concurrency: concurrency,
+		manifests:   manifests,
+		client:      &http.Client{Timeout: 60 * time.Second},
+
+		pollInterval: arOperationPollInterval,
+	}
+}
+
+// arVersion is a package version as returned by the Artifact Registry API.
+type arVersion struct {
+	Name        string    `json:"name"`
+	CreateTime  time.Time `json:"createTime"`
+	UpdateTime  time.Time `json:"updateTime"`
+	RelatedTags []struct {
+		Name string `json:"name"`
+	} `json:"relatedTags"`
+	Metadata struct {
+		ImageSizeBytes string    `json:"imageSizeBytes"`
+		MediaType      string    `json:"mediaType"`
+		BuildTime      time.Time `json:"buildTime"`
+	} `json:"metadata"`
+}
+
+// arOperation is a long-running operation.
+type arOperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ListManifests lists all versions of the image's package. The created time
+// is the build time reported by the registry, or the time the version was
+// created if there is none. The uploaded time is the time the version was
+// created.
+func (r *ArtifactRegistry) ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error) {
+	pkg, err := arPackagePath(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	type page struct {
+		Versions      []*arVersion `json:"versions"`
+		NextPageToken string       `json:"nextPageToken"`
+	}
+
+	manifests := make(map[string]ManifestInfo, 8)
+	u := fmt.Sprintf("%s/v1/%s/versions?view=FULL&pageSize=%d", r.baseURL, pkg, arPageSize)
+	if err := r.paginate(ctx, repo.RegistryStr(), u, func() any { return &page{} }, func(v any) string {
+		p := v.(*page)
+		for _, version := range p.Versions {
+			digest := version.Name[strings.LastIndex(version.Name, "/")+1:]
+
+			var tags []string
+			for _, t := range version.RelatedTags {
+				tag, err := url.PathUnescape(t.Name[strings.LastIndex(t.Name, "/")+1:])
+				if err != nil {
+					tag = t.Name[strings.LastIndex(t.Name, "/")+1:]
+				}
+				tags = append(tags, tag)
+			}
+			sort.Strings(tags)
+
+			uploaded := version.CreateTime
+			if uploaded.IsZero() {
+				uploaded = version.UpdateTime
+			}
+			created := version.Metadata.BuildTime
+			if created.IsZero() {
+				created = uploaded
+			}
+			size, _ := strconv.ParseUint(version.Metadata.ImageSizeBytes, 10, 64)
+
+			manifests[digest] = ManifestInfo{
+				Size:      size,
+				MediaType: version.Metadata.MediaType,
+				Created:   created.UTC(),
+				Uploaded:  uploaded.UTC(),
+				Tags:      tags,
+			}
+		}
+		return p.NextPageToken
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	return manifests, nil
+}
+
+// DeleteTag deletes the tag.
+func (r *ArtifactRegistry) DeleteTag(ctx context.Context, tag gcrname.Tag) error {
+	pkg, err := arPackagePath(tag.Context())
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/v1/%s/tags/%s", r.baseURL, pkg, url.PathEscape(tag.TagStr()))
+	if err := r.do(ctx, tag.RegistryStr(), http.MethodDelete, u, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete tag: %w", err)
+	}
+	return nil
+}
+
+// DeleteDigest deletes the version.
+func (r *ArtifactRegistry) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	return r.DeleteBatch(ctx, []gcrname.Reference{digest})[0]
+}
+
+// DeleteBatch deletes the refs. Tags are deleted concurrently, since the API
+// has no batch operation for tags. Digests are deleted with batchDelete, up to
+// 1000 per request. A batch succeeds or fails as a whole.
+func (r *ArtifactRegistry) DeleteBatch(ctx context.Context, refs []gcrname.Reference) []error {
+	errs := make([]error, len(refs))
+
+	var digests []int
+	w := worker.New[worker.Void](r.concurrency)
+	for i, ref := range refs {
+		i := i
+
+		switch typ := ref.(type) {
+		case gcrname.Tag:
+			if err := w.Do(ctx, func() (worker.Void, error) {
+				errs[i] = r.DeleteTag(ctx, typ)
+				return worker.Void{}, nil
+			}); err != nil {
+				errs[i] = err
+			}
+		case gcrname.Digest:
+			digests = append(digests, i)
+		default:
+			errs[i] = fmt.Errorf("unknown reference type %T", ref)
+		}
+	}
+
+	for start := 0; start < len(digests); start += arBatchSize {
+		end := start + arBatchSize
+		if end > len(digests) {
+			end = len(digests)
+		}
+		batch := digests[start:end]
+
+		err := r.batchDelete(ctx, refs[batch[0]].Context(), refs, batch)
+		for _, i := range batch {
+			errs[i] = err
+		}
+	}
+
+	if _, err := w.Done(ctx); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+// batchDelete deletes the versions for the refs at the given indexes and waits
+// for the operation to finish.
+func (r *ArtifactRegistry) batchDelete(ctx context.Context, repo gcrname.Repository, refs []gcrname.Reference, indexes []int) error {
+	pkg, err := arPackagePath(repo)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		names = append(names, fmt.Sprintf("%s/versions/%s", pkg, refs[i].Identifier()))
+	}
+
+	var op arOperation
+	u := fmt.Sprintf("%s/v1/%s/versions:batchDelete", r.baseURL, pkg)
+	if err := r.do(ctx, repo.RegistryStr(), http.MethodPost, u, map[string]any{
+		"names": names,
+	}, &op); err != nil {
+		return fmt.Errorf("failed to batch delete versions: %w", err)
+	}
+
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+
+		if err := r.do(ctx, repo.RegistryStr(), http.MethodGet, r.baseURL+"/v1/"+op.Name, nil, &op); err != nil {
+			return fmt.Errorf("failed to get operation %s: %w", op.Name, err)
+		}
+	}
+
+	if op.Error != nil {
+		return &arOperationError{Code: op.Error.Code, Message: op.Error.Message}
+	}
+	return nil
+}
+
+// Catalog lists all repositories on the host using the registry API, since the
+// Artifact Registry API can only list repositories per project.
+func (r *ArtifactRegistry) Catalog(ctx context.Context, registry gcrname.Registry) ([]string, error) {
+	return r.manifests.Catalog(ctx, registry)
+}
+
+// CatalogScope lists the images in the project and location of the registry.
+// If the scope includes a repository (e.g. "my-project/my-repo"), only images
+// in that repository are listed.
+func (r *ArtifactRegistry) CatalogScope(ctx context.Context, registry gcrname.Registry, scope string) ([]string, error) {
+	location, err := arLocation(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	project, rest, _ := strings.Cut(scope, "/")
+	repository, _, _ := strings.Cut(rest, "/")
+	host := registry.RegistryStr()
+
+	var repositories []string
+	if repository != "" {
+		repositories = append(repositories, repository)
+	} else {
+		type page struct {
+			Repositories []struct {
+				Name   string `json:"name"`
+				Format string `json:"format"`
+			} `json:"repositories"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		u := fmt.Sprintf("%s/v1/projects/%s/locations/%s/repositories?pageSize=%d",
+			r.baseURL, url.PathEscape(project), location, arPageSize)
+		if err := r.paginate(ctx, host, u, func() any { return &page{} }, func(v any) string {
+			p := v.(*page)
+			for _, repo := range p.Repositories {
+				if repo.Format == "DOCKER" {
+					repositories = append(repositories, repo.Name[strings.LastIndex(repo.Name, "/")+1:])
+				}
+			}
+			return p.NextPageToken
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %w", err)
+		}
+	}
+
+	type page struct {
+		Packages []struct {
+			Name string `json:"name"`
+		} `json:"packages"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+
+	var repos []string
+	for _, repository := range repositories {
+		u := fmt.Sprintf("%s/v1/projects/%s/locations/%s/repositories/%s/packages?pageSize=%d",
+			r.baseURL, url.PathEscape(project), location, url.PathEscape(repository), arPageSize)
+		if err := r.paginate(ctx, host, u, func() any { return &page{} }, func(v any) string {
+			p := v.(*page)
+			for _, pkg := range p.Packages {
+				id := pkg.Name[strings.LastIndex(pkg.Name, "/")+1:]
+				if unescaped, err := url.PathUnescape(id); err == nil {
+					id = unescaped
+				}
+				repos = append(repos, project+"/"+repository+"/"+id)
+			}
+			return p.NextPageToken
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list packages: %w", err)
+		}
+	}
+	return repos, nil
+}
+
+// FetchManifest fetches the manifest using the registry API.
+func (r *ArtifactRegistry) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	return r.manifests.FetchManifest(ctx, ref)
+}
+
+// FetchBlob fetches the blob using the registry API.
+func (r *ArtifactRegistry) FetchBlob(ctx context.Context, digest gcrname.Digest) ([]byte, error) {
+	return fetchBlob(ctx, r.manifests, digest)
+}
+
+// ListReferrers lists the referrers using the registry API.
+func (r *ArtifactRegistry) ListReferrers(ctx context.Context, subject gcrname.Digest) ([]string, error) {
+	return listReferrers(ctx, r.manifests, subject)
+}
+
+// paginate calls the list endpoint until there are no more pages. newPage
+// returns the value to decode each page into, and handle processes the page
+// and returns the next page token.
+func (r *ArtifactRegistry) paginate(ctx context.Context, host, u string, newPage func() any, handle func(any) string) error {
+	token := ""
+	for {
+		pageURL := u
+		if token != "" {
+			pageURL += "&pageToken=" + url.QueryEscape(token)
+		}
+
+		page := newPage()
+		if err := r.do(ctx, host, http.MethodGet, pageURL, nil, page); err != nil {
+			return err
+		}
+
+		token = handle(page)
+		if token == "" {
+			return nil
+		}
+	}
+}
+
+// do performs an authenticated request against the Artifact Registry API.
+// Credentials are resolved from the keychain for the registry host on every
+// request, so refreshed tokens are picked up.
+func (r *ArtifactRegistry) do(ctx context.Context, host, method, u string, body, out any) error {
+	token, err := keychainToken(r.keychain, host)
+	if err != nil {
+		return err
+	}
+
+	req, err := newJSONRequest(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return doJSON(r.client, req, out)
+}
+
+// arLocation returns the location of the Artifact Registry host.
+func arLocation(registry gcrname.Registry) (string, error) {
+	matches := arHostRe.FindStringSubmatch(registry.RegistryStr())
+	if matches == nil {
+		return "", fmt.Errorf("invalid artifact registry host %q", registry.RegistryStr())
+	}
+	return matches[1], nil
+}
+
+// arPackagePath returns the API resource name of the image's package, e.g.
+// "projects/p/locations/us/repositories/r/packages/a%2Fb" for
+// "us-docker.pkg.dev/p/r/a/b".
+func arPackagePath(repo gcrname.Repository) (string, error) {
+	location, err := arLocation(repo.Registry)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(repo.RepositoryStr(), "/", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid artifact registry repository %q: must be project/repository/image", repo.RepositoryStr())
+	}
+
+	return fmt.Sprintf("projects/%s/locations/%s/repositories/%s/packages/%s",
+		url.PathEscape(parts[0]), location, url.PathEscape(parts[1]), url.PathEscape(parts[2])), nil
+}
+
+// arOperationError is a failed long-running operation.
+type arOperationError struct {
+	Code    int
+	Message string
+}
+
+func (e *arOperationError) Error() string {
+	return fmt.Sprintf("operation failed with code %d: %s", e.Code, e.Message)
+}
+
+// Temporary returns true if the operation may succeed if retried. These are
+// the RESOURCE_EXHAUSTED and UNAVAILABLE codes.
+func (e *arOperationError) Temporary() bool {
+	return e.Code == 8 || e.Code == 14
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/bearerkeychain"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// fakeArtifactRegistry is a minimal stand-in for the Artifact Registry REST
+// API with a single project ("proj") in a single location ("us").
+type fakeArtifactRegistry struct {
+	server *httptest.Server
+
+	lock        sync.Mutex
+	deletedTags []string
+	batches     [][]string
+	polls       int
+}
+
+func newFakeArtifactRegistry(tb testing.TB, versions []map[string]any) *fakeArtifactRegistry {
+	tb.Helper()
+
+	f := &fakeArtifactRegistry{}
+
+	const parent = "/v1/projects/proj/locations/us/repositories"
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, fn http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if got, want := r.Header.Get("Authorization"), "Bearer ya29.token"; got != want {
+				http.Error(w, `{"error":{"code":401}}`, http.StatusUnauthorized)
+				return
+			}
+
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			fn(w, r)
+		})
+	}
+
+	handle("GET "+parent, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"repositories":[
+			{"name":"projects/proj/locations/us/repositories/docker-repo","format":"DOCKER"},
+			{"name":"projects/proj/locations/us/repositories/npm-repo","format":"NPM"}
+		]}`)
+	})
+
+	handle("GET "+parent+"/docker-repo/packages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprintf(w, `{"packages":[{"name":"projects/proj/locations/us/repositories/docker-repo/packages/app"}],"nextPageToken":"2"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"packages":[{"name":"projects/proj/locations/us/repositories/docker-repo/packages/tools%%2Fbuild"}]}`)
+	})
+
+	handle("GET "+parent+"/docker-repo/packages/tools%2Fbuild/versions", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Query().Get("view"), "FULL"; got != want {
+			http.Error(w, "expected full view", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"versions": versions})
+	})
+
+	handle("DELETE "+parent+"/docker-repo/packages/tools%2Fbuild/tags/", func(w http.ResponseWriter, r *http.Request) {
+		f.deletedTags = append(f.deletedTags, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		fmt.Fprintf(w, `{}`)
+	})
+
+	handle("POST "+parent+"/docker-repo/packages/tools%2Fbuild/versions:batchDelete", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Names []string `json:"names"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var batch []string
+		for _, name := range body.Names {
+			batch = append(batch, name[strings.LastIndex(name, "/")+1:])
+		}
+		f.batches = append(f.batches, batch)
+		fmt.Fprintf(w, `{"name":"projects/proj/locations/us/operations/op-%d","done":false}`, len(f.batches))
+	})
+
+	handle("GET /v1/projects/proj/locations/us/operations/", func(w http.ResponseWriter, r *http.Request) {
+		f.polls++
+		fmt.Fprintf(w, `{"name":"projects/proj/locations/us/operations/%s","done":true}`,
+			r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+	})
+
+	f.server = httptest.NewServer(mux)
+	tb.Cleanup(f.server.Close)
+	return f
+}
+
+func newTestArtifactRegistry(tb testing.TB, f *fakeArtifactRegistry, manifests Registry) *ArtifactRegistry {
+	tb.Helper()
+
+	registry := NewArtifactRegistry(&ArtifactRegistryConfig{
+		URL: f.server.URL,
+	}, bearerkeychain.New("ya29.token"), NewLogger("error", io.Discard, io.Discard), 2, manifests)
+	registry.pollInterval = time.Millisecond
+	return registry
+}
+
+func TestArtifactRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+
+	const pkg = "projects/proj/locations/us/repositories/docker-repo/packages/tools%2Fbuild"
+
+	f := newFakeArtifactRegistry(t, []map[string]any{
+		{
+			"name":       pkg + "/versions/" + aa,
+			"createTime": "2024-01-02T00:00:00Z",
+			"updateTime": "2024-01-03T00:00:00Z",
+			"relatedTags": []map[string]any{
+				{"name": pkg + "/tags/v1"},
+				{"name": pkg + "/tags/latest"},
+			},
+			"metadata": map[string]any{
+				"imageSizeBytes": "1024",
+				"mediaType":      "application/vnd.oci.image.manifest.v1+json",
+				"buildTime":      "2024-01-01T00:00:00Z",
+			},
+		},
+		{
+			"name":       pkg + "/versions/" + bb,
+			"createTime": "2024-01-02T00:00:00Z",
+			"updateTime": "2024-01-02T00:00:00Z",
+		},
+	})
+	registry := newTestArtifactRegistry(t, f, &fakeRegistry{repos: []string{"proj/docker-repo/app"}})
+
+	repo := mustRepository(t, "us-docker.pkg.dev/proj/docker-repo/tools/build")
+
+	manifests, err := registry.ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]ManifestInfo{
+		aa: {
+			Size:      1024,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Created:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Uploaded:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Tags:      []string{"latest", "v1"},
+		},
+		bb: {
+			Created:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Uploaded: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	if got := manifests; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v to be %#v", got, want)
+	}
+
+	errs := registry.DeleteBatch(ctx, []gcrname.Reference{repo.Tag("v1"), repo.Tag("latest")})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs = registry.DeleteBatch(ctx, []gcrname.Reference{repo.Digest(aa), repo.Digest(bb)})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sort.Strings(f.deletedTags)
+	if got, want := f.deletedTags, []string{"latest", "v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := f.batches, [][]string{{aa, bb}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := f.polls, 1; got != want {
+		t.Errorf("expected %d polls to be %d", got, want)
+	}
+}
+
+func TestArtifactRegistry_CatalogScope(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	f := newFakeArtifactRegistry(t, nil)
+
+	fallback := &fakeRegistry{repos: []string{"other/repo/image"}}
+	router := NewRegistryRouter(fallback)
+	if err := router.Handle(ArtifactRegistryHostPattern, newTestArtifactRegistry(t, f, fallback)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCleaner(t, WithRegistry(router))
+
+	cases := []struct {
+		name  string
+		roots []string
+		exp   []string
+	}{
+		{
+			name:  "project",
+			roots: []string{"us-docker.pkg.dev/proj"},
+			exp: []string{
+				"us-docker.pkg.dev/proj/docker-repo/app",
+				"us-docker.pkg.dev/proj/docker-repo/tools/build",
+			},
+		},
+		{
+			name:  "image_prefix",
+			roots: []string{"us-docker.pkg.dev/proj/docker-repo/tools"},
+			exp: []string{
+				"us-docker.pkg.dev/proj/docker-repo/tools/build",
+			},
+		},
+		{
+			name:  "entire_host",
+			roots: []string{"us-docker.pkg.dev"},
+			exp: []string{
+				"us-docker.pkg.dev/other/repo/image",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repos, err := c.ListChildRepositories(ctx, tc.roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := repos, tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Buckets is a grandfather-father-son retention schedule. Each field is the
+// number of calendar periods, counting back from the current one, in which the
+// newest image is kept. For example, Daily: 7 keeps the newest image of each
+// of the last 7 days, including today. Periods are in UTC and weeks start on
+// Monday.
+type Buckets struct {
+	Daily   int64 `json:"daily,omitempty"`
+	Weekly  int64 `json:"weekly,omitempty"`
+	Monthly int64 `json:"monthly,omitempty"`
+	Yearly  int64 `json:"yearly,omitempty"`
+}
+
+// validate returns an error if any of the counts are negative.
+func (b *Buckets) validate() error {
+	if b == nil {
+		return nil
+	}
+
+	if b.Daily < 0 || b.Weekly < 0 || b.Monthly < 0 || b.Yearly < 0 {
+		return fmt.Errorf("bucket counts must be positive")
+	}
+	return nil
+}
+
+// String returns a human-readable description of the schedule.
+func (b *Buckets) String() string {
+	return fmt.Sprintf("daily=%d, weekly=%d, monthly=%d, yearly=%d",
+		b.Daily, b.Weekly, b.Monthly, b.Yearly)
+}
+
+// bucketPeriod is a single kind of calendar period.
+type bucketPeriod struct {
+	name  string
+	count int64
+
+	// start returns the beginning of the period that contains t.
+	start func(t time.Time) time.Time
+
+	// shift moves the beginning of a period by n periods.
+	shift func(t time.Time, n int) time.Time
+
+	// key formats the period that contains t.
+	key func(t time.Time) string
+}
+
+// bucketFiller assigns images to buckets. Images must be given newest first,
+// so the first image in each period fills it.
+type bucketFiller struct {
+	periods []*bucketPeriod
+	oldest  []time.Time
+	filled  []map[string]struct{}
+}
+
+// newBucketFiller creates a filler for the schedule relative to now. It
+// returns nil if b is nil.
+func newBucketFiller(b *Buckets, now time.Time) *bucketFiller {
+	if b == nil {
+		return nil
+	}
+
+	now = now.UTC()
+	periods := []*bucketPeriod{
+		{
+			name:  "daily",
+			count: b.Daily,
+			start: func(t time.Time) time.Time {
+				return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			},
+			shift: func(t time.Time, n int) time.Time { return t.AddDate(0, 0, n) },
+			key:   func(t time.Time) string { return t.Format("2006-01-02") },
+		},
+		{
+			name:  "weekly",
+			count: b.Weekly,
+			start: func(t time.Time) time.Time {
+				offset := (int(t.Weekday()) + 6) % 7
+				return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+			},
+			shift: func(t time.Time, n int) time.Time { return t.AddDate(0, 0, 7*n) },
+			key: func(t time.Time) string {
+				year, week := t.ISOWeek()
+				return fmt.Sprintf("%04d-W%02d", year, week)
+			},
+		},
+		{
+			name:  "monthly",
+			count: b.Monthly,
+			start: func(t time.Time) time.Time {
+				return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+			},
+			shift: func(t time.Time, n int) time.Time { return t.AddDate(0, n, 0) },
+			key:   func(t time.Time) string { return t.Format("2006-01") },
+		},
+		{
+			name:  "yearly",
+			count: b.Yearly,
+			start: func(t time.Time) time.Time {
+				return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+			},
+			shift: func(t time.Time, n int) time.Time { return t.AddDate(n, 0, 0) },
+			key:   func(t time.Time) string { return t.Format("2006") },
+		},
+	}
+
+	f := &bucketFiller{}
+	for _, p := range periods {
+		if p.count <= 0 {
+			continue
+		}
+		f.periods = append(f.periods, p)
+		f.oldest = append(f.oldest, p.shift(p.start(now), -int(p.count-1)))
+		f.filled = append(f.filled, make(map[string]struct{}, p.count))
+	}
+	return f
+}
+
+// fill returns the buckets that the image fills, such as "daily 2024-01-31,
+// weekly 2024-W05", or the empty string if it fills none. An image fills every
+// bucket in which it is the newest image.
+func (f *bucketFiller) fill(m *manifest) string {
+	if f == nil {
+		return ""
+	}
+
+	t := m.created()
+	if t.Before(dockerExistence) {
+		t = m.uploaded()
+	}
+
+	var buckets []string
+	for i, p := range f.periods {
+		if t.Before(f.oldest[i]) {
+			continue
+		}
+
+		key := p.key(t)
+		if _, ok := f.filled[i][key]; ok {
+			continue
+		}
+		f.filled[i][key] = struct{}{}
+		buckets = append(buckets, p.name+" "+key)
+	}
+	return strings.Join(buckets, ", ")
+}
+
+// fillAll fills the buckets with the tagged images of the repository, which
+// must be sorted newest first, and returns the buckets that each image fills
+// by digest. Children and artifacts follow their parent or subject, so they do
+// not fill buckets. It returns nil if f is nil.
+func (f *bucketFiller) fillAll(manifests []*manifest, graph *manifestGraph) map[string]string {
+	if f == nil {
+		return nil
+	}
+
+	filled := make(map[string]string, len(manifests))
+	for _, m := range manifests {
+		if len(m.Info.Tags) == 0 || graph.isChild(m) || graph.isArtifact(m) {
+			continue
+		}
+		if bucket := f.fill(m); bucket != "" {
+			filled[m.Digest] = bucket
+		}
+	}
+	return filled
+}
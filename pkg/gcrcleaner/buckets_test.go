@@ -0,0 +1,105 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketFiller_Fill(t *testing.T) {
+	t.Parallel()
+
+	// Friday of ISO week 11.
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+	newManifest := func(created time.Time) *manifest {
+		return &manifest{
+			Info: ManifestInfo{
+				Created:  created,
+				Uploaded: created,
+			},
+		}
+	}
+
+	day := func(d int, hour int) time.Time {
+		return time.Date(2024, time.March, d, hour, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name     string
+		buckets  *Buckets
+		manifest *manifest
+		exp      string
+	}{
+		{
+			name:     "newest_fills_all",
+			manifest: newManifest(day(15, 10)),
+			exp:      "daily 2024-03-15, weekly 2024-W11, monthly 2024-03",
+		},
+		{
+			name:     "same_day",
+			manifest: newManifest(day(15, 8)),
+			exp:      "",
+		},
+		{
+			name:     "previous_day",
+			manifest: newManifest(day(14, 8)),
+			exp:      "daily 2024-03-14",
+		},
+		{
+			name:     "outside_daily_window",
+			manifest: newManifest(day(12, 8)),
+			exp:      "",
+		},
+		{
+			name:     "previous_week",
+			manifest: newManifest(day(8, 8)),
+			exp:      "weekly 2024-W10",
+		},
+		{
+			name:     "outside_weekly_window",
+			manifest: newManifest(day(1, 8)),
+			exp:      "",
+		},
+		{
+			name:     "previous_month",
+			manifest: newManifest(time.Date(2024, time.February, 20, 0, 0, 0, 0, time.UTC)),
+			exp:      "monthly 2024-02",
+		},
+		{
+			name: "created_before_docker",
+			manifest: &manifest{
+				Info: ManifestInfo{
+					Created:  time.Unix(0, 0),
+					Uploaded: time.Date(2024, time.January, 20, 0, 0, 0, 0, time.UTC),
+				},
+			},
+			exp: "",
+		},
+	}
+
+	// The cases share a filler and run in order, newest first.
+	f := newBucketFiller(&Buckets{Daily: 3, Weekly: 2, Monthly: 2}, now)
+	for _, tc := range cases {
+		if got, want := f.fill(tc.manifest), tc.exp; got != want {
+			t.Errorf("%s: expected %q to be %q", tc.name, got, want)
+		}
+	}
+
+	if got := (*bucketFiller)(nil).fill(newManifest(now)); got != "" {
+		t.Errorf("expected %q to be empty", got)
+	}
+}
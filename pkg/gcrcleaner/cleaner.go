@@ -17,18 +17,18 @@ package gcrcleaner
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/version"
 	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
 	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
 	gcrname "github.com/google/go-containerregistry/pkg/name"
-	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
-	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
 )
 
 // dockerExistence is date of the first release of Docker[1] (then dotCloud) and
@@ -40,6 +40,14 @@ import (
 // [2]: https://buildpacks.io/docs/features/reproducibility/
 var dockerExistence = time.Date(2013, time.March, 20, 0, 0, 0, 0, time.UTC)
 
+// deleteRetryAttempts is the maximum number of attempts to delete a single ref
+// when the registry returns a transient error.
+const deleteRetryAttempts = 3
+
+// deleteRetryBackoff is the initial backoff between delete attempts. It doubles
+// after each attempt.
+var deleteRetryBackoff = 1 * time.Second
+
 // userAgent is the HTTP user agent.
 var userAgent = fmt.Sprintf("%s/%s (+https://github.com/GoogleCloudPlatform/gcr-cleaner)",
 	version.Name, version.Version)
@@ -47,40 +55,200 @@ var userAgent = fmt.Sprintf("%s/%s (+https://github.com/GoogleCloudPlatform/gcr-
 // Cleaner is a gcr cleaner.
 type Cleaner struct {
 	keychain    gcrauthn.Keychain
+	registry    Registry
 	logger      *Logger
 	concurrency int64
+
+	// metadata caches the manifest metadata that is fetched across runs.
+	metadata *metadataCache
+
+	// inUse, if set, lists the images that are in use and must be kept.
+	inUse InUseLister
+}
+
+// CleanerOption is an option for configuring the cleaner.
+type CleanerOption func(c *Cleaner)
+
+// CleanOption is an option for a single clean of a repository.
+type CleanOption func(o *cleanOptions)
+
+// cleanOptions are the options for a single clean of a repository.
+type cleanOptions struct {
+	// inUse are the images in use of the run, if inUseListed is true.
+	inUse       []*InUseImage
+	inUseListed bool
+}
+
+// WithRegistry configures the cleaner to use the given registry instead of
+// the default RemoteRegistry.
+func WithRegistry(registry Registry) CleanerOption {
+	return func(c *Cleaner) {
+		c.registry = registry
+	}
 }
 
 // NewCleaner creates a new GCR cleaner with the given token provider and
 // concurrency.
-func NewCleaner(keychain gcrauthn.Keychain, logger *Logger, concurrency int64) (*Cleaner, error) {
-	return &Cleaner{
+func NewCleaner(keychain gcrauthn.Keychain, logger *Logger, concurrency int64, opts ...CleanerOption) (*Cleaner, error) {
+	c := &Cleaner{
 		keychain:    keychain,
 		concurrency: concurrency,
 		logger:      logger,
-	}, nil
+		metadata:    newMetadataCache(defaultMetadataCacheSize),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.registry == nil {
+		c.registry = NewRemoteRegistry(keychain, logger, concurrency)
+	}
+	return c, nil
 }
 
 // Clean deletes old images from GCR that are (un)tagged and older than "since"
-// and higher than the "keep" amount.
+// and higher than the "keep" amount. It returns the deleted refs, sorted.
+//
+// Deprecated: Use CleanPolicy or CleanWithResult, which support every
+// retention option.
 func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep int64, tagFilter TagFilter, dryRun bool) ([]string, error) {
+	deleted, err := c.CleanPolicy(ctx, repo, &Policy{
+		Name:      "default",
+		OlderThan: since,
+		Keep:      keep,
+		TagFilter: tagFilter,
+		DryRun:    dryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]string, 0, len(deleted))
+	for _, ref := range deleted {
+		refs = append(refs, ref.Ref)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// CleanPolicy deletes old images from GCR that are (un)tagged and older than
+// the policy's grace period and higher than the policy's "keep" amount.
+func (c *Cleaner) CleanPolicy(ctx context.Context, repo string, policy *Policy) ([]*DeletedRef, error) {
+	images, err := c.ListInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.CleanWithResult(ctx, repo, policy, WithInUseImages(images))
+	if err != nil {
+		return nil, err
+	}
+	return result.Deleted, nil
+}
+
+// CleanWithResult is like CleanPolicy, but also returns the images that were kept
+// because of a protected tag or to fill a retention bucket. If the cleaner has
+// an in-use lister, the images in use must be given with WithInUseImages.
+func (c *Cleaner) CleanWithResult(ctx context.Context, repo string, policy *Policy, opts ...CleanOption) (*CleanResult, error) {
+	var o cleanOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if c.inUse != nil && !o.inUseListed {
+		return nil, fmt.Errorf("images in use were not listed for repo %s, use ListInUse and WithInUseImages", repo)
+	}
+
 	gcrrepo, err := gcrname.NewRepository(repo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get repo %s: %w", repo, err)
 	}
 	c.logger.Debug("computed repo", "repo", gcrrepo.Name())
 
-	tags, err := gcrgoogle.List(gcrrepo,
-		gcrgoogle.WithContext(ctx),
-		gcrgoogle.WithUserAgent(userAgent),
-		gcrgoogle.WithAuthFromKeychain(c.keychain))
+	if policy.TagFilter == nil {
+		p := *policy
+		p.TagFilter = &TagFilterNull{}
+		policy = &p
+	}
+
+	now := time.Now()
+	since := policy.Since(now)
+	dryRun := policy.DryRun
+	c.logger.Debug("computed policy",
+		"repo", gcrrepo.Name(),
+		"policy", policy.Name,
+		"since", since.Format(time.RFC3339),
+		"untagged_grace", policy.UntaggedGrace,
+		"tagged_grace", policy.TaggedGrace,
+		"newer_than", policy.NewerThan.Format(time.RFC3339),
+		"keep", policy.Keep,
+		"keep_group", policy.KeepGroup.Name(),
+		"protected_tags", policy.ProtectedTags,
+		"untag_only", policy.UntagOnly,
+		"tag_filter", policy.TagFilter.Name(),
+		"expression", policy.Expression.String(),
+		"semver", policy.Semver,
+		"buckets", policy.Buckets,
+		"time_source", policy.TimeSource.String(),
+		"retention_labels", policy.RetentionLabels,
+		"delete_orphans", policy.DeleteOrphans,
+		"type_filter", policy.TypeFilter.String(),
+		"quota", policy.Quota,
+		"dry_run", dryRun)
+
+	infos, err := c.registry.ListManifests(ctx, gcrrepo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list tags for repo %s: %w", repo, err)
 	}
 
-	var manifests = make([]*manifest, 0, len(tags.Manifests))
-	for k, m := range tags.Manifests {
-		manifests = append(manifests, &manifest{repo, k, m})
+	var manifests = make([]*manifest, 0, len(infos))
+	var byDigest = make(map[string]*manifest, len(infos))
+	for k, m := range infos {
+		mf := &manifest{Repo: repo, Digest: k, Info: m}
+		manifests = append(manifests, mf)
+		byDigest[k] = mf
+	}
+
+	// Build the graph of image indexes and their children.
+	graph, err := c.buildGraph(ctx, gcrrepo, manifests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build manifest graph for repo %s: %w", repo, err)
+	}
+
+	// Images in use are kept.
+	if o.inUseListed {
+		markInUse(gcrrepo, manifests, o.inUse)
+	}
+
+	// Read the retention labels, media types, and artifact types that the
+	// registry did not report. Labels are also available to the expression and
+	// time source.
+	var needMetadata []*manifest
+	for _, m := range manifests {
+		if needsMetadata(m, graph, policy) {
+			needMetadata = append(needMetadata, m)
+		}
+	}
+	if len(needMetadata) > 0 {
+		if err := c.fetchMetadata(ctx, gcrrepo, needMetadata, policy.needsLabels()); err != nil {
+			return nil, fmt.Errorf("failed to fetch manifest metadata for repo %s: %w", repo, err)
+		}
+	}
+
+	if policy.TimeSource != nil {
+		for _, m := range manifests {
+			m.Time, m.TimeSource = policy.TimeSource.resolve(m)
+			c.logger.Debug("resolved manifest time",
+				"repo", repo,
+				"digest", m.Digest,
+				"time", m.Time.Format(time.RFC3339),
+				"time_source", m.TimeSource)
+		}
+	}
+
+	// Find the untagged referrers among the images that would be deleted, now
+	// that their times are known.
+	if err := c.findReferrers(ctx, gcrrepo, manifests, graph, now, policy); err != nil {
+		return nil, fmt.Errorf("failed to find referrers for repo %s: %w", repo, err)
 	}
 
 	// Sort manifests. If either of the containers were created before Docker even
@@ -89,8 +257,8 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 	// fall back to the upload date. Otherwise, we sort by the container creation
 	// date.
 	sort.Slice(manifests, func(i, j int) bool {
-		jCreated, jUploaded := manifests[j].Info.Created, manifests[j].Info.Uploaded
-		iCreated, iUploaded := manifests[i].Info.Created, manifests[i].Info.Uploaded
+		jCreated, jUploaded := manifests[j].created(), manifests[j].uploaded()
+		iCreated, iUploaded := manifests[i].created(), manifests[i].uploaded()
 
 		// If either container has a CreateTime that predates Docker's existence, or
 		// the contains have the same creation time, fallback to the uploaded time.
@@ -110,229 +278,961 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 			"tags":     m.Info.Tags,
 			"created":  m.Info.Created.Format(time.RFC3339),
 			"uploaded": m.Info.Uploaded.Format(time.RFC3339),
+			"time":     m.Time.Format(time.RFC3339),
 		})
 	}
 	c.logger.Debug("computed all manifests",
-		"keep", keep,
+		"keep", policy.Keep,
 		"manifests", manifestListForLog)
 
-	// Create the worker.
-	w := worker.New[string](c.concurrency)
+	// Decide which manifests to delete.
+	plan := c.plan(repo, manifests, graph, now, policy)
+	toDelete := plan.Delete
+
+	// Registries that cannot remove a single tag keep the images that
+	// untag-only mode would untag, with all of their tags.
+	if len(plan.Untag) > 0 && !canUntag(c.registry, gcrrepo) {
+		for _, u := range plan.Untag {
+			c.logger.Warn("registry cannot remove a single tag, keeping image",
+				"repo", repo,
+				"digest", u.Digest,
+				"tags", u.Tags)
+
+			m := byDigest[u.Digest]
+			plan.Kept = append(plan.Kept, &KeptRef{
+				Digest:      m.Digest,
+				Tags:        m.Info.Tags,
+				MediaType:   m.Info.MediaType,
+				NotUntagged: u.Tags,
+			})
+		}
+		plan.Untag = nil
+	}
+
+	// Estimate the storage that the deletions reclaim before deleting anything,
+	// so that dry runs report the same numbers. The estimate is best effort and
+	// does not fail the run.
+	var size *RepoSize
+	if len(toDelete) > 0 || policy.Quota > 0 {
+		size, err = c.measureSizes(ctx, gcrrepo, manifests, graph, toDelete, policy.Quota)
+		if err != nil {
+			c.logger.Warn("failed to estimate reclaimable storage",
+				"repo", repo,
+				"error", err)
+		}
+	}
+
+	deleted := make([]*DeletedRef, 0, len(toDelete))
+	errs := make([]error, 0, 4)
+
+	// Delete all tags before attempting to delete the digests later.
+	var digestsToDelete = make([]string, 0, len(toDelete))
+	var tagRefs = make([]gcrname.Reference, 0, len(toDelete))
+	var tagDigests = make([]string, 0, len(toDelete))
+	var tagUntagged = make([]bool, 0, len(toDelete))
+	for _, m := range toDelete {
+		// Make note that we need to delete this digest.
+		digestsToDelete = append(digestsToDelete, m.Digest)
+
+		for _, tag := range m.Info.Tags {
+			c.logger.Debug("deleting tag",
+				"repo", repo,
+				"digest", m.Digest,
+				"tag", tag)
+
+			tagRefs = append(tagRefs, gcrrepo.Tag(tag))
+			tagDigests = append(tagDigests, m.Digest)
+			tagUntagged = append(tagUntagged, false)
+		}
+	}
+
+	// In untag-only mode, the matching tags of kept images are removed too.
+	for _, u := range plan.Untag {
+		for _, tag := range u.Tags {
+			c.logger.Debug("removing tag",
+				"repo", repo,
+				"digest", u.Digest,
+				"tag", tag)
+
+			tagRefs = append(tagRefs, gcrrepo.Tag(tag))
+			tagDigests = append(tagDigests, u.Digest)
+			tagUntagged = append(tagUntagged, true)
+		}
+	}
+
+	// Deleting the digests is only safe after all the tags have been deleted,
+	// so this finishes first.
+	tagErrs, err := c.deleteRefs(ctx, gcrrepo, tagRefs, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	for i, ref := range tagRefs {
+		// Registries that cannot remove a single tag remove it when its
+		// manifest is deleted below.
+		if errors.Is(tagErrs[i], ErrUntagUnsupported) && !tagUntagged[i] {
+			c.logger.Debug("tag is deleted with its manifest",
+				"repo", repo,
+				"tag", ref.Identifier())
+			tagErrs[i] = nil
+		}
+		if tagErrs[i] != nil {
+			errs = append(errs, fmt.Errorf("failed to delete tag %s: %w", ref, tagErrs[i]))
+			continue
+		}
+		deleted = append(deleted, &DeletedRef{
+			Ref:          ref.Identifier(),
+			Digest:       tagDigests[i],
+			Subject:      graph.subjects[tagDigests[i]],
+			Untagged:     tagUntagged[i],
+			Threshold:    plan.Thresholds[tagDigests[i]],
+			MediaType:    byDigest[tagDigests[i]].Info.MediaType,
+			ArtifactType: byDigest[tagDigests[i]].Info.ArtifactType,
+		})
+	}
+
+	// Registries refuse to delete (or end up with broken) image indexes when
+	// their children are deleted first, so delete in topological order: each
+	// layer only contains digests whose parents were in an earlier layer.
+	layers := graph.deletionOrder(digestsToDelete)
+	c.logger.Debug("computed digest deletion order",
+		"repo", repo,
+		"layers", layers)
+
+	var failed = make(map[string]struct{})
+
+	for _, layer := range layers {
+		var refs = make([]gcrname.Reference, 0, len(layer))
+		var digests = make([]string, 0, len(layer))
+
+	LAYER:
+		for _, digest := range layer {
+			// If a parent or artifact failed to delete, deleting this digest
+			// would leave a dangling index or an orphaned artifact.
+			for _, prev := range graph.before(digest) {
+				if _, ok := failed[prev]; ok {
+					failed[digest] = struct{}{}
+					errs = append(errs, fmt.Errorf("failed to delete digest %s: %s was not deleted", digest, prev))
+					continue LAYER
+				}
+			}
+
+			c.logger.Debug("deleting digest",
+				"repo", repo,
+				"digest", digest)
+
+			refs = append(refs, gcrrepo.Digest(digest))
+			digests = append(digests, digest)
+		}
+
+		// The entire layer finishes before any children are deleted.
+		digestErrs, err := c.deleteRefs(ctx, gcrrepo, refs, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		for i, ref := range refs {
+			digest := digests[i]
+			if digestErrs[i] != nil {
+				failed[digest] = struct{}{}
+				errs = append(errs, fmt.Errorf("failed to delete digest %s: %w", digest, digestErrs[i]))
+				continue
+			}
+			deleted = append(deleted, &DeletedRef{
+				Ref:          ref.Identifier(),
+				Digest:       digest,
+				Subject:      graph.subjects[digest],
+				Threshold:    plan.Thresholds[digest],
+				MediaType:    byDigest[digest].Info.MediaType,
+				ArtifactType: byDigest[digest].Info.ArtifactType,
+			})
+		}
+	}
+
+	// Aggregate any errors.
+	if err := ErrsToError(errs); err != nil {
+		return nil, err
+	}
 
-	var keepCount = int64(0)
-	var digestsToDelete []string
-	var toRetry []string
-	var toRetryLock sync.Mutex
+	// Return the list of deleted entries.
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].Ref < deleted[j].Ref
+	})
+	return &CleanResult{
+		Deleted: deleted,
+		Kept:    plan.Kept,
+		Cutoff:  since,
+		Size:    size,
+	}, nil
+}
 
-	// Delete all the manifests.
+// plan decides which of the sorted manifests should be deleted according to
+// the policy. Untagged children of image indexes are deleted only when no kept
+// manifest references them. Supporting artifacts are kept exactly as long as
+// their subject is kept, and are deleted when their subject no longer exists.
+// Images with semantic version tags are decided by the semver policy, if any.
+// In untag-only mode, images where only some tags match the tag filter are
+// kept and only the matching tags are removed.
+func (c *Cleaner) plan(repo string, manifests []*manifest, graph *manifestGraph, now time.Time, policy *Policy) *deletionPlan {
+	// Buckets are filled by every tagged image, so a bucket that already holds
+	// an image kept for another reason does not also keep a candidate.
+	buckets := newBucketFiller(policy.Buckets, now).fillAll(manifests, graph)
+	var keptRefs []*KeptRef
+	var untag []*untagRef
+	var thresholds = make(map[string]string, len(manifests))
+
+	var keepCounts = make(map[string]int64, 4)
+	var kept []string
+	var candidates = make(map[string]struct{}, len(manifests))
+	var quotaCandidates []*manifest
+
+	var byDigest = make(map[string]*manifest, len(manifests))
 	for _, m := range manifests {
-		m := m
+		byDigest[m.Digest] = m
+	}
+
+	// Rank the semantic versions of the independent images only.
+	var semverDecisions map[string]*semverDecision
+	if policy.Semver != nil {
+		images := make([]*manifest, 0, len(manifests))
+		for _, m := range manifests {
+			if !graph.isChild(m) && !graph.isArtifact(m) {
+				images = append(images, m)
+			}
+		}
+		semverDecisions = policy.Semver.decide(images, now)
+	}
 
+	for _, m := range manifests {
+		since, threshold := policy.sinceFor(now, m.Info.Tags)
 		c.logger.Debug("processing manifest",
 			"repo", repo,
 			"digest", m.Digest,
 			"tags", m.Info.Tags,
 			"created", m.Info.Created.Format(time.RFC3339),
-			"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+			"uploaded", m.Info.Uploaded.Format(time.RFC3339),
+			"media_type", m.Info.MediaType,
+			"artifact_type", m.Info.ArtifactType,
+			"time_source", m.TimeSource,
+			"threshold", threshold)
+
+		// Protected tags are evaluated before all other rules, so protected
+		// images are always kept and do not count against the keep count.
+		if tag, re, ok := protectedTag(policy.ProtectedTags, m.Info.Tags); ok {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "protected tag",
+				"tag", tag,
+				"protected_tag", re.String())
+
+			keptRefs = append(keptRefs, &KeptRef{
+				Digest:    m.Digest,
+				Tags:      m.Info.Tags,
+				MediaType: m.Info.MediaType,
+				Protected: re.String(),
+			})
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Images in use are kept like protected images. This includes children
+		// and artifacts, which would otherwise follow their parent or subject.
+		if m.InUse != "" {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "in use",
+				"user", m.InUse)
+
+			keptRefs = append(keptRefs, &KeptRef{
+				Digest:    m.Digest,
+				Tags:      m.Info.Tags,
+				MediaType: m.Info.MediaType,
+				InUse:     m.InUse,
+			})
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Untagged children of an image index are not independent images. Their
+		// fate is decided by their parents below, and they do not count against
+		// the keep count.
+		if graph.isChild(m) {
+			c.logger.Debug("deferring decision to parent index",
+				"repo", repo,
+				"digest", m.Digest,
+				"parents", graph.parents[m.Digest])
+			continue
+		}
+
+		// Likewise, signatures, attestations, SBOMs, and other referrers follow
+		// their subject.
+		if graph.isArtifact(m) {
+			c.logger.Debug("deferring decision to subject",
+				"repo", repo,
+				"digest", m.Digest,
+				"subject", graph.subjects[m.Digest])
+			continue
+		}
+
+		// Manifests that could not be read may be referrers of a kept image.
+		if _, ok := graph.unreadable[m.Digest]; ok {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "manifest could not be read")
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Images with an unknown upload time, such as on registries that do not
+		// record it, are treated as too new.
+		if policy.unknownTooNew(m.uploaded(), since, now) {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "unknown upload time",
+				"threshold", threshold)
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Manifests that the type filter does not select are not managed by this
+		// policy.
+		if !policy.TypeFilter.Matches(m.Info.MediaType, m.Info.ArtifactType) {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "not selected by type filter",
+				"media_type", m.Info.MediaType,
+				"artifact_type", m.Info.ArtifactType,
+				"type_filter", policy.TypeFilter.String())
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Images can pin themselves or set their own expiry with labels. Invalid
+		// labels keep the image.
+		var ret *retention
+		if policy.RetentionLabels {
+			r, err := parseRetention(m.Info.Labels)
+			if err != nil {
+				c.logger.Error("invalid retention label, keeping image",
+					"repo", repo,
+					"digest", m.Digest,
+					"error", err)
+				kept = append(kept, m.Digest)
+				continue
+			}
+			ret = r
+		}
+
+		// Pinned images are kept like protected images.
+		if ret != nil && ret.keep {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "pinned by label",
+				"label", LabelKeep)
+
+			keptRefs = append(keptRefs, &KeptRef{
+				Digest:    m.Digest,
+				Tags:      m.Info.Tags,
+				MediaType: m.Info.MediaType,
+				Label:     LabelKeep + "=" + m.Info.Labels[LabelKeep],
+			})
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Images at or before the absolute newer_than cutoff are never deleted
+		// and do not count against the keep count.
+		if policy.tooOld(m.uploaded()) {
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "not newer than newer_than",
+				"newer_than", policy.NewerThan.Format(time.RFC3339),
+				"uploaded", m.uploaded().Format(time.RFC3339))
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Images with an expiry are deleted once it passes, regardless of the
+		// other rules, and are kept until then.
+		if ret != nil && ret.expiresAfter > 0 {
+			since := policy.cutoff(graceSince(now, ret.expiresAfter))
+			if uploaded := m.uploaded(); uploaded.After(since) {
+				c.logger.Debug("should not delete",
+					"repo", repo,
+					"digest", m.Digest,
+					"reason", "not expired",
+					"expires_after", ret.expiresAfter.String(),
+					"since", since.Format(time.RFC3339),
+					"uploaded", uploaded.Format(time.RFC3339))
+				kept = append(kept, m.Digest)
+				continue
+			}
+
+			c.logger.Debug("should delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "expired",
+				"expires_after", ret.expiresAfter.String())
+			candidates[m.Digest] = struct{}{}
+			thresholds[m.Digest] = fmt.Sprintf("%s %s", LabelExpiresAfter, ret.expiresAfter)
+			continue
+		}
+
+		// Images with semantic version tags are ranked by version instead, so
+		// they do not count against the keep count.
+		if decision, ok := semverDecisions[m.Digest]; ok {
+			if !c.shouldDeleteSemver(m, since, decision, policy.TagFilter) {
+				kept = append(kept, m.Digest)
+				continue
+			}
+			candidates[m.Digest] = struct{}{}
+			quotaCandidates = append(quotaCandidates, m)
+			thresholds[m.Digest] = threshold
+			continue
+		}
+
+		// In untag-only mode, an image that also has tags that do not match is
+		// kept and only loses the matching tags.
+		if policy.UntagOnly {
+			if tags := c.tagsToRemove(m, since, policy.TagFilter); len(tags) > 0 {
+				untag = append(untag, &untagRef{
+					Digest: m.Digest,
+					Tags:   tags,
+				})
+				thresholds[m.Digest] = threshold
+				kept = append(kept, m.Digest)
+				continue
+			}
+		}
 
-		// Do nothing if this is not a candidate.
-		if !c.shouldDelete(m, since, tagFilter) {
+		// Do nothing if this is not a candidate. The expression, if any, replaces
+		// the tag filter.
+		var candidate bool
+		if policy.Expression != nil {
+			candidate = c.shouldDeleteExpression(m, since, now, policy.Expression)
+		} else {
+			candidate = c.shouldDelete(m, since, policy.TagFilter)
+		}
+		if !candidate {
 			c.logger.Debug("skipping deletion because of filters",
 				"repo", repo,
 				"digest", m.Digest,
 				"tags", m.Info.Tags)
+			kept = append(kept, m.Digest)
+			continue
+		}
+
+		// Keep the newest image in each bucket of the schedule, if any.
+		if bucket := buckets[m.Digest]; bucket != "" {
+			c.logger.Debug("skipping deletion because it fills a bucket",
+				"repo", repo,
+				"digest", m.Digest,
+				"bucket", bucket,
+				"created", m.Info.Created.Format(time.RFC3339),
+				"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+
+			keptRefs = append(keptRefs, &KeptRef{
+				Digest:    m.Digest,
+				Tags:      m.Info.Tags,
+				MediaType: m.Info.MediaType,
+				Bucket:    bucket,
+			})
+			kept = append(kept, m.Digest)
 			continue
 		}
 
-		// Keep a certain amount of images.
-		if keepCount < keep {
+		// Keep a certain amount of images, separately for each family if the
+		// images are grouped.
+		group := policy.KeepGroup.Group(m.Info.Tags)
+		if keepCount := keepCounts[group]; keepCount < policy.Keep {
 			c.logger.Debug("skipping deletion because of keep count",
 				"repo", repo,
 				"digest", m.Digest,
-				"keep", keep,
+				"keep", policy.Keep,
+				"keep_group", group,
 				"keep_count", keepCount,
 				"created", m.Info.Created.Format(time.RFC3339),
 				"uploaded", m.Info.Uploaded.Format(time.RFC3339))
 
-			keepCount++
+			keepCounts[group]++
+			kept = append(kept, m.Digest)
 			continue
 		}
 
-		// Make note that we need to delete this digest.
-		digestsToDelete = append(digestsToDelete, m.Digest)
+		candidates[m.Digest] = struct{}{}
+		quotaCandidates = append(quotaCandidates, m)
+		thresholds[m.Digest] = threshold
+	}
 
-		// Delete all tags before attempting to delete the digests later.
-		for _, tag := range m.Info.Tags {
-			tag := tag
+	// In quota mode, candidates are deleted from oldest to newest only until the
+	// repository fits in the quota, and the rest are kept. Expired images are
+	// deleted regardless, so they are removed first.
+	var sizes *repoSizes
+	if policy.Quota > 0 {
+		sizes = newRepoSizes(manifests, graph)
+		quota := make(map[string]struct{}, len(quotaCandidates))
+		for _, m := range quotaCandidates {
+			quota[m.Digest] = struct{}{}
+		}
+		for _, m := range manifests {
+			if _, ok := candidates[m.Digest]; ok {
+				if _, ok := quota[m.Digest]; !ok {
+					sizes.remove(m.Digest)
+				}
+			}
+		}
 
-			if err := w.Do(ctx, func() (string, error) {
-				c.logger.Debug("deleting tag",
+		for i := len(quotaCandidates) - 1; i >= 0; i-- {
+			m := quotaCandidates[i]
+			if size := sizes.size(); size > policy.Quota {
+				c.logger.Debug("should delete",
 					"repo", repo,
 					"digest", m.Digest,
-					"tag", tag)
-
-				tagged := gcrrepo.Tag(tag)
-				if !dryRun {
-					if err := c.deleteOne(ctx, tagged); err != nil {
-						return "", fmt.Errorf("failed to delete tag %s: %w", tagged, err)
-					}
-				}
-				return tagged.Identifier(), nil
-			}); err != nil {
-				return nil, err
+					"reason", "over quota",
+					"size", FormatSize(size),
+					"quota", FormatSize(policy.Quota))
+				sizes.remove(m.Digest)
+				continue
 			}
+
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "within quota",
+				"size", FormatSize(sizes.size()),
+				"quota", FormatSize(policy.Quota))
+			delete(candidates, m.Digest)
+			delete(thresholds, m.Digest)
+			kept = append(kept, m.Digest)
 		}
 	}
 
-	// Delete the digest. This is only safe after all the tags have been
-	// deleted, so wait for that to finish first.
-	if err := w.Wait(ctx); err != nil {
-		return nil, err
-	}
-	for _, digest := range digestsToDelete {
-		digest := digest
+	// Anything reachable from a kept manifest (e.g. the platform images of a
+	// kept multi-arch index) must not be deleted.
+	protected := graph.descendants(kept)
 
-		if err := w.Do(ctx, func() (string, error) {
-			c.logger.Debug("deleting digest",
-				"repo", repo,
-				"digest", digest)
-
-			grcdigest := gcrrepo.Digest(digest)
-			if !dryRun {
-				if err := c.deleteOne(ctx, grcdigest); err != nil {
-					// We cannot delete fat manifests which still have images. There's no
-					// easy way to build a DAG of these, so just push them onto the end
-					// and retry again later.
-					if strings.Contains(err.Error(), "GOOGLE_MANIFEST_DANGLING_PARENT_IMAGE") {
-						c.logger.Debug("failed to delete digest due to dangling parent, retrying later",
-							"repo", repo,
-							"digest", digest)
-
-						toRetryLock.Lock()
-						toRetry = append(toRetry, digest)
-						toRetryLock.Unlock()
-						return "", nil
-					}
+	// Resolve each artifact to the subject at the end of its chain (e.g. the
+	// signature of an attestation of an image).
+	for _, m := range manifests {
+		if !graph.isArtifact(m) {
+			continue
+		}
 
-					return "", fmt.Errorf("failed to delete digest %s: %w", digest, err)
-				}
+		subject := graph.subjects[m.Digest]
+		for i := 0; i < len(manifests); i++ {
+			sm, ok := byDigest[subject]
+			if !ok || !graph.isArtifact(sm) {
+				break
 			}
-			return grcdigest.Identifier(), nil
-		}); err != nil {
-			return nil, err
+			subject = graph.subjects[sm.Digest]
 		}
-	}
 
-	// Wait for all those deletions to finish.
-	if err := w.Wait(ctx); err != nil {
-		return nil, err
-	}
+		switch _, exists := byDigest[subject]; {
+		case !exists && !policy.DeleteOrphans:
+			// The subject may be in another repository, such as with
+			// COSIGN_REPOSITORY, so it cannot be known to be gone.
+			c.logger.Debug("should not delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "subject not in repository",
+				"subject", subject)
+			kept = append(kept, m.Digest)
+		case !exists:
+			since, threshold := policy.sinceFor(now, m.Info.Tags)
+			if uploaded := m.uploaded(); uploaded.After(since) || policy.unknownTooNew(uploaded, since, now) {
+				c.logger.Debug("should not delete",
+					"repo", repo,
+					"digest", m.Digest,
+					"reason", "orphaned artifact too new",
+					"subject", subject,
+					"since", since.Format(time.RFC3339),
+					"uploaded", uploaded.Format(time.RFC3339))
+				kept = append(kept, m.Digest)
+				continue
+			}
+			if uploaded := m.uploaded(); policy.tooOld(uploaded) {
+				c.logger.Debug("should not delete",
+					"repo", repo,
+					"digest", m.Digest,
+					"reason", "orphaned artifact not newer than newer_than",
+					"subject", subject,
+					"newer_than", policy.NewerThan.Format(time.RFC3339),
+					"uploaded", uploaded.Format(time.RFC3339))
+				kept = append(kept, m.Digest)
+				continue
+			}
 
-	// Perform any retries.
-	for i := 0; i < 3; i++ {
-		if len(toRetry) == 0 {
-			break
+			c.logger.Debug("should delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "orphaned artifact",
+				"subject", subject,
+				"threshold", threshold)
+			candidates[m.Digest] = struct{}{}
+			thresholds[m.Digest] = threshold
+		default:
+			if _, ok := protected[subject]; ok {
+				c.logger.Debug("should not delete",
+					"repo", repo,
+					"digest", m.Digest,
+					"reason", "subject kept",
+					"subject", subject)
+				kept = append(kept, m.Digest)
+				continue
+			}
+
+			c.logger.Debug("should delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "subject deleted",
+				"subject", subject)
+			candidates[m.Digest] = struct{}{}
 		}
+	}
 
-		c.logger.Debug("retrying failed deletions",
-			"attempt", i+1,
-			"toRetry", toRetry)
+	// Recompute now that kept artifacts are known, so the children of kept
+	// referrers indexes are protected too. Everything else that was deferred to
+	// its parents belongs only to deleted indexes and is deleted with them.
+	protected = graph.descendants(kept)
 
-		// We don't need as many pre-flight checks, since these entries were already
-		// marked for deletion.
-		toRetryCopy := make([]string, 0, len(toRetry))
-		for _, digest := range toRetry {
-			digest := digest
+	var toDelete []*manifest
+	for _, m := range manifests {
+		_, isCandidate := candidates[m.Digest]
+		isChild := graph.isChild(m)
 
-			if err := w.Do(ctx, func() (string, error) {
-				c.logger.Debug("deleting digest (retry)",
+		if _, ok := protected[m.Digest]; ok {
+			if isCandidate || isChild {
+				c.logger.Debug("skipping deletion because referenced by a kept manifest",
 					"repo", repo,
-					"digest", digest)
-
-				grcdigest := gcrrepo.Digest(digest)
-				if !dryRun {
-					if err := c.deleteOne(ctx, grcdigest); err != nil {
-						// We cannot delete fat manifests which still have images. There's no
-						// easy way to build a DAG of these, so just push them onto the end
-						// and retry again later.
-						if strings.Contains(err.Error(), "GOOGLE_MANIFEST_DANGLING_PARENT_IMAGE") {
-							toRetryLock.Lock()
-							toRetryCopy = append(toRetryCopy, digest)
-							toRetryLock.Unlock()
-							return "", nil
-						}
-						return "", fmt.Errorf("failed to delete digest %s: %w", digest, err)
-					}
-				}
-				return grcdigest.Identifier(), nil
-			}); err != nil {
-				return nil, err
+					"digest", m.Digest,
+					"parents", graph.parents[m.Digest])
 			}
+			continue
 		}
 
-		// Wait for all those deletions to finish.
-		if err := w.Wait(ctx); err != nil {
-			return nil, err
+		switch {
+		case isCandidate:
+			toDelete = append(toDelete, m)
+		case isChild:
+			c.logger.Debug("should delete",
+				"repo", repo,
+				"digest", m.Digest,
+				"reason", "parent index deleted",
+				"parents", graph.parents[m.Digest])
+			toDelete = append(toDelete, m)
 		}
+	}
+	return &deletionPlan{
+		Delete:     toDelete,
+		Untag:      untag,
+		Kept:       keptRefs,
+		Thresholds: thresholds,
+	}
+}
+
+// deletionPlan is the result of plan.
+type deletionPlan struct {
+	// Delete are the manifests to delete with all of their tags.
+	Delete []*manifest
+
+	// Untag are the tags to remove from kept images in untag-only mode.
+	Untag []*untagRef
+
+	// Kept are the images kept because of a protected tag, to fill a bucket, or
+	// because they are pinned by a label, with the reason.
+	Kept []*KeptRef
+
+	// Thresholds are the grace periods that applied to the images that are
+	// deleted or untagged, by digest. Images that are deleted with their parent
+	// index have none.
+	Thresholds map[string]string
+}
+
+// untagRef is a kept image and the tags to remove from it.
+type untagRef struct {
+	Digest string
+	Tags   []string
+}
+
+// DeletedRef is a tag or digest that was deleted, or that would have been
+// deleted in dry-run mode.
+type DeletedRef struct {
+	// Ref is the tag or digest.
+	Ref string `json:"ref"`
+
+	// Digest is the digest of the manifest to which the ref points.
+	Digest string `json:"digest"`
+
+	// Subject is the digest of the image described by the manifest if the
+	// manifest is a signature, attestation, SBOM, or other OCI referrer.
+	Subject string `json:"subject,omitempty"`
+
+	// Untagged is true if the ref is a tag that was removed in untag-only mode
+	// while the image it pointed to was kept.
+	Untagged bool `json:"untagged,omitempty"`
 
-		// Update to the new retry list.
-		toRetry = toRetryCopy
+	// Threshold describes the grace period that applied to the image, such as
+	// "untagged_grace 24h0m0s".
+	Threshold string `json:"threshold,omitempty"`
+
+	// MediaType is the media type of the manifest.
+	MediaType string `json:"media_type,omitempty"`
+
+	// ArtifactType is the artifact type of the manifest, if any.
+	ArtifactType string `json:"artifact_type,omitempty"`
+}
+
+// String returns the tag or digest.
+func (r *DeletedRef) String() string {
+	return r.Ref
+}
+
+// KeptRef is an image that was kept because of a protected tag, to fill a
+// retention bucket, or because it is pinned by a label.
+type KeptRef struct {
+	// Digest is the digest of the image.
+	Digest string `json:"digest"`
+
+	// Tags are the tags of the image.
+	Tags []string `json:"tags,omitempty"`
+
+	// MediaType is the media type of the image.
+	MediaType string `json:"media_type,omitempty"`
+
+	// Protected is the protected tag expression that matches one of the tags.
+	Protected string `json:"protected,omitempty"`
+
+	// Bucket is the list of buckets the image fills, such as "daily 2024-01-31,
+	// weekly 2024-W05".
+	Bucket string `json:"bucket,omitempty"`
+
+	// Label is the retention label that pins the image, such as
+	// "gcr-cleaner.keep=true".
+	Label string `json:"label,omitempty"`
+
+	// InUse describes what uses the image, such as "Deployment default/web in
+	// prod".
+	InUse string `json:"in_use,omitempty"`
+
+	// NotUntagged are the tags that untag-only mode would have removed, if the
+	// registry could remove a single tag without deleting the image.
+	NotUntagged []string `json:"not_untagged,omitempty"`
+}
+
+// CleanResult is the result of cleaning a single repository.
+type CleanResult struct {
+	// Deleted are the refs that were deleted, or that would have been deleted in
+	// dry-run mode.
+	Deleted []*DeletedRef
+
+	// Kept are the images that were kept because of a protected tag, to fill a
+	// retention bucket, because they are pinned by a label, because they are in
+	// use, or because the registry cannot untag them.
+	Kept []*KeptRef
+
+	// Cutoff is the effective cutoff of the grace period and older_than. Images
+	// uploaded after it were not deleted, unless untagged_grace, tagged_grace,
+	// or the tag filter set a different grace period for them.
+	Cutoff time.Time
+
+	// Size is the size of the repository before and after cleaning, and the
+	// storage that cleaning reclaims. After assumes that every planned deletion
+	// succeeded. It is nil if nothing was deleted outside of quota mode, or if
+	// the sizes could not be read.
+	Size *RepoSize
+}
+
+type manifest struct {
+	Repo   string
+	Digest string
+	Info   ManifestInfo
+
+	// Time, if set, replaces both the creation and upload time of the image.
+	// It comes from the time source of the policy.
+	Time time.Time
+
+	// TimeSource describes where Time came from.
+	TimeSource string
+
+	// Blobs are the sizes of the manifest, its config, and its layers, by
+	// digest. They are only fetched in quota mode or when anything is deleted.
+	Blobs map[string]int64
+
+	// InUse, if set, describes what uses the image. Images in use are kept.
+	InUse string
+}
+
+// uploaded returns the time used to decide whether the image is inside the
+// grace period.
+func (m *manifest) uploaded() time.Time {
+	if !m.Time.IsZero() {
+		return m.Time
+	}
+	return m.Info.Uploaded.UTC()
+}
+
+// created returns the time used to order images.
+func (m *manifest) created() time.Time {
+	if !m.Time.IsZero() {
+		return m.Time
 	}
+	return m.Info.Created.UTC()
+}
 
-	// Wait for everything to finish.
-	results, err := w.Done(ctx)
-	if err != nil {
-		return nil, err
+// deleteRefs deletes the refs and returns the error for each one, in order. If
+// the registry supports batch deletion, the refs are deleted in batches.
+// Otherwise they are deleted concurrently. In dry-run mode nothing is deleted.
+// The returned error is only non-nil if the context is cancelled.
+func (c *Cleaner) deleteRefs(ctx context.Context, gcrrepo gcrname.Repository, refs []gcrname.Reference, dryRun bool) ([]error, error) {
+	if dryRun || len(refs) == 0 {
+		return make([]error, len(refs)), nil
 	}
 
-	// Gather the results.
-	deleted := make([]string, 0, len(results))
-	errs := make([]error, 0, len(results))
-	for _, result := range results {
-		if result.Error != nil {
-			errs = append(errs, result.Error)
-			continue
-		}
+	if batch, ok := batchDeleterFor(c.registry, gcrrepo); ok {
+		return c.deleteBatch(ctx, batch, refs)
+	}
+
+	w := worker.New[worker.Void](c.concurrency)
+	for _, ref := range refs {
+		ref := ref
 
-		if result.Value != "" {
-			deleted = append(deleted, result.Value)
+		if err := w.Do(ctx, func() (worker.Void, error) {
+			return worker.Void{}, c.deleteOne(ctx, ref)
+		}); err != nil {
+			return nil, err
 		}
 	}
 
-	// Aggregate any errors.
-	if err := ErrsToError(errs); err != nil {
+	results, err := w.Done(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	// Return the list of deleted entries.
-	sort.Strings(deleted)
-	return deleted, nil
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = result.Error
+	}
+	return errs, nil
 }
 
-type manifest struct {
-	Repo   string
-	Digest string
-	Info   gcrgoogle.ManifestInfo
+// deleteBatch deletes the refs using the registry's batch API. Refs that fail
+// with a transient error are retried with backoff.
+func (c *Cleaner) deleteBatch(ctx context.Context, batch BatchDeleter, refs []gcrname.Reference) ([]error, error) {
+	backoff := deleteRetryBackoff
+
+	errs := make([]error, len(refs))
+	pending := make([]int, len(refs))
+	for i := range refs {
+		pending[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		batchRefs := make([]gcrname.Reference, 0, len(pending))
+		for _, i := range pending {
+			batchRefs = append(batchRefs, refs[i])
+		}
+
+		batchErrs := batch.DeleteBatch(ctx, batchRefs)
+
+		retry := make([]int, 0, len(pending))
+		for j, i := range pending {
+			errs[i] = batchErrs[j]
+			if isTransient(errs[i]) && attempt < deleteRetryAttempts {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 {
+			return errs, nil
+		}
+
+		c.logger.Debug("transient failure deleting batch, retrying",
+			"refs", len(retry),
+			"attempt", attempt,
+			"backoff", backoff.String())
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+		pending = retry
+	}
 }
 
-// deleteOne deletes a single repo ref using the supplied auth.
+// deleteOne deletes a single repo ref using the supplied auth. Transient
+// failures are retried with backoff; all other errors are returned immediately.
 func (c *Cleaner) deleteOne(ctx context.Context, ref gcrname.Reference) error {
-	if err := gcrremote.Delete(ref,
-		gcrremote.WithContext(ctx),
-		gcrremote.WithUserAgent(userAgent),
-		gcrremote.WithAuthFromKeychain(c.keychain),
-		gcrremote.WithJobs(int(c.concurrency))); err != nil {
-		return err
+	backoff := deleteRetryBackoff
+
+	var err error
+	for attempt := 1; attempt <= deleteRetryAttempts; attempt++ {
+		switch typ := ref.(type) {
+		case gcrname.Tag:
+			err = c.registry.DeleteTag(ctx, typ)
+		case gcrname.Digest:
+			err = c.registry.DeleteDigest(ctx, typ)
+		default:
+			return fmt.Errorf("unknown reference type %T", ref)
+		}
+		if err == nil || !isTransient(err) || attempt == deleteRetryAttempts {
+			break
+		}
+
+		c.logger.Debug("transient failure deleting ref, retrying",
+			"ref", ref.String(),
+			"attempt", attempt,
+			"backoff", backoff.String(),
+			"error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = backoff * 2
+	}
+	return err
+}
+
+// isTransient returns true if the error is a temporary registry or network
+// failure that is worth retrying.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Registry errors know which status and error codes are temporary, but do
+	// not consider rate limiting to be one.
+	var tpErr *gcrtransport.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.StatusCode == http.StatusTooManyRequests || tpErr.Temporary()
+	}
+
+	// Errors from registry-specific APIs.
+	var aerr interface{ Temporary() bool }
+	if errors.As(err, &aerr) && aerr.Temporary() {
+		return true
 	}
 
-	return nil
+	// Network errors.
+	var terr interface{ Timeout() bool }
+	if errors.As(err, &terr) {
+		return terr.Timeout()
+	}
+	return false
 }
 
 // shouldDelete returns true if the manifest was created before the given
 // timestamp and either has no tags or has tags that match the given filter.
 func (c *Cleaner) shouldDelete(m *manifest, since time.Time, tagFilter TagFilter) bool {
 	// Immediately exclude images that have been uploaded after the given time.
-	if uploaded := m.Info.Uploaded.UTC(); uploaded.After(since) {
+	if uploaded := m.uploaded(); uploaded.After(since) {
 		c.logger.Debug("should not delete",
 			"repo", m.Repo,
 			"digest", m.Digest,
@@ -374,6 +1274,146 @@ func (c *Cleaner) shouldDelete(m *manifest, since time.Time, tagFilter TagFilter
 	return false
 }
 
+// shouldDeleteExpression returns true if the manifest is outside the grace
+// period and the expression deletes it. If the expression fails to evaluate,
+// the manifest is kept.
+func (c *Cleaner) shouldDeleteExpression(m *manifest, since, now time.Time, expression *Expression) bool {
+	if uploaded := m.uploaded(); uploaded.After(since) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "too new",
+			"since", since.Format(time.RFC3339),
+			"uploaded", uploaded.Format(time.RFC3339))
+		return false
+	}
+
+	del, err := expression.Evaluate(m, now)
+	if err != nil {
+		c.logger.Error("failed to evaluate expression, keeping image",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"error", err)
+		return false
+	}
+
+	if !del {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "expression is false",
+			"expression", expression.String())
+		return false
+	}
+
+	c.logger.Debug("should delete",
+		"repo", m.Repo,
+		"digest", m.Digest,
+		"reason", "expression is true",
+		"expression", expression.String())
+	return true
+}
+
+// tagsToRemove returns the tags of the image that match the tag filter if some,
+// but not all, of its tags match and the image is older than since. Otherwise
+// it returns nil and the image is decided by shouldDelete.
+func (c *Cleaner) tagsToRemove(m *manifest, since time.Time, tagFilter TagFilter) []string {
+	if m.uploaded().After(since) {
+		return nil
+	}
+
+	var matching []string
+	for _, tag := range m.Info.Tags {
+		if tagFilter.Matches([]string{tag}) {
+			matching = append(matching, tag)
+		}
+	}
+	if len(matching) == 0 || len(matching) == len(m.Info.Tags) {
+		return nil
+	}
+
+	c.logger.Debug("should untag",
+		"repo", m.Repo,
+		"digest", m.Digest,
+		"reason", "some tags match tag filter",
+		"tags", m.Info.Tags,
+		"untag", matching,
+		"tag_filter", tagFilter.Name())
+	return matching
+}
+
+// shouldDeleteSemver returns true if the image with semantic version tags
+// should be deleted according to the semver decision. Any other tags on the
+// image must also match the tag filter.
+func (c *Cleaner) shouldDeleteSemver(m *manifest, since time.Time, decision *semverDecision, tagFilter TagFilter) bool {
+	if uploaded := m.uploaded(); uploaded.After(since) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "too new",
+			"since", since.Format(time.RFC3339),
+			"uploaded", uploaded.Format(time.RFC3339))
+		return false
+	}
+
+	if decision.Keep {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "semver",
+			"semver", decision.Reason)
+		return false
+	}
+
+	if len(decision.Other) > 0 && !tagFilter.Matches(decision.Other) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "non-semver tags do not match tag filter",
+			"semver", decision.Reason,
+			"tags", decision.Other,
+			"tag_filter", tagFilter.Name())
+		return false
+	}
+
+	c.logger.Debug("should delete",
+		"repo", m.Repo,
+		"digest", m.Digest,
+		"reason", "semver",
+		"semver", decision.Reason)
+	return true
+}
+
+// catalog lists the repositories in the registry. If the registry supports
+// scoped listing and no root is the entire registry, only the repositories
+// under the roots are listed.
+func (c *Cleaner) catalog(ctx context.Context, registry gcrname.Registry, scopes map[string]struct{}) ([]string, error) {
+	scoped, ok := scopedCatalogerFor(c.registry, registry)
+	if _, all := scopes[""]; !ok || all {
+		return c.registry.Catalog(ctx, registry)
+	}
+
+	sortedScopes := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		sortedScopes = append(sortedScopes, scope)
+	}
+	sort.Strings(sortedScopes)
+
+	var repos []string
+	for _, scope := range sortedScopes {
+		c.logger.Debug("listing child repositories for scope",
+			"registry", registry.Name(),
+			"scope", scope)
+
+		scopeRepos, err := scoped.CatalogScope(ctx, registry, scope)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, scopeRepos...)
+	}
+	return repos, nil
+}
+
 // ListChildRepositories lists all child repositores for the given roots. Roots
 // can be entire registries (e.g. us-docker.pkg.dev) or a subpath within a
 // registry (e.g. gcr.io/my-project/my-container).
@@ -385,11 +1425,16 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 	// limit upstream API calls.
 	registriesMap := make(map[string]*gcrname.Registry, len(roots))
 
+	// scopesMap is the set of paths within each registry that contain roots. An
+	// empty path is the entire registry.
+	scopesMap := make(map[string]map[string]struct{}, len(roots))
+
 	// Iterate over each root and attempt to extract the registry component. Some
 	// roots will be registries themselves whereas other roots could be a subpath
 	// in a registry and we need to extract just the registry part.
 	for _, root := range roots {
 		registryName := ""
+		scope := ""
 
 		parts := strings.Split(root, "/")
 		switch len(parts) {
@@ -405,7 +1450,13 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 			}
 
 			registryName = repo.RegistryStr()
+			scope = repo.RepositoryStr()
+		}
+
+		if scopesMap[registryName] == nil {
+			scopesMap[registryName] = make(map[string]struct{}, 1)
 		}
+		scopesMap[registryName][scope] = struct{}{}
 
 		registry, err := gcrname.NewRegistry(registryName)
 		if err != nil {
@@ -419,19 +1470,16 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 
 	// Iterate through each registry, query the entire registry (yea, that's how
 	// you "search"), and collect a list of candidate repos.
-	for _, registry := range registriesMap {
+	for registryName, registry := range registriesMap {
 		registry := registry
+		scopes := scopesMap[registryName]
 
 		if err := w.Do(ctx, func() ([]string, error) {
 			c.logger.Debug("listing child repositories for registry",
 				"registry", registry.Name())
 
 			// List all repos in the registry.
-			allRepos, err := gcrremote.Catalog(ctx, *registry,
-				gcrremote.WithContext(ctx),
-				gcrremote.WithUserAgent(userAgent),
-				gcrremote.WithAuthFromKeychain(c.keychain),
-				gcrremote.WithJobs(int(c.concurrency)))
+			allRepos, err := c.catalog(ctx, *registry, scopes)
 			if err != nil {
 				return nil, fmt.Errorf("failed to list child repositories for registry %s: %w", registry, err)
 			}
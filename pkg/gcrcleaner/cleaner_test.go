@@ -15,8 +15,18 @@
 package gcrcleaner
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
 )
 
 func TestErrsToError(t *testing.T) {
@@ -68,3 +78,716 @@ func TestErrsToError(t *testing.T) {
 		})
 	}
 }
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   error
+		exp  bool
+	}{
+		{
+			name: "nil",
+			in:   nil,
+			exp:  false,
+		},
+		{
+			name: "generic",
+			in:   fmt.Errorf("oops"),
+			exp:  false,
+		},
+		{
+			name: "canceled",
+			in:   context.Canceled,
+			exp:  false,
+		},
+		{
+			name: "deadline",
+			in:   context.DeadlineExceeded,
+			exp:  true,
+		},
+		{
+			name: "unavailable",
+			in:   fmt.Errorf("wrapped: %w", &gcrtransport.Error{StatusCode: http.StatusServiceUnavailable}),
+			exp:  true,
+		},
+		{
+			name: "rate_limited",
+			in:   &gcrtransport.Error{StatusCode: http.StatusTooManyRequests},
+			exp:  true,
+		},
+		{
+			name: "not_found",
+			in:   &gcrtransport.Error{StatusCode: http.StatusNotFound},
+			exp:  false,
+		},
+		{
+			name: "dangling_parent",
+			in: &gcrtransport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors: []gcrtransport.Diagnostic{
+					{Code: "GOOGLE_MANIFEST_DANGLING_PARENT_IMAGE"},
+				},
+			},
+			exp: false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := isTransient(tc.in), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestCleaner_Plan(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	old := now.Add(-48 * time.Hour)
+
+	// index -> (amd64, arm64), oldIndex -> (oldAmd64)
+	graph := newManifestGraph()
+	graph.addEdge("index", "amd64")
+	graph.addEdge("index", "arm64")
+	graph.addEdge("oldIndex", "oldAmd64")
+	graph.addSubject("indexSig", "index")
+	graph.addSubject("oldIndexSig", "oldIndex")
+	graph.addSubject("oldIndexSigSig", "oldIndexSig")
+	graph.addSubject("amd64Att", "amd64")
+	graph.addSubject("orphanSig", "missing")
+
+	newManifest := func(digest string, tags ...string) *manifest {
+		return &manifest{
+			Repo:   "gcr.io/p/r",
+			Digest: digest,
+			Info: ManifestInfo{
+				Tags:     tags,
+				Created:  old,
+				Uploaded: old,
+			},
+		}
+	}
+
+	newManifestUploaded := func(digest string, uploaded time.Time) *manifest {
+		m := newManifest(digest)
+		m.Info.Uploaded = uploaded
+		return m
+	}
+
+	newManifestType := func(digest, mediaType, artifactType string) *manifest {
+		m := newManifest(digest)
+		m.Info.MediaType = mediaType
+		m.Info.ArtifactType = artifactType
+		return m
+	}
+
+	newManifestLabeled := func(digest string, labels map[string]string, tags ...string) *manifest {
+		m := newManifest(digest, tags...)
+		m.Info.Labels = labels
+		return m
+	}
+
+	newManifestSized := func(digest string, blobs map[string]int64, tags ...string) *manifest {
+		m := newManifest(digest, tags...)
+		m.Blobs = blobs
+		return m
+	}
+
+	newManifestInUse := func(digest, user string, tags ...string) *manifest {
+		m := newManifest(digest, tags...)
+		m.InUse = user
+		return m
+	}
+
+	cases := []struct {
+		name       string
+		manifests  []*manifest
+		keep       int64
+		keepGroup  string
+		buckets    *Buckets
+		tagFilter  TagFilter
+		untagged   time.Duration
+		tagged     time.Duration
+		newerThan  time.Time
+		expression string
+		protected  []string
+		semver     *SemverPolicy
+		retention  bool
+		types      *TypeFilterSpec
+		quota      int64
+		orphans    bool
+		exp        []string
+		expKept    []string
+	}{
+		{
+			name: "untagged_children_of_kept_index",
+			manifests: []*manifest{
+				newManifest("index", "latest"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+			},
+			exp: []string{},
+		},
+		{
+			name: "children_of_deleted_index",
+			manifests: []*manifest{
+				newManifest("index", "pr-1"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("loose"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{"index", "amd64", "arm64", "loose"},
+		},
+		{
+			name: "children_do_not_count_against_keep",
+			manifests: []*manifest{
+				newManifest("index", "pr-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldAmd64"),
+			},
+			keep:      1,
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{"oldIndex", "oldAmd64"},
+		},
+		{
+			name: "tagged_child_of_kept_index",
+			manifests: []*manifest{
+				newManifest("index", "latest"),
+				newManifest("amd64", "pr-1"),
+				newManifest("arm64"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{},
+		},
+		{
+			name: "tagged_child_of_deleted_index",
+			manifests: []*manifest{
+				newManifest("index", "pr-1"),
+				newManifest("amd64", "stable"),
+				newManifest("arm64"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{"index", "arm64"},
+		},
+		{
+			name: "keep_per_group",
+			manifests: []*manifest{
+				newManifest("mainNew", "main-aaaaaaa"),
+				newManifest("featNew", "feat-bbbbbbb"),
+				newManifest("mainOld", "main-ccccccc"),
+				newManifest("featOld", "feat-ddddddd"),
+				newManifest("loose"),
+				newManifest("looseOld"),
+			},
+			keep:      1,
+			keepGroup: `^(?P<group>.+)-[0-9a-f]{7}$`,
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("-[0-9a-f]{7}$")},
+			exp:       []string{"mainOld", "featOld", "looseOld"},
+		},
+		{
+			name: "buckets",
+			manifests: []*manifest{
+				newManifest("index", "nightly-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "nightly-1"),
+				newManifest("oldAmd64"),
+			},
+			buckets:   &Buckets{Daily: 7},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^nightly-")},
+			exp:       []string{"oldIndex", "oldAmd64"},
+			expKept:   []string{"index"},
+		},
+		{
+			name: "buckets_filled_by_kept_images",
+			manifests: []*manifest{
+				newManifest("index", "latest"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "nightly-1"),
+				newManifest("oldAmd64"),
+			},
+			buckets:   &Buckets{Daily: 7},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^nightly-")},
+			exp:       []string{"oldIndex", "oldAmd64"},
+		},
+		{
+			name: "buckets_untagged_do_not_fill",
+			manifests: []*manifest{
+				newManifest("loose"),
+				newManifest("oldIndex", "nightly-1"),
+				newManifest("oldAmd64"),
+			},
+			buckets:   &Buckets{Daily: 7},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^nightly-")},
+			exp:       []string{"loose"},
+			expKept:   []string{"oldIndex"},
+		},
+		{
+			name: "protected_tag",
+			manifests: []*manifest{
+				newManifest("index", "latest", "pr-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldAmd64"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			protected: []string{"^stable$", "^latest$"},
+			exp:       []string{"oldIndex", "oldAmd64"},
+			expKept:   []string{"index"},
+		},
+		{
+			name: "protected_does_not_count_against_keep",
+			manifests: []*manifest{
+				newManifest("index", "stable", "pr-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldAmd64"),
+			},
+			keep:      1,
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			protected: []string{"^stable$"},
+			exp:       []string{},
+			expKept:   []string{"index"},
+		},
+		{
+			name: "artifacts_of_kept_subject",
+			manifests: []*manifest{
+				newManifest("index", "latest"),
+				newManifest("amd64"),
+				newManifest("indexSig", "sha256-index.sig"),
+				newManifest("amd64Att"),
+			},
+			exp: []string{},
+		},
+		{
+			name: "artifacts_of_deleted_subject",
+			manifests: []*manifest{
+				newManifest("index", "pr-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("indexSig", "sha256-index.sig"),
+				newManifest("amd64Att"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{"index", "amd64", "arm64", "indexSig", "amd64Att"},
+		},
+		{
+			name: "artifacts_do_not_count_against_keep",
+			manifests: []*manifest{
+				newManifest("index", "pr-2"),
+				newManifest("indexSig", "sha256-index.sig"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldIndexSig", "sha256-oldIndex.sig"),
+				newManifest("oldIndexSigSig"),
+			},
+			keep:      1,
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			exp:       []string{"oldIndex", "oldIndexSig", "oldIndexSigSig"},
+		},
+		{
+			name: "orphaned_artifact",
+			manifests: []*manifest{
+				newManifest("orphanSig", "sha256-missing.sig"),
+			},
+			orphans: true,
+			exp:     []string{"orphanSig"},
+		},
+		{
+			name: "orphaned_artifact_not_opted_in",
+			manifests: []*manifest{
+				newManifest("orphanSig", "sha256-missing.sig"),
+			},
+			exp: []string{},
+		},
+		{
+			name: "unknown_upload_time_with_grace",
+			manifests: []*manifest{
+				newManifestUploaded("loose", time.Time{}),
+			},
+			untagged: time.Hour,
+			exp:      []string{},
+		},
+		{
+			name: "unknown_upload_time_without_grace",
+			manifests: []*manifest{
+				newManifestUploaded("loose", time.Time{}),
+			},
+			exp: []string{"loose"},
+		},
+		{
+			name: "orphaned_artifact_unknown_upload_time",
+			manifests: []*manifest{
+				newManifestUploaded("orphanSig", time.Time{}),
+			},
+			untagged: time.Hour,
+			orphans:  true,
+			exp:      []string{},
+		},
+		{
+			name: "orphaned_artifact_too_new",
+			manifests: []*manifest{
+				newManifestUploaded("orphanSig", now.Add(time.Hour)),
+			},
+			orphans: true,
+			exp:     []string{},
+		},
+		{
+			name: "semver",
+			manifests: []*manifest{
+				newManifest("index", "v1.0.1"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "v1.0.0", "stable"),
+				newManifest("oldAmd64"),
+				newManifest("loose", "v0.1.0"),
+			},
+			semver: &SemverPolicy{KeepMajors: 1, KeepPatches: 1},
+			exp:    []string{"loose"},
+		},
+		{
+			name: "semver_non_semver_tags_match_filter",
+			manifests: []*manifest{
+				newManifest("index", "v1.0.1"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "v1.0.0", "stable"),
+				newManifest("oldAmd64"),
+				newManifest("loose", "v0.1.0"),
+			},
+			tagFilter: &TagFilterAll{re: regexp.MustCompile("^stable$")},
+			semver:    &SemverPolicy{KeepMajors: 1, KeepPatches: 1},
+			exp:       []string{"oldIndex", "oldAmd64", "loose"},
+		},
+		{
+			name: "semver_does_not_count_against_keep",
+			manifests: []*manifest{
+				newManifest("index", "v1.0.0"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldAmd64"),
+			},
+			keep:      1,
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			semver:    &SemverPolicy{},
+			exp:       []string{},
+		},
+		{
+			name: "expression",
+			manifests: []*manifest{
+				newManifest("index", "latest"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("oldIndex", "pr-1"),
+				newManifest("oldAmd64"),
+				newManifest("loose"),
+			},
+			tagFilter:  &TagFilterAny{re: regexp.MustCompile(".*")},
+			expression: `tags.exists(t, t.startsWith("pr-")) && now - uploaded > duration("24h")`,
+			exp:        []string{"oldIndex", "oldAmd64"},
+		},
+		{
+			name: "untagged_and_tagged_grace",
+			manifests: []*manifest{
+				newManifest("index", "pr-2"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("loose"),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			untagged:  24 * time.Hour,
+			tagged:    72 * time.Hour,
+			exp:       []string{"loose"},
+		},
+		{
+			name: "newer_than",
+			manifests: []*manifest{
+				newManifestUploaded("new", now.Add(-24*time.Hour)),
+				newManifestUploaded("cutoff", now.Add(-36*time.Hour)),
+				newManifestUploaded("old", now.Add(-72*time.Hour)),
+			},
+			newerThan: now.Add(-36 * time.Hour),
+			exp:       []string{"new"},
+		},
+		{
+			name: "type_filter",
+			manifests: []*manifest{
+				newManifestType("image", "application/vnd.oci.image.manifest.v1+json", ""),
+				newManifestType("cache", "application/vnd.oci.image.manifest.v1+json", "application/vnd.buildkit.cacheconfig.v0"),
+				newManifestType("chart", "application/vnd.oci.image.manifest.v1+json", "application/vnd.cncf.helm.config.v1+json"),
+				newManifestType("docker", "application/vnd.docker.distribution.manifest.v2+json", ""),
+			},
+			keep: 1,
+			types: &TypeFilterSpec{
+				MediaTypes:           []string{"application/vnd.oci.*"},
+				ExcludeArtifactTypes: []string{"application/vnd.cncf.helm.*"},
+			},
+			exp: []string{"cache"},
+		},
+		{
+			name: "retention_keep_label",
+			manifests: []*manifest{
+				newManifestLabeled("pinned", map[string]string{LabelKeep: "true"}),
+				newManifestLabeled("unpinned", map[string]string{LabelKeep: "false"}),
+				newManifestLabeled("invalid", map[string]string{LabelKeep: "yes"}),
+				newManifest("loose"),
+			},
+			keep:      1,
+			retention: true,
+			exp:       []string{"loose"},
+			expKept:   []string{"pinned"},
+		},
+		{
+			name: "retention_expires_after",
+			manifests: []*manifest{
+				newManifestLabeled("expired", map[string]string{LabelExpiresAfter: "1d"}, "latest"),
+				newManifestLabeled("fresh", map[string]string{LabelExpiresAfter: "1w"}),
+				newManifestLabeled("invalid", map[string]string{LabelExpiresAfter: "0d"}),
+			},
+			keep:      1,
+			retention: true,
+			exp:       []string{"expired"},
+		},
+		{
+			name: "retention_labels_disabled",
+			manifests: []*manifest{
+				newManifestLabeled("pinned", map[string]string{LabelKeep: "true"}),
+				newManifestLabeled("expired", map[string]string{LabelExpiresAfter: "1d"}, "latest"),
+			},
+			exp: []string{"pinned"},
+		},
+		{
+			name: "in_use",
+			manifests: []*manifest{
+				newManifestInUse("index", "Deployment default/web in prod"),
+				newManifest("amd64"),
+				newManifest("arm64"),
+				newManifest("loose"),
+			},
+			exp:     []string{"loose"},
+			expKept: []string{"index"},
+		},
+		{
+			name: "quota",
+			manifests: []*manifest{
+				newManifestSized("newest", map[string]int64{"base": 100, "newest": 10}),
+				newManifestSized("newer", map[string]int64{"base": 100, "newer": 10}),
+				newManifestSized("pinned", map[string]int64{"base": 100, "pinned": 10}, "latest"),
+				newManifestSized("older", map[string]int64{"base": 100, "older": 10}),
+				newManifestSized("oldest", map[string]int64{"base": 100, "oldest": 10}),
+			},
+			tagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+			quota:     135,
+			exp:       []string{"older", "oldest"},
+		},
+		{
+			name: "quota_shared_layers",
+			manifests: []*manifest{
+				newManifestSized("newest", map[string]int64{"base": 100, "newest": 10}),
+				newManifestSized("older", map[string]int64{"base": 100, "older": 10}),
+				newManifestSized("oldest", map[string]int64{"base": 100, "oldest": 10}),
+			},
+			quota: 50,
+			exp:   []string{"newest", "older", "oldest"},
+		},
+		{
+			name: "quota_fits",
+			manifests: []*manifest{
+				newManifestSized("newest", map[string]int64{"base": 100, "newest": 10}),
+				newManifestSized("oldest", map[string]int64{"base": 100, "oldest": 10}),
+			},
+			quota: 120,
+			exp:   []string{},
+		},
+		{
+			name: "expression_error_keeps",
+			manifests: []*manifest{
+				newManifest("loose"),
+			},
+			expression: `labels["keep"] != "true"`,
+			exp:        []string{},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+
+			tagFilter := tc.tagFilter
+			if tagFilter == nil {
+				tagFilter = &TagFilterNull{}
+			}
+			keepGroup, err := BuildKeepGroup(tc.keepGroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			protected, err := BuildProtectedTags(tc.protected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expression, err := BuildExpression(tc.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			typeFilter, err := tc.types.filter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy := &Policy{
+				UntaggedGrace:   tc.untagged,
+				TaggedGrace:     tc.tagged,
+				NewerThan:       tc.newerThan,
+				Keep:            tc.keep,
+				KeepGroup:       keepGroup,
+				Buckets:         tc.buckets,
+				TagFilter:       tagFilter,
+				Expression:      expression,
+				ProtectedTags:   protected,
+				Semver:          tc.semver,
+				TypeFilter:      typeFilter,
+				RetentionLabels: tc.retention,
+				Quota:           tc.quota,
+				DeleteOrphans:   tc.orphans,
+			}
+
+			plan := c.plan("gcr.io/p/r", tc.manifests, graph, now, policy)
+
+			got := make([]string, 0, len(tc.manifests))
+			for _, m := range plan.Delete {
+				got = append(got, m.Digest)
+			}
+			if want := tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+
+			gotKept := make([]string, 0, len(plan.Kept))
+			for _, ref := range plan.Kept {
+				gotKept = append(gotKept, ref.Digest)
+			}
+			wantKept := tc.expKept
+			if wantKept == nil {
+				wantKept = []string{}
+			}
+			if !reflect.DeepEqual(gotKept, wantKept) {
+				t.Errorf("expected kept %q to be %q", gotKept, wantKept)
+			}
+		})
+	}
+}
+
+func TestCleaner_Clean(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	manifest := func(digest string) *RawManifest {
+		return &RawManifest{
+			Digest:    digest,
+			MediaType: mediaType,
+			Body:      []byte(`{"schemaVersion":2}`),
+		}
+	}
+
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-1"}},
+			bb: {MediaType: mediaType, Created: old, Uploaded: old},
+			cc: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"v1"}},
+		},
+		raw: map[string]*RawManifest{
+			aa: manifest(aa),
+			bb: manifest(bb),
+			cc: manifest(cc),
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+
+	deleted, err := c.Clean(ctx, "registry.example/a/b", time.Now(), 0,
+		&TagFilterAny{re: regexp.MustCompile("^pr-")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := deleted, []string{"pr-1", aa, bb}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestCleaner_Clean_UntagOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+
+	manifest := func(digest string) *RawManifest {
+		return &RawManifest{
+			Digest:    digest,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Body:      []byte(`{"schemaVersion":2}`),
+		}
+	}
+
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: "application/vnd.oci.image.manifest.v1+json", Created: old, Uploaded: old, Tags: []string{"pr-123", "v1.2.0"}},
+			bb: {MediaType: "application/vnd.oci.image.manifest.v1+json", Created: old, Uploaded: old, Tags: []string{"pr-1"}},
+		},
+		raw: map[string]*RawManifest{
+			aa: manifest(aa),
+			bb: manifest(bb),
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+
+	deleted, err := c.CleanPolicy(ctx, "registry.example/a/b", &Policy{
+		TagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+		UntagOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	want := []*DeletedRef{
+		{Ref: "pr-1", Digest: bb, Threshold: "grace 0s", MediaType: mediaType},
+		{Ref: "pr-123", Digest: aa, Untagged: true, Threshold: "grace 0s", MediaType: mediaType},
+		{Ref: bb, Digest: bb, Threshold: "grace 0s", MediaType: mediaType},
+	}
+	if got := deleted; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The release tag and its digest are kept.
+	sort.Strings(registry.deleted)
+	if got, want := registry.deleted, []string{"pr-1", "pr-123", bb}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
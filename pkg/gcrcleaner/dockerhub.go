@@ -0,0 +1,357 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// DockerHubHosts are the registry hosts served by Docker Hub.
+var DockerHubHosts = []string{gcrname.DefaultRegistry, "docker.io", "registry-1.docker.io"}
+
+// defaultDockerHubURL is the base URL of the Docker Hub API.
+const defaultDockerHubURL = "https://hub.docker.com"
+
+// dockerHubPageSize is the number of results to request per page.
+const dockerHubPageSize = 100
+
+var (
+	_ Registry        = (*DockerHubRegistry)(nil)
+	_ BlobFetcher     = (*DockerHubRegistry)(nil)
+	_ ReferrersLister = (*DockerHubRegistry)(nil)
+)
+
+// DockerHubConfig is the configuration for a DockerHubRegistry.
+type DockerHubConfig struct {
+	// URL is the base URL of the Docker Hub API. The default is
+	// https://hub.docker.com.
+	URL string
+
+	// Username is the Docker Hub username.
+	Username string
+
+	// Token is the password or personal access token for Username.
+	Token string
+
+	// Namespaces are the organizations or users searched by Catalog. The
+	// default is Username.
+	Namespaces []string
+}
+
+// DockerHubRegistry is a Registry for Docker Hub. Docker Hub does not support
+// deleting manifests through the registry API and does not report timestamps
+// in its tags list, so tags are listed and deleted with the Docker Hub API.
+// Manifests are still fetched using the registry API.
+type DockerHubRegistry struct {
+	baseURL    string
+	username   string
+	token      string
+	namespaces []string
+
+	manifests Registry
+	client    *http.Client
+
+	jwtLock sync.Mutex
+	jwt     string
+}
+
+// NewDockerHubRegistry creates a new Docker Hub registry. The manifests
+// registry is used to fetch manifests, usually a RemoteRegistry.
+func NewDockerHubRegistry(cfg *DockerHubConfig, manifests Registry) (*DockerHubRegistry, error) {
+	if cfg.Username == "" || cfg.Token == "" {
+		return nil, fmt.Errorf("docker hub username and token are required")
+	}
+
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultDockerHubURL
+	}
+
+	namespaces := cfg.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{cfg.Username}
+	}
+
+	return &DockerHubRegistry{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		username:   cfg.Username,
+		token:      cfg.Token,
+		namespaces: namespaces,
+		manifests:  manifests,
+		client:     &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// dockerHubTag is a tag as returned by the Docker Hub API.
+type dockerHubTag struct {
+	Name          string            `json:"name"`
+	Digest        string            `json:"digest"`
+	MediaType     string            `json:"media_type"`
+	FullSize      uint64            `json:"full_size"`
+	LastUpdated   time.Time         `json:"last_updated"`
+	TagLastPushed time.Time         `json:"tag_last_pushed"`
+	Images        []*dockerHubImage `json:"images"`
+}
+
+// dockerHubImage is a platform image of a tag as returned by the Docker Hub
+// API.
+type dockerHubImage struct {
+	Digest     string    `json:"digest"`
+	Size       uint64    `json:"size"`
+	LastPushed time.Time `json:"last_pushed"`
+}
+
+// ListManifests lists all tags in the repository and groups them by digest.
+// Docker Hub does not record build times, so both the created and uploaded
+// times are the earliest push time of any tag pointing to the manifest. The
+// platform images of multi-arch tags are included as untagged manifests.
+func (r *DockerHubRegistry) ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error) {
+	namespace, name, err := dockerHubRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/v2/namespaces/%s/repositories/%s/tags?page_size=%d",
+		r.baseURL, url.PathEscape(namespace), url.PathEscape(name), dockerHubPageSize)
+
+	manifests := make(map[string]ManifestInfo, 8)
+	for u != "" {
+		var page struct {
+			Next    string          `json:"next"`
+			Results []*dockerHubTag `json:"results"`
+		}
+		if err := r.do(ctx, http.MethodGet, u, nil, &page); err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+
+		for _, tag := range page.Results {
+			digest := tag.Digest
+			if digest == "" && len(tag.Images) == 1 {
+				digest = tag.Images[0].Digest
+			}
+			if digest == "" {
+				continue
+			}
+
+			pushed := tag.TagLastPushed
+			if pushed.IsZero() {
+				pushed = tag.LastUpdated
+			}
+			pushed = pushed.UTC()
+
+			info, ok := manifests[digest]
+			if !ok || pushed.Before(info.Uploaded) {
+				info.Created = pushed
+				info.Uploaded = pushed
+			}
+			info.MediaType = tag.MediaType
+			info.Size = tag.FullSize
+			info.Tags = append(info.Tags, tag.Name)
+			manifests[digest] = info
+
+			// Record the platform images of a multi-arch tag so they are deleted
+			// with their index.
+			if !gcrtypes.MediaType(tag.MediaType).IsIndex() {
+				continue
+			}
+			for _, img := range tag.Images {
+				if img.Digest == "" || img.Digest == digest {
+					continue
+				}
+				if _, ok := manifests[img.Digest]; ok {
+					continue
+				}
+
+				lastPushed := img.LastPushed.UTC()
+				if lastPushed.IsZero() {
+					lastPushed = pushed
+				}
+				manifests[img.Digest] = ManifestInfo{
+					Size:     img.Size,
+					Created:  lastPushed,
+					Uploaded: lastPushed,
+				}
+			}
+		}
+
+		u = page.Next
+	}
+
+	for digest, info := range manifests {
+		sort.Strings(info.Tags)
+		manifests[digest] = info
+	}
+	return manifests, nil
+}
+
+// DeleteTag deletes the tag using the Docker Hub API.
+func (r *DockerHubRegistry) DeleteTag(ctx context.Context, tag gcrname.Tag) error {
+	namespace, name, err := dockerHubRepository(tag.Context())
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/v2/namespaces/%s/repositories/%s/tags/%s",
+		r.baseURL, url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(tag.TagStr()))
+	if err := r.do(ctx, http.MethodDelete, u, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete tag: %w", err)
+	}
+	return nil
+}
+
+// DeleteDigest deletes the image using the Docker Hub API.
+func (r *DockerHubRegistry) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	namespace, name, err := dockerHubRepository(digest.Context())
+	if err != nil {
+		return err
+	}
+
+	type manifest struct {
+		Repository string `json:"repository"`
+		Digest     string `json:"digest"`
+	}
+	body := struct {
+		DryRun    bool        `json:"dry_run"`
+		Manifests []*manifest `json:"manifests"`
+	}{
+		Manifests: []*manifest{{Repository: name, Digest: digest.DigestStr()}},
+	}
+
+	u := fmt.Sprintf("%s/v2/namespaces/%s/delete-images",
+		r.baseURL, url.PathEscape(namespace))
+	if err := r.do(ctx, http.MethodPost, u, body, nil); err != nil {
+		return fmt.Errorf("failed to delete image: %w", err)
+	}
+	return nil
+}
+
+// Catalog lists all repositories in the configured namespaces.
+func (r *DockerHubRegistry) Catalog(ctx context.Context, _ gcrname.Registry) ([]string, error) {
+	var repos []string
+	for _, namespace := range r.namespaces {
+		u := fmt.Sprintf("%s/v2/namespaces/%s/repositories?page_size=%d",
+			r.baseURL, url.PathEscape(namespace), dockerHubPageSize)
+
+		for u != "" {
+			var page struct {
+				Next    string `json:"next"`
+				Results []struct {
+					Name string `json:"name"`
+				} `json:"results"`
+			}
+			if err := r.do(ctx, http.MethodGet, u, nil, &page); err != nil {
+				return nil, fmt.Errorf("failed to list repositories: %w", err)
+			}
+
+			for _, result := range page.Results {
+				repos = append(repos, namespace+"/"+result.Name)
+			}
+			u = page.Next
+		}
+	}
+	return repos, nil
+}
+
+// FetchManifest fetches the manifest using the registry API.
+func (r *DockerHubRegistry) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	return r.manifests.FetchManifest(ctx, ref)
+}
+
+// FetchBlob fetches the blob using the registry API.
+func (r *DockerHubRegistry) FetchBlob(ctx context.Context, digest gcrname.Digest) ([]byte, error) {
+	return fetchBlob(ctx, r.manifests, digest)
+}
+
+// ListReferrers lists the referrers using the registry API.
+func (r *DockerHubRegistry) ListReferrers(ctx context.Context, subject gcrname.Digest) ([]string, error) {
+	return listReferrers(ctx, r.manifests, subject)
+}
+
+// do performs an authenticated request against the Docker Hub API. If the
+// token has expired, it logs in again and retries once.
+func (r *DockerHubRegistry) do(ctx context.Context, method, u string, body, out any) error {
+	for attempt := 0; ; attempt++ {
+		jwt, err := r.login(ctx, attempt > 0)
+		if err != nil {
+			return err
+		}
+
+		req, err := newJSONRequest(ctx, method, u, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+jwt)
+
+		err = doJSON(r.client, req, out)
+		var aerr *apiError
+		if attempt == 0 && errors.As(err, &aerr) && aerr.StatusCode == http.StatusUnauthorized {
+			continue
+		}
+		return err
+	}
+}
+
+// login exchanges the username and token for a Docker Hub JWT. The JWT is
+// cached until force is true.
+func (r *DockerHubRegistry) login(ctx context.Context, force bool) (string, error) {
+	r.jwtLock.Lock()
+	defer r.jwtLock.Unlock()
+
+	if r.jwt != "" && !force {
+		return r.jwt, nil
+	}
+
+	req, err := newJSONRequest(ctx, http.MethodPost, r.baseURL+"/v2/users/login", map[string]string{
+		"username": r.username,
+		"password": r.token,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := doJSON(r.client, req, &resp); err != nil {
+		return "", fmt.Errorf("failed to login to docker hub: %w", err)
+	}
+	if resp.Token == "" {
+		return "", fmt.Errorf("failed to login to docker hub: no token returned")
+	}
+
+	r.jwt = resp.Token
+	return r.jwt, nil
+}
+
+// dockerHubRepository splits the repository into the Docker Hub namespace and
+// repository name.
+func dockerHubRepository(repo gcrname.Repository) (string, string, error) {
+	parts := strings.Split(repo.RepositoryStr(), "/")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid docker hub repository %q: must be namespace/name", repo.RepositoryStr())
+	}
+	return parts[0], parts[1], nil
+}
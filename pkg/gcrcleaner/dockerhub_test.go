@@ -0,0 +1,308 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// fakeDockerHub is a minimal stand-in for the Docker Hub API.
+type fakeDockerHub struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	logins  int
+	deleted []string
+}
+
+func newFakeDockerHub(tb testing.TB, tags []map[string]any) *fakeDockerHub {
+	tb.Helper()
+
+	hub := &fakeDockerHub{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/users/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body["username"] != "user" || body["password"] != "secret" {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		hub.lock.Lock()
+		hub.logins++
+		hub.lock.Unlock()
+		fmt.Fprintf(w, `{"token":"jwt"}`)
+	})
+
+	authed := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if got, want := r.Header.Get("Authorization"), "Bearer jwt"; got != want {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	// Tags are served one per page to exercise pagination.
+	mux.HandleFunc("/v2/namespaces/acme/repositories/app/tags", authed(func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+
+		resp := map[string]any{"results": []any{}}
+		if page < len(tags) {
+			resp["results"] = []any{tags[page]}
+		}
+		if page+1 < len(tags) {
+			resp["next"] = fmt.Sprintf("%s%s?page=%d", hub.server.URL, r.URL.Path, page+1)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+
+	mux.HandleFunc("/v2/namespaces/acme/repositories/app/tags/", authed(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hub.lock.Lock()
+		hub.deleted = append(hub.deleted, strings.TrimPrefix(r.URL.Path, "/v2/namespaces/acme/repositories/app/tags/"))
+		hub.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/v2/namespaces/acme/delete-images", authed(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Manifests []struct {
+				Repository string `json:"repository"`
+				Digest     string `json:"digest"`
+			} `json:"manifests"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hub.lock.Lock()
+		for _, m := range body.Manifests {
+			hub.deleted = append(hub.deleted, m.Repository+"@"+m.Digest)
+		}
+		hub.lock.Unlock()
+		fmt.Fprintf(w, `{}`)
+	}))
+
+	mux.HandleFunc("/v2/namespaces/acme/repositories", authed(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"results":[{"name":"app"},{"name":"web"}]}`)
+	}))
+
+	hub.server = httptest.NewServer(mux)
+	tb.Cleanup(hub.server.Close)
+	return hub
+}
+
+func TestDockerHubRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	hub := newFakeDockerHub(t, []map[string]any{
+		{
+			"name":            "latest",
+			"digest":          aa,
+			"media_type":      "application/vnd.oci.image.index.v1+json",
+			"full_size":       100,
+			"last_updated":    newer,
+			"tag_last_pushed": newer,
+			"images": []map[string]any{
+				{"digest": bb, "size": 100, "last_pushed": older},
+			},
+		},
+		{
+			"name":            "v1",
+			"digest":          aa,
+			"media_type":      "application/vnd.oci.image.index.v1+json",
+			"full_size":       100,
+			"last_updated":    older,
+			"tag_last_pushed": older,
+		},
+		{
+			"name":         "v0",
+			"digest":       cc,
+			"media_type":   "application/vnd.oci.image.manifest.v1+json",
+			"full_size":    50,
+			"last_updated": older,
+		},
+	})
+
+	registry, err := NewDockerHubRegistry(&DockerHubConfig{
+		URL:        hub.server.URL,
+		Username:   "user",
+		Token:      "secret",
+		Namespaces: []string{"acme"},
+	}, &fakeRegistry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := gcrname.NewRepository("acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := registry.ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]ManifestInfo{
+		aa: {
+			Size:      100,
+			MediaType: "application/vnd.oci.image.index.v1+json",
+			Created:   older,
+			Uploaded:  older,
+			Tags:      []string{"latest", "v1"},
+		},
+		bb: {
+			Size:     100,
+			Created:  older,
+			Uploaded: older,
+		},
+		cc: {
+			Size:      50,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Created:   older,
+			Uploaded:  older,
+			Tags:      []string{"v0"},
+		},
+	}
+	if got := manifests; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v to be %#v", got, want)
+	}
+
+	if err := registry.DeleteTag(ctx, repo.Tag("v0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.DeleteDigest(ctx, repo.Digest(cc)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hub.deleted, []string{"v0", "app@" + cc}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	repos, err := registry.Catalog(ctx, repo.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repos, []string{"acme/app", "acme/web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if got, want := hub.logins, 1; got != want {
+		t.Errorf("expected %d logins to be %d", got, want)
+	}
+}
+
+func TestRegistryRouter_For(t *testing.T) {
+	t.Parallel()
+
+	fallback := &fakeRegistry{repos: []string{"fallback"}}
+	hub := &fakeRegistry{repos: []string{"hub"}}
+	ecr := &fakeRegistry{repos: []string{"ecr"}}
+
+	router := NewRegistryRouter(fallback)
+	for _, host := range DockerHubHosts {
+		if err := router.Handle(host, hub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.Handle("*.dkr.ecr.*.amazonaws.com", ecr); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Handle("[", ecr); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+
+	cases := []struct {
+		name string
+		repo string
+		exp  string
+	}{
+		{
+			name: "docker_hub_short",
+			repo: "acme/app",
+			exp:  "hub",
+		},
+		{
+			name: "docker_hub_full",
+			repo: "docker.io/acme/app",
+			exp:  "hub",
+		},
+		{
+			name: "ecr",
+			repo: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app",
+			exp:  "ecr",
+		},
+		{
+			name: "fallback",
+			repo: "us-docker.pkg.dev/my-project/my-repo/app",
+			exp:  "fallback",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo, err := gcrname.NewRepository(tc.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repos, err := router.Catalog(context.Background(), repo.Registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(repos)
+			if got, want := repos, []string{tc.exp}; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ECRHostPatterns match the registry hosts of Amazon ECR private registries,
+// including their FIPS endpoints and the China regions.
+var ECRHostPatterns = []string{
+	"*.dkr.ecr.*.amazonaws.com",
+	"*.dkr.ecr-fips.*.amazonaws.com",
+	"*.dkr.ecr.*.amazonaws.com.cn",
+}
+
+// ecrHostRe extracts the account ID, FIPS suffix, and region from an ECR
+// registry host.
+var ecrHostRe = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ecrBatchSize is the maximum number of images in a BatchDeleteImage request.
+const ecrBatchSize = 100
+
+var (
+	_ Registry     = (*ECRRegistry)(nil)
+	_ BatchDeleter = (*ECRRegistry)(nil)
+)
+
+// ECRConfig is the configuration for an ECRRegistry.
+type ECRConfig struct {
+	// AWSConfig is the base AWS configuration. The region is always taken from
+	// the registry host. If nil, the default configuration is loaded from the
+	// environment.
+	AWSConfig *aws.Config
+
+	// Endpoint overrides the ECR API endpoint, for example for testing.
+	Endpoint string
+}
+
+// ECRRegistry is a Registry for Amazon ECR private registries. Images are
+// listed, fetched, and deleted with the ECR API using AWS credentials, so no
+// Docker credentials are required.
+//
+// In ECR, deleting the last tag of an image deletes the image. Deleting an
+// image that no longer exists is therefore not an error.
+type ECRRegistry struct {
+	cfg *ECRConfig
+
+	lock    sync.Mutex
+	clients map[string]*ecr.Client
+}
+
+// NewECRRegistry creates a new ECR registry.
+func NewECRRegistry(cfg *ECRConfig) *ECRRegistry {
+	if cfg == nil {
+		cfg = &ECRConfig{}
+	}
+
+	return &ECRRegistry{
+		cfg:     cfg,
+		clients: make(map[string]*ecr.Client, 2),
+	}
+}
+
+// ListManifests lists all images in the repository. ECR only records when an
+// image was pushed, so that is both the created and the uploaded time.
+func (r *ECRRegistry) ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error) {
+	client, account, err := r.client(ctx, repo.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]ManifestInfo, 8)
+	paginator := ecr.NewDescribeImagesPaginator(client, &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(repo.RepositoryStr()),
+		MaxResults:     aws.Int32(1000),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe images: %w", err)
+		}
+
+		for _, img := range page.ImageDetails {
+			digest := aws.ToString(img.ImageDigest)
+			if digest == "" {
+				continue
+			}
+
+			pushed := aws.ToTime(img.ImagePushedAt).UTC()
+
+			var tags []string
+			if len(img.ImageTags) > 0 {
+				tags = append(tags, img.ImageTags...)
+				sort.Strings(tags)
+			}
+
+			manifests[digest] = ManifestInfo{
+				Size:      uint64(aws.ToInt64(img.ImageSizeInBytes)),
+				MediaType: aws.ToString(img.ImageManifestMediaType),
+				Created:   pushed,
+				Uploaded:  pushed,
+				Tags:      tags,
+			}
+		}
+	}
+	return manifests, nil
+}
+
+// DeleteTag deletes the tag. If it is the last tag, the image is deleted too.
+func (r *ECRRegistry) DeleteTag(ctx context.Context, tag gcrname.Tag) error {
+	return r.DeleteBatch(ctx, []gcrname.Reference{tag})[0]
+}
+
+// DeleteDigest deletes the image and all of its tags.
+func (r *ECRRegistry) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	return r.DeleteBatch(ctx, []gcrname.Reference{digest})[0]
+}
+
+// DeleteBatch deletes the refs with BatchDeleteImage, up to 100 per request.
+// Each per-image failure is returned as the error for that ref.
+func (r *ECRRegistry) DeleteBatch(ctx context.Context, refs []gcrname.Reference) []error {
+	errs := make([]error, len(refs))
+	if len(refs) == 0 {
+		return errs
+	}
+
+	repo := refs[0].Context()
+	client, account, err := r.client(ctx, repo.Registry)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for start := 0; start < len(refs); start += ecrBatchSize {
+		end := start + ecrBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		// Index the refs in this batch by their identifier, so failures can be
+		// mapped back.
+		ids := make([]ecrtypes.ImageIdentifier, 0, end-start)
+		index := make(map[string]int, end-start)
+		for i := start; i < end; i++ {
+			var id ecrtypes.ImageIdentifier
+			switch typ := refs[i].(type) {
+			case gcrname.Tag:
+				id.ImageTag = aws.String(typ.TagStr())
+			case gcrname.Digest:
+				id.ImageDigest = aws.String(typ.DigestStr())
+			default:
+				errs[i] = fmt.Errorf("unknown reference type %T", refs[i])
+				continue
+			}
+			ids = append(ids, id)
+			index[ecrImageKey(id)] = i
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		out, err := client.BatchDeleteImage(ctx, &ecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(account),
+			RepositoryName: aws.String(repo.RepositoryStr()),
+			ImageIds:       ids,
+		})
+		if err != nil {
+			for _, i := range index {
+				errs[i] = fmt.Errorf("failed to batch delete images: %w", err)
+			}
+			continue
+		}
+
+		for _, failure := range out.Failures {
+			if failure.ImageId == nil {
+				continue
+			}
+
+			// The image is already gone, for example because its last tag was
+			// deleted.
+			if failure.FailureCode == ecrtypes.ImageFailureCodeImageNotFound {
+				continue
+			}
+
+			i, ok := index[ecrImageKey(*failure.ImageId)]
+			if !ok {
+				continue
+			}
+			errs[i] = &ecrImageError{
+				Code:   failure.FailureCode,
+				Reason: aws.ToString(failure.FailureReason),
+			}
+		}
+	}
+	return errs
+}
+
+// Catalog lists all repositories in the registry.
+func (r *ECRRegistry) Catalog(ctx context.Context, registry gcrname.Registry) ([]string, error) {
+	client, account, err := r.client(ctx, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []string
+	paginator := ecr.NewDescribeRepositoriesPaginator(client, &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(account),
+		MaxResults: aws.Int32(1000),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe repositories: %w", err)
+		}
+
+		for _, repo := range page.Repositories {
+			repos = append(repos, aws.ToString(repo.RepositoryName))
+		}
+	}
+	return repos, nil
+}
+
+// FetchManifest fetches the manifest with BatchGetImage.
+func (r *ECRRegistry) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	repo := ref.Context()
+	client, account, err := r.client(ctx, repo.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	var id ecrtypes.ImageIdentifier
+	switch typ := ref.(type) {
+	case gcrname.Tag:
+		id.ImageTag = aws.String(typ.TagStr())
+	case gcrname.Digest:
+		id.ImageDigest = aws.String(typ.DigestStr())
+	default:
+		return nil, fmt.Errorf("unknown reference type %T", ref)
+	}
+
+	out, err := client.BatchGetImage(ctx, &ecr.BatchGetImageInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(repo.RepositoryStr()),
+		ImageIds:       []ecrtypes.ImageIdentifier{id},
+		AcceptedMediaTypes: []string{
+			string(gcrtypes.OCIImageIndex),
+			string(gcrtypes.OCIManifestSchema1),
+			string(gcrtypes.DockerManifestList),
+			string(gcrtypes.DockerManifestSchema2),
+			string(gcrtypes.DockerManifestSchema1),
+			string(gcrtypes.DockerManifestSchema1Signed),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image: %w", err)
+	}
+
+	if len(out.Failures) > 0 {
+		failure := out.Failures[0]
+		return nil, &ecrImageError{
+			Code:   failure.FailureCode,
+			Reason: aws.ToString(failure.FailureReason),
+		}
+	}
+	if len(out.Images) == 0 {
+		return nil, fmt.Errorf("no image returned for %s", ref)
+	}
+
+	img := out.Images[0]
+	return &RawManifest{
+		Digest:    aws.ToString(img.ImageId.ImageDigest),
+		MediaType: aws.ToString(img.ImageManifestMediaType),
+		Body:      []byte(aws.ToString(img.ImageManifest)),
+	}, nil
+}
+
+// ecrHost is an ECR registry host.
+type ecrHost struct {
+	account string
+	region  string
+	fips    bool
+}
+
+// parseECRHost parses an ECR registry host, such as
+// "123456789012.dkr.ecr.us-east-1.amazonaws.com".
+func parseECRHost(host string) (*ecrHost, error) {
+	matches := ecrHostRe.FindStringSubmatch(host)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid ecr registry %q", host)
+	}
+	return &ecrHost{
+		account: matches[1],
+		region:  matches[3],
+		fips:    matches[2] != "",
+	}, nil
+}
+
+// client returns the ECR client and account ID for the registry. Clients are
+// cached per region and endpoint variant. The SDK resolves the endpoints of
+// the China regions from the region.
+func (r *ECRRegistry) client(ctx context.Context, registry gcrname.Registry) (*ecr.Client, string, error) {
+	host, err := parseECRHost(registry.RegistryStr())
+	if err != nil {
+		return nil, "", err
+	}
+	account, region := host.account, host.region
+
+	key := region
+	if host.fips {
+		key += "-fips"
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if client, ok := r.clients[key]; ok {
+		return client, account, nil
+	}
+
+	var cfg aws.Config
+	if r.cfg.AWSConfig != nil {
+		cfg = r.cfg.AWSConfig.Copy()
+	} else {
+		loaded, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load aws config: %w", err)
+		}
+		cfg = loaded
+	}
+	cfg.Region = region
+
+	client := ecr.NewFromConfig(cfg, func(o *ecr.Options) {
+		if host.fips {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+		if r.cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(r.cfg.Endpoint)
+		}
+	})
+	r.clients[key] = client
+	return client, account, nil
+}
+
+// ecrImageKey returns a key that identifies the image in a batch request.
+func ecrImageKey(id ecrtypes.ImageIdentifier) string {
+	if d := aws.ToString(id.ImageDigest); d != "" {
+		return "@" + d
+	}
+	return ":" + aws.ToString(id.ImageTag)
+}
+
+// ecrImageError is a per-image failure returned by the ECR batch APIs.
+type ecrImageError struct {
+	Code   ecrtypes.ImageFailureCode
+	Reason string
+}
+
+func (e *ecrImageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// Temporary returns true if the request may succeed if retried.
+func (e *ecrImageError) Temporary() bool {
+	return e.Code == ecrtypes.ImageFailureCodeUpstreamTooManyRequests ||
+		e.Code == ecrtypes.ImageFailureCodeUpstreamUnavailable
+}
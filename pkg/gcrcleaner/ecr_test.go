@@ -0,0 +1,409 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// fakeECRImage is an image in the fake ECR API.
+type fakeECRImage struct {
+	digest    string
+	mediaType string
+	manifest  string
+	tags      []string
+	pushedAt  time.Time
+}
+
+// fakeECR is a minimal stand-in for the ECR JSON API. It only supports a
+// single repository.
+type fakeECR struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	images  []*fakeECRImage
+	batches [][]string
+}
+
+func newFakeECR(tb testing.TB, images []*fakeECRImage) *fakeECR {
+	tb.Helper()
+
+	f := &fakeECR{images: images}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	tb.Cleanup(f.server.Close)
+	return f
+}
+
+type fakeECRImageID struct {
+	ImageDigest string `json:"imageDigest,omitempty"`
+	ImageTag    string `json:"imageTag,omitempty"`
+}
+
+func (f *fakeECR) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RepositoryName string            `json:"repositoryName"`
+		NextToken      string            `json:"nextToken"`
+		ImageIds       []*fakeECRImageID `json:"imageIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	target := r.Header.Get("X-Amz-Target")
+	switch target[strings.LastIndex(target, ".")+1:] {
+	case "DescribeImages":
+		// Return one image per page to exercise pagination.
+		page := 0
+		fmt.Sscanf(req.NextToken, "%d", &page)
+
+		details := []map[string]any{}
+		if page < len(f.images) {
+			img := f.images[page]
+			details = append(details, map[string]any{
+				"imageDigest":            img.digest,
+				"imageManifestMediaType": img.mediaType,
+				"imageTags":              img.tags,
+				"imagePushedAt":          img.pushedAt.Unix(),
+				"imageSizeInBytes":       10,
+			})
+		}
+
+		resp := map[string]any{"imageDetails": details}
+		if page+1 < len(f.images) {
+			resp["nextToken"] = fmt.Sprintf("%d", page+1)
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case "BatchGetImage":
+		var images []map[string]any
+		for _, id := range req.ImageIds {
+			for _, img := range f.images {
+				if img.digest == id.ImageDigest {
+					images = append(images, map[string]any{
+						"imageId":                map[string]string{"imageDigest": img.digest},
+						"imageManifest":          img.manifest,
+						"imageManifestMediaType": img.mediaType,
+					})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"images": images})
+
+	case "BatchDeleteImage":
+		var batch []string
+		var failures []map[string]any
+		for _, id := range req.ImageIds {
+			if id.ImageTag == "locked" {
+				failures = append(failures, map[string]any{
+					"imageId":       id,
+					"failureCode":   "KmsError",
+					"failureReason": "access denied",
+				})
+				continue
+			}
+			if id.ImageDigest != "" {
+				batch = append(batch, id.ImageDigest)
+			} else {
+				batch = append(batch, id.ImageTag)
+			}
+		}
+		f.batches = append(f.batches, batch)
+		json.NewEncoder(w).Encode(map[string]any{"failures": failures})
+
+	case "DescribeRepositories":
+		json.NewEncoder(w).Encode(map[string]any{
+			"repositories": []map[string]string{
+				{"repositoryName": "team/app"},
+				{"repositoryName": "team/web"},
+			},
+		})
+
+	default:
+		http.Error(w, "unknown target "+target, http.StatusBadRequest)
+	}
+}
+
+func newTestECRRegistry(tb testing.TB, f *fakeECR) *ECRRegistry {
+	tb.Helper()
+
+	return NewECRRegistry(&ECRConfig{
+		AWSConfig: &aws.Config{
+			Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		},
+		Endpoint: f.server.URL,
+	})
+}
+
+func mustRepository(tb testing.TB, s string) gcrname.Repository {
+	tb.Helper()
+
+	repo, err := gcrname.NewRepository(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return repo
+}
+
+func TestECRRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	pushed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	f := newFakeECR(t, []*fakeECRImage{
+		{
+			digest:    aa,
+			mediaType: "application/vnd.oci.image.index.v1+json",
+			manifest:  `{"schemaVersion":2,"manifests":[{"digest":"` + bb + `"}]}`,
+			tags:      []string{"v1", "latest"},
+			pushedAt:  pushed,
+		},
+		{
+			digest:    bb,
+			mediaType: "application/vnd.oci.image.manifest.v1+json",
+			pushedAt:  pushed,
+		},
+	})
+	registry := newTestECRRegistry(t, f)
+
+	repo := mustRepository(t, "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app")
+
+	manifests, err := registry.ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]ManifestInfo{
+		aa: {
+			Size:      10,
+			MediaType: "application/vnd.oci.image.index.v1+json",
+			Created:   pushed,
+			Uploaded:  pushed,
+			Tags:      []string{"latest", "v1"},
+		},
+		bb: {
+			Size:      10,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Created:   pushed,
+			Uploaded:  pushed,
+		},
+	}
+	if got := manifests; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v to be %#v", got, want)
+	}
+
+	raw, err := registry.FetchManifest(ctx, repo.Digest(aa))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := raw.MediaType, "application/vnd.oci.image.index.v1+json"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	repos, err := registry.Catalog(ctx, repo.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repos, []string{"team/app", "team/web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if _, err := registry.ListManifests(ctx, mustRepository(t, "registry.example/team/app")); err == nil {
+		t.Errorf("expected error for non-ecr host")
+	}
+}
+
+func TestECRRegistry_DeleteBatch(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	f := newFakeECR(t, nil)
+	registry := newTestECRRegistry(t, f)
+
+	repo := mustRepository(t, "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app")
+
+	// 250 digests plus a tag that fails are deleted in three batches.
+	refs := make([]gcrname.Reference, 0, 251)
+	for i := 0; i < 250; i++ {
+		refs = append(refs, repo.Digest(fmt.Sprintf("sha256:%064x", i)))
+	}
+	refs = append(refs, repo.Tag("locked"))
+
+	errs := registry.DeleteBatch(ctx, refs)
+	if got, want := len(errs), len(refs); got != want {
+		t.Fatalf("expected %d errors to be %d", got, want)
+	}
+	for i, err := range errs[:250] {
+		if err != nil {
+			t.Errorf("expected %s to be deleted: %s", refs[i], err)
+		}
+	}
+	if err := errs[250]; err == nil || !strings.Contains(err.Error(), "KmsError") {
+		t.Errorf("expected %v to contain %q", err, "KmsError")
+	}
+
+	sizes := make([]int, 0, len(f.batches))
+	for _, batch := range f.batches {
+		sizes = append(sizes, len(batch))
+	}
+	sort.Ints(sizes)
+	if got, want := sizes, []int{50, 100, 100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+}
+
+func TestCleaner_Clean_ECR(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+	pushed := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	f := newFakeECR(t, []*fakeECRImage{
+		{
+			digest:    aa,
+			mediaType: "application/vnd.oci.image.index.v1+json",
+			manifest:  `{"schemaVersion":2,"manifests":[{"digest":"` + bb + `"},{"digest":"` + cc + `"}]}`,
+			tags:      []string{"old"},
+			pushedAt:  pushed,
+		},
+		{
+			digest:    bb,
+			mediaType: "application/vnd.oci.image.manifest.v1+json",
+			manifest:  `{"schemaVersion":2}`,
+			pushedAt:  pushed,
+		},
+		{
+			digest:    cc,
+			mediaType: "application/vnd.oci.image.manifest.v1+json",
+			manifest:  `{"schemaVersion":2}`,
+			pushedAt:  pushed,
+		},
+	})
+
+	router := NewRegistryRouter(&fakeRegistry{})
+	ecrRegistry := newTestECRRegistry(t, f)
+	for _, pattern := range ECRHostPatterns {
+		if err := router.Handle(pattern, ecrRegistry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestCleaner(t, WithRegistry(router))
+
+	tagFilter, err := BuildTagFilter("old", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := c.CleanPolicy(ctx, "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app", &Policy{
+		TagFilter: tagFilter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(deleted), 4; got != want {
+		t.Errorf("expected %d deleted refs to be %d: %q", got, want, deleted)
+	}
+
+	// The tag, then the index, then both children in a single batch.
+	if got, want := f.batches, [][]string{{"old"}, {aa}, {bb, cc}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestParseECRHost(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		host string
+		exp  *ecrHost
+		err  bool
+	}{
+		{
+			name: "standard",
+			host: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			exp:  &ecrHost{account: "123456789012", region: "us-east-1"},
+		},
+		{
+			name: "fips",
+			host: "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com",
+			exp:  &ecrHost{account: "123456789012", region: "us-gov-west-1", fips: true},
+		},
+		{
+			name: "china",
+			host: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			exp:  &ecrHost{account: "123456789012", region: "cn-north-1"},
+		},
+		{
+			name: "public",
+			host: "public.ecr.aws",
+			err:  true,
+		},
+		{
+			name: "short_account",
+			host: "1234.dkr.ecr.us-east-1.amazonaws.com",
+			err:  true,
+		},
+		{
+			name: "other_suffix",
+			host: "123456789012.dkr.ecr.us-east-1.amazonaws.com.example",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseECRHost(tc.host)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := got, tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %#v to be %#v", got, want)
+			}
+		})
+	}
+}
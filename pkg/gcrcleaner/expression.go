@@ -0,0 +1,136 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+// expressionEnv declares the variables that are available to expressions.
+var expressionEnv = []cel.EnvOption{
+	cel.Variable("repo", cel.StringType),
+	cel.Variable("digest", cel.StringType),
+	cel.Variable("tags", cel.ListType(cel.StringType)),
+	cel.Variable("created", cel.TimestampType),
+	cel.Variable("uploaded", cel.TimestampType),
+	cel.Variable("size", cel.IntType),
+	cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+	cel.Variable("media_type", cel.StringType),
+	cel.Variable("now", cel.TimestampType),
+}
+
+// Expression is a compiled CEL (https://cel.dev) expression that decides
+// whether an image is deleted. It must evaluate to a boolean, where true means
+// the image is deleted. For example:
+//
+//	tags.size() == 0 && now - uploaded > duration("72h") ||
+//	  tags.exists(t, t.startsWith("pr-")) && now - uploaded > duration("336h") &&
+//	  labels[?"keep"].orValue("") != "true"
+type Expression struct {
+	source  string
+	program cel.Program
+
+	// variables are the names of the variables that the expression references.
+	variables map[string]struct{}
+}
+
+// BuildExpression compiles and type-checks the given CEL expression. If the
+// expression is empty, it returns nil.
+func BuildExpression(s string) (*Expression, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	env, err := cel.NewEnv(append(expressionEnv, cel.OptionalTypes())...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expression environment: %w", err)
+	}
+
+	ast, iss := env.Compile(s)
+	if err := iss.Err(); err != nil {
+		return nil, fmt.Errorf("failed to compile expression %q: %w", s, err)
+	}
+	if got := ast.OutputType(); !got.IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("expression %q must evaluate to a bool, got %s", s, got)
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression %q: %w", s, err)
+	}
+	variables := make(map[string]struct{}, len(expressionEnv))
+	for _, ref := range ast.NativeRep().ReferenceMap() {
+		if ref.Name != "" && len(ref.OverloadIDs) == 0 {
+			variables[ref.Name] = struct{}{}
+		}
+	}
+
+	return &Expression{source: s, program: program, variables: variables}, nil
+}
+
+// references returns true if the expression references the named variable. It
+// is safe to call on a nil expression.
+func (e *Expression) references(name string) bool {
+	if e == nil {
+		return false
+	}
+	_, ok := e.variables[name]
+	return ok
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	if e == nil {
+		return "(none)"
+	}
+	return e.source
+}
+
+// Evaluate returns true if the expression deletes the manifest. Like grace
+// and keep, created and uploaded are the time from the time source, if any.
+func (e *Expression) Evaluate(m *manifest, now time.Time) (bool, error) {
+	tags := m.Info.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	labels := m.Info.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	out, _, err := e.program.Eval(map[string]any{
+		"repo":       m.Repo,
+		"digest":     m.Digest,
+		"tags":       tags,
+		"created":    m.created(),
+		"uploaded":   m.uploaded(),
+		"size":       int64(m.Info.Size),
+		"labels":     labels,
+		"media_type": m.Info.MediaType,
+		"now":        now.UTC(),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate expression %q: %w", e.source, err)
+	}
+
+	del, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %s, not a bool", e.source, out.Type())
+	}
+	return del, nil
+}
@@ -0,0 +1,299 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildExpression(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		expr string
+		err  string
+	}{
+		{
+			name: "empty",
+			expr: "",
+		},
+		{
+			name: "valid",
+			expr: `tags.size() == 0 && now - created > duration("72h")`,
+		},
+		{
+			name: "syntax_error",
+			expr: `tags.size( == 0`,
+			err:  "failed to compile expression",
+		},
+		{
+			name: "undeclared_variable",
+			expr: `age > 3`,
+			err:  "undeclared reference to 'age'",
+		},
+		{
+			name: "type_error",
+			expr: `size > "big"`,
+			err:  "found no matching overload",
+		},
+		{
+			name: "not_bool",
+			expr: `digest`,
+			err:  "must evaluate to a bool",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := BuildExpression(tc.expr)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+				if got, want := err.Error(), tc.expr; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := e == nil, tc.expr == ""; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestExpression_Evaluate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+
+	m := &manifest{
+		Repo:   "gcr.io/p/r",
+		Digest: "sha256:abc",
+		Info: ManifestInfo{
+			Size:      2048,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Created:   now.Add(-96 * time.Hour),
+			Uploaded:  now.Add(-48 * time.Hour),
+			Tags:      []string{"pr-1", "latest"},
+			Labels:    map[string]string{"keep": "true"},
+		},
+	}
+	resolved := &manifest{
+		Repo:   "gcr.io/p/r",
+		Digest: "sha256:123",
+		Info: ManifestInfo{
+			Created:  time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC),
+			Uploaded: now.Add(-time.Hour),
+		},
+		Time:       now.Add(-96 * time.Hour),
+		TimeSource: "tag nightly",
+	}
+	untagged := &manifest{
+		Repo:   "gcr.io/p/r",
+		Digest: "sha256:def",
+		Info: ManifestInfo{
+			Created:  now.Add(-96 * time.Hour),
+			Uploaded: now.Add(-96 * time.Hour),
+		},
+	}
+
+	cases := []struct {
+		name string
+		expr string
+		m    *manifest
+		exp  bool
+		err  bool
+	}{
+		{
+			name: "tags",
+			expr: `tags.exists(t, t.startsWith("pr-"))`,
+			m:    m,
+			exp:  true,
+		},
+		{
+			name: "untagged",
+			expr: `tags.size() == 0`,
+			m:    untagged,
+			exp:  true,
+		},
+		{
+			name: "created",
+			expr: `now - created > duration("72h")`,
+			m:    m,
+			exp:  true,
+		},
+		{
+			name: "uploaded",
+			expr: `now - uploaded > duration("72h")`,
+			m:    m,
+			exp:  false,
+		},
+		{
+			name: "time_source",
+			expr: `now - created > duration("72h") && now - uploaded > duration("72h")`,
+			m:    resolved,
+			exp:  true,
+		},
+		{
+			name: "metadata",
+			expr: `repo == "gcr.io/p/r" && digest == "sha256:abc" && size > 1024 && media_type.contains("oci")`,
+			m:    m,
+			exp:  true,
+		},
+		{
+			name: "labels",
+			expr: `labels[?"keep"].orValue("false") != "true"`,
+			m:    m,
+			exp:  false,
+		},
+		{
+			name: "missing_label",
+			expr: `labels[?"keep"].orValue("false") != "true"`,
+			m:    untagged,
+			exp:  true,
+		},
+		{
+			name: "runtime_error",
+			expr: `labels["keep"] == "true"`,
+			m:    untagged,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := BuildExpression(tc.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := e.Evaluate(tc.m, now)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if want := tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestExpression_References(t *testing.T) {
+	t.Parallel()
+
+	e, err := BuildExpression(`tags.size() == 0 && labels[?"keep"].orValue("") != "true"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{
+		"tags":       true,
+		"labels":     true,
+		"media_type": false,
+		"size":       false,
+	} {
+		if got := e.references(name); got != want {
+			t.Errorf("expected %s to be %t", name, want)
+		}
+	}
+
+	var none *Expression
+	if none.references("labels") {
+		t.Errorf("expected nil expression to reference nothing")
+	}
+}
+
+func TestCleaner_CleanWithResult_ExpressionLabels(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cfg := "sha256:" + strings.Repeat("c", 64)
+	empty := "sha256:" + strings.Repeat("e", 64)
+
+	// Like GCR and Artifact Registry, the listing has no labels.
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	manifest := func(digest, config string) *RawManifest {
+		return &RawManifest{
+			Digest:    digest,
+			MediaType: mediaType,
+			Body: []byte(fmt.Sprintf(`{
+				"schemaVersion": 2,
+				"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": %q, "size": 1}
+			}`, config)),
+		}
+	}
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-1"}},
+			bb: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-2"}},
+		},
+		raw: map[string]*RawManifest{
+			aa: manifest(aa, cfg),
+			bb: manifest(bb, empty),
+		},
+		blobs: map[string][]byte{
+			cfg:   []byte(`{"config": {"Labels": {"keep": "true"}}}`),
+			empty: []byte(`{"config": {}}`),
+		},
+	}
+
+	expression, err := BuildExpression(`labels[?"keep"].orValue("") != "true"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{
+		TagFilter:  &TagFilterNull{},
+		Expression: expression,
+		DryRun:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(result.Deleted))
+	for _, ref := range result.Deleted {
+		got = append(got, ref.Digest)
+	}
+	if want := []string{bb, bb}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
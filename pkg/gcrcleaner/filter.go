@@ -17,6 +17,8 @@ package gcrcleaner
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"time"
 )
 
 // TagFilter is an interface which defines whether a given set of tags matches
@@ -41,13 +43,13 @@ func BuildTagFilter(any, all string) (TagFilter, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile tag_filter_any regular expression %q: %w", any, err)
 		}
-		return &TagFilterAny{re}, nil
+		return &TagFilterAny{re: re}, nil
 	case all != "":
 		re, err := regexp.Compile(all)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile tag_filter_all regular expression %q: %w", all, err)
 		}
-		return &TagFilterAll{re}, nil
+		return &TagFilterAll{re: re}, nil
 	default:
 		// If no filters were provided, return the null filter which just returns
 		// false for all matches.
@@ -55,6 +57,37 @@ func BuildTagFilter(any, all string) (TagFilter, error) {
 	}
 }
 
+// BuildProtectedTags compiles the given regular expressions for protected
+// tags.
+func BuildProtectedTags(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	out := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile protected_tags regular expression %q: %w", pattern, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+// protectedTag returns the first tag that matches any of the protected tag
+// expressions, and the expression it matches.
+func protectedTag(protected []*regexp.Regexp, tags []string) (string, *regexp.Regexp, bool) {
+	for _, re := range protected {
+		for _, t := range tags {
+			if re.MatchString(t) {
+				return t, re, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
 var _ TagFilter = (*TagFilterNull)(nil)
 
 // TagFilterNull always returns false.
@@ -72,6 +105,9 @@ func (f *TagFilterNull) Name() string {
 // matches, it returns true. If no tags match, it returns false.
 type TagFilterAny struct {
 	re *regexp.Regexp
+
+	// patterns are the expressions combined into re, if there are several.
+	patterns []string
 }
 
 func (f *TagFilterAny) Matches(tags []string) bool {
@@ -87,7 +123,7 @@ func (f *TagFilterAny) Matches(tags []string) bool {
 }
 
 func (f *TagFilterAny) Name() string {
-	return fmt.Sprintf("any(%s)", f.re.String())
+	return fmt.Sprintf("any(%s)", patternsName(f.re, f.patterns))
 }
 
 var _ TagFilter = (*TagFilterAll)(nil)
@@ -96,10 +132,13 @@ var _ TagFilter = (*TagFilterAll)(nil)
 // it returns true. If one more more tags do not match, it returns false.
 type TagFilterAll struct {
 	re *regexp.Regexp
+
+	// patterns are the expressions combined into re, if there are several.
+	patterns []string
 }
 
 func (f *TagFilterAll) Name() string {
-	return fmt.Sprintf("all(%s)", f.re.String())
+	return fmt.Sprintf("all(%s)", patternsName(f.re, f.patterns))
 }
 
 func (f *TagFilterAll) Matches(tags []string) bool {
@@ -113,3 +152,173 @@ func (f *TagFilterAll) Matches(tags []string) bool {
 	}
 	return true
 }
+
+var _ TagFilter = (*TagFilterNone)(nil)
+
+// TagFilterNone filters based on the entire list. If no tags in the list
+// match, it returns true. If any tag matches, it returns false.
+type TagFilterNone struct {
+	re *regexp.Regexp
+
+	// patterns are the expressions combined into re, if there are several.
+	patterns []string
+}
+
+func (f *TagFilterNone) Name() string {
+	return fmt.Sprintf("none(%s)", patternsName(f.re, f.patterns))
+}
+
+func (f *TagFilterNone) Matches(tags []string) bool {
+	if f.re == nil {
+		return false
+	}
+	for _, t := range tags {
+		if f.re.MatchString(t) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ TagFilter = (*TagFilterAnd)(nil)
+
+// TagFilterAnd returns true if all of its filters match.
+type TagFilterAnd struct {
+	Filters []TagFilter
+}
+
+func (f *TagFilterAnd) Name() string {
+	names := make([]string, 0, len(f.Filters))
+	for _, filter := range f.Filters {
+		names = append(names, operandName(filter))
+	}
+	return strings.Join(names, " and ")
+}
+
+func (f *TagFilterAnd) Matches(tags []string) bool {
+	if len(f.Filters) == 0 {
+		return false
+	}
+	for _, filter := range f.Filters {
+		if !filter.Matches(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ TagFilter = (*TagFilterOr)(nil)
+
+// TagFilterOr returns true if any of its filters match.
+type TagFilterOr struct {
+	Filters []TagFilter
+}
+
+func (f *TagFilterOr) Name() string {
+	names := make([]string, 0, len(f.Filters))
+	for _, filter := range f.Filters {
+		names = append(names, filter.Name())
+	}
+	return strings.Join(names, " or ")
+}
+
+func (f *TagFilterOr) Matches(tags []string) bool {
+	for _, filter := range f.Filters {
+		if filter.Matches(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ TagFilter = (*TagFilterNot)(nil)
+
+// TagFilterNot negates its filter.
+type TagFilterNot struct {
+	Filter TagFilter
+}
+
+func (f *TagFilterNot) Name() string {
+	return "not " + operandName(f.Filter)
+}
+
+func (f *TagFilterNot) Matches(tags []string) bool {
+	return !f.Filter.Matches(tags)
+}
+
+var _ TagFilter = (*TagFilterGrace)(nil)
+
+// TagFilterGrace matches like its filter, but sets the grace period for the
+// images that it matches.
+type TagFilterGrace struct {
+	Filter TagFilter
+	Grace  time.Duration
+}
+
+func (f *TagFilterGrace) Name() string {
+	return operandName(f.Filter) + " older than " + f.Grace.String()
+}
+
+func (f *TagFilterGrace) Matches(tags []string) bool {
+	return f.Filter.Matches(tags)
+}
+
+// tagFilterGrace returns the grace period set by the parts of the filter that
+// match the tags, and a description of where it came from. All parts of an
+// "and" must match, so the longest grace period applies. Any part of an "or"
+// may match, so the shortest grace period of the parts that match applies.
+// Parts without a grace period use the given default. The filter must match
+// the tags.
+func tagFilterGrace(f TagFilter, tags []string, grace time.Duration, from string) (time.Duration, string) {
+	switch f := f.(type) {
+	case *TagFilterGrace:
+		return f.Grace, f.Name()
+	case *TagFilterAnd:
+		var longest time.Duration
+		var longestFrom string
+		for i, filter := range f.Filters {
+			g, gFrom := tagFilterGrace(filter, tags, grace, from)
+			if i == 0 || g > longest {
+				longest, longestFrom = g, gFrom
+			}
+		}
+		return longest, longestFrom
+	case *TagFilterOr:
+		var shortest time.Duration
+		var shortestFrom string
+		for _, filter := range f.Filters {
+			if !filter.Matches(tags) {
+				continue
+			}
+			g, gFrom := tagFilterGrace(filter, tags, grace, from)
+			if shortestFrom == "" || g < shortest {
+				shortest, shortestFrom = g, gFrom
+			}
+		}
+		return shortest, shortestFrom
+	default:
+		return grace, from
+	}
+}
+
+// operandName returns the name of the filter, wrapped in parentheses if it is
+// a composition with a lower precedence.
+func operandName(f TagFilter) string {
+	switch f.(type) {
+	case *TagFilterAnd, *TagFilterOr:
+		return "(" + f.Name() + ")"
+	default:
+		return f.Name()
+	}
+}
+
+// patternsName returns the expressions of a filter, separated by commas.
+func patternsName(re *regexp.Regexp, patterns []string) string {
+	if len(patterns) > 0 {
+		return strings.Join(patterns, ", ")
+	}
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
@@ -0,0 +1,355 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BuildTagFilterExpr builds a tag filter from an expression or from the any
+// and all regular expressions, which are mutually exclusive with it.
+func BuildTagFilterExpr(expr, any, all string) (TagFilter, error) {
+	if expr == "" {
+		return BuildTagFilter(any, all)
+	}
+
+	if any != "" || all != "" {
+		return nil, fmt.Errorf("only one tag filter type may be specified")
+	}
+	return ParseTagFilter(expr)
+}
+
+// ParseTagFilter parses a tag filter expression such as:
+//
+//	any(^pr-) and not any(^release-, ^hotfix-)
+//
+// The functions any, all, and none take one or more regular expressions,
+// separated by commas, and match like TagFilterAny, TagFilterAll, and
+// TagFilterNone. A regular expression can be quoted with double quotes or
+// backticks if it has unbalanced parentheses or a comma. Filters are combined
+// with "not", "and", and "or", in order of precedence, and grouped with
+// parentheses. A function or group followed by "older than" and a duration,
+// such as "any(^pr-) older than 720h", sets the grace period for the images it
+// matches.
+func ParseTagFilter(expr string) (TagFilter, error) {
+	p := &filterParser{expr: expr}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tag_filter expression %q: %w", expr, err)
+	}
+
+	p.skipSpace()
+	if !p.done() {
+		return nil, fmt.Errorf("failed to parse tag_filter expression %q: %w", expr,
+			p.errorf("unexpected %q", p.expr[p.pos:]))
+	}
+	return f, nil
+}
+
+// filterParser is a recursive descent parser for tag filter expressions.
+// Regular expressions can contain almost any character, so the expression is
+// parsed directly instead of being split into tokens first.
+type filterParser struct {
+	expr string
+	pos  int
+}
+
+// parseOr parses one or more "and" expressions separated by "or".
+func (p *filterParser) parseOr() (TagFilter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []TagFilter{f}
+	for p.keyword("or") {
+		f, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return &TagFilterOr{Filters: filters}, nil
+}
+
+// parseAnd parses one or more unary expressions separated by "and".
+func (p *filterParser) parseAnd() (TagFilter, error) {
+	f, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []TagFilter{f}
+	for p.keyword("and") {
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return &TagFilterAnd{Filters: filters}, nil
+}
+
+// parseNot parses a primary expression with any number of "not" prefixes.
+func (p *filterParser) parseNot() (TagFilter, error) {
+	if p.keyword("not") {
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &TagFilterNot{Filter: f}, nil
+	}
+	return p.parseGrace()
+}
+
+// parseGrace parses a primary expression with an optional "older than"
+// suffix.
+func (p *filterParser) parseGrace() (TagFilter, error) {
+	f, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.keyword("older") {
+		return f, nil
+	}
+	if !p.keyword("than") {
+		return nil, p.errorf("expected than after older")
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for !p.done() && !strings.ContainsRune(" \t\r\n()", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+	grace, err := ParseDuration(p.expr[start:p.pos])
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("invalid duration: %s", err)
+	}
+	if grace < 0 {
+		p.pos = start
+		return nil, p.errorf("duration must be positive")
+	}
+	return &TagFilterGrace{Filter: f, Grace: grace}, nil
+}
+
+// parsePrimary parses a parenthesized expression or a function.
+func (p *filterParser) parsePrimary() (TagFilter, error) {
+	p.skipSpace()
+	if p.done() {
+		return nil, p.errorf("expected a filter")
+	}
+
+	if p.expr[p.pos] == '(' {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.done() || p.expr[p.pos] != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return f, nil
+	}
+
+	start := p.pos
+	name := p.word()
+	switch name {
+	case "any", "all", "none":
+	case "":
+		return nil, p.errorf("expected a filter")
+	default:
+		p.pos = start
+		return nil, p.errorf("unknown filter %q, must be any, all, or none", name)
+	}
+
+	p.skipSpace()
+	if p.done() || p.expr[p.pos] != '(' {
+		return nil, p.errorf("expected ( after %s", name)
+	}
+	p.pos++
+
+	patterns, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := compilePatterns(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %s regular expression: %w", name, err)
+	}
+
+	switch name {
+	case "any":
+		return &TagFilterAny{re: re, patterns: patterns}, nil
+	case "all":
+		return &TagFilterAll{re: re, patterns: patterns}, nil
+	default:
+		return &TagFilterNone{re: re, patterns: patterns}, nil
+	}
+}
+
+// parseArgs parses the comma-separated regular expressions of a function up to
+// and including the closing parenthesis.
+func (p *filterParser) parseArgs() ([]string, error) {
+	var args []string
+	for {
+		arg, err := p.parseArg()
+		if err != nil {
+			return nil, err
+		}
+		if arg == "" {
+			return nil, p.errorf("expected a regular expression")
+		}
+		args = append(args, arg)
+
+		// parseArg stops at a comma or the closing parenthesis.
+		c := p.expr[p.pos]
+		p.pos++
+		if c == ')' {
+			return args, nil
+		}
+	}
+}
+
+// parseArg parses a single regular expression, which ends at a comma or
+// parenthesis that is not part of a group, character class, or repetition.
+func (p *filterParser) parseArg() (string, error) {
+	p.skipSpace()
+	if p.done() {
+		return "", p.errorf("expected )")
+	}
+
+	// Quoted expressions.
+	if c := p.expr[p.pos]; c == '"' || c == '`' {
+		quoted, err := strconv.QuotedPrefix(p.expr[p.pos:])
+		if err != nil {
+			return "", p.errorf("invalid quoted regular expression")
+		}
+		arg, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", p.errorf("invalid quoted regular expression")
+		}
+		p.pos += len(quoted)
+
+		p.skipSpace()
+		if p.done() || (p.expr[p.pos] != ',' && p.expr[p.pos] != ')') {
+			return "", p.errorf("expected , or ) after quoted regular expression")
+		}
+		return arg, nil
+	}
+
+	start := p.pos
+	depth, braces := 0, 0
+	class := false
+	for ; !p.done(); p.pos++ {
+		switch c := p.expr[p.pos]; {
+		case c == '\\':
+			// Skip the escaped character.
+			p.pos++
+		case class:
+			// Only an unescaped ] ends a character class. A ] at the start of the
+			// class is a literal, which is handled when the class opens.
+			if c == ']' {
+				class = false
+			}
+		case c == '[':
+			class = true
+			if strings.HasPrefix(p.expr[p.pos+1:], "^") {
+				p.pos++
+			}
+			if strings.HasPrefix(p.expr[p.pos+1:], "]") {
+				p.pos++
+			}
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == '{':
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		case c == ',' && braces > 0:
+			// A repetition such as {1,3}.
+		case (c == ')' || c == ',') && depth == 0:
+			return strings.TrimSpace(p.expr[start:p.pos]), nil
+		}
+	}
+	return "", p.errorf("expected )")
+}
+
+// keyword consumes the given keyword if it is next in the expression.
+func (p *filterParser) keyword(kw string) bool {
+	p.skipSpace()
+	start := p.pos
+	if p.word() == kw {
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// word consumes a run of lowercase letters.
+func (p *filterParser) word() string {
+	start := p.pos
+	for !p.done() && p.expr[p.pos] >= 'a' && p.expr[p.pos] <= 'z' {
+		p.pos++
+	}
+	return p.expr[start:p.pos]
+}
+
+// skipSpace consumes any whitespace.
+func (p *filterParser) skipSpace() {
+	for !p.done() && strings.ContainsRune(" \t\r\n", rune(p.expr[p.pos])) {
+		p.pos++
+	}
+}
+
+// done returns true if the entire expression was consumed.
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.expr)
+}
+
+// errorf returns an error at the current position.
+func (p *filterParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+// compilePatterns compiles the regular expressions into a single expression
+// that matches if any of them match.
+func compilePatterns(patterns []string) (*regexp.Regexp, error) {
+	parts := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		parts = append(parts, "(?:"+pattern+")")
+	}
+	return regexp.Compile(strings.Join(parts, "|"))
+}
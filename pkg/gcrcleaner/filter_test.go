@@ -181,3 +181,210 @@ func TestTagFilterAll_Matches(t *testing.T) {
 		})
 	}
 }
+
+func TestProtectedTag(t *testing.T) {
+	t.Parallel()
+
+	protected, err := BuildProtectedTags([]string{"^latest$", "^prod-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		tags    []string
+		expTag  string
+		expRule string
+	}{
+		{
+			name: "empty",
+			tags: nil,
+		},
+		{
+			name: "no_match",
+			tags: []string{"pr-1", "stable"},
+		},
+		{
+			name:    "match",
+			tags:    []string{"pr-1", "latest"},
+			expTag:  "latest",
+			expRule: "^latest$",
+		},
+		{
+			name:    "first_rule_wins",
+			tags:    []string{"prod-eu", "latest"},
+			expTag:  "latest",
+			expRule: "^latest$",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tag, re, ok := protectedTag(protected, tc.tags)
+			if got, want := ok, tc.expTag != ""; got != want {
+				t.Fatalf("expected %t to be %t", got, want)
+			}
+			if !ok {
+				return
+			}
+			if got, want := tag, tc.expTag; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+			if got, want := re.String(), tc.expRule; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+
+	if _, err := BuildProtectedTags([]string{"("}); err == nil {
+		t.Errorf("expected error for invalid expression")
+	}
+}
+
+func TestParseTagFilter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		expr    string
+		err     bool
+		expName string
+		match   [][]string
+		noMatch [][]string
+	}{
+		{
+			name:    "any",
+			expr:    "any(^pr-)",
+			expName: "any(^pr-)",
+			match:   [][]string{{"pr-1"}, {"pr-1", "latest"}},
+			noMatch: [][]string{nil, {"latest"}},
+		},
+		{
+			name:    "list",
+			expr:    "any( ^pr- ,^dev- )",
+			expName: "any(^pr-, ^dev-)",
+			match:   [][]string{{"pr-1"}, {"dev-2"}},
+			noMatch: [][]string{{"v1"}},
+		},
+		{
+			name:    "none",
+			expr:    "none(^v, ^latest$)",
+			expName: "none(^v, ^latest$)",
+			match:   [][]string{nil, {"pr-1"}},
+			noMatch: [][]string{{"pr-1", "latest"}},
+		},
+		{
+			name:    "and_not",
+			expr:    "any(^pr-) and not any(^release-)",
+			expName: "any(^pr-) and not any(^release-)",
+			match:   [][]string{{"pr-1"}},
+			noMatch: [][]string{{"pr-1", "release-1"}, {"latest"}},
+		},
+		{
+			name:    "precedence",
+			expr:    "all(^pr-) or any(^dev-) and not (any(^v) or any(^latest$))",
+			expName: "all(^pr-) or any(^dev-) and not (any(^v) or any(^latest$))",
+			match:   [][]string{{"pr-1", "pr-2"}, {"dev-1", "pr-1"}},
+			noMatch: [][]string{{"dev-1", "v1"}, {"pr-1", "latest"}},
+		},
+		{
+			name:    "grouped_or",
+			expr:    "(any(^pr-) or any(^dev-)) and all(-[0-9a-f]{7}$)",
+			expName: "(any(^pr-) or any(^dev-)) and all(-[0-9a-f]{7}$)",
+			match:   [][]string{{"pr-abcdef0"}},
+			noMatch: [][]string{{"pr-abcdef0", "latest"}},
+		},
+		{
+			name:    "regexp_syntax",
+			expr:    `any(^(a|b)-[,)]\)x{1,2}$, "^c,d$")`,
+			expName: `any(^(a|b)-[,)]\)x{1,2}$, ^c,d$)`,
+			match:   [][]string{{"a-,)x"}, {"b-))xx"}, {"c,d"}},
+			noMatch: [][]string{{"c-,)x"}},
+		},
+		{
+			name:    "older_than",
+			expr:    "(any(^pr-) or any(^dev-)) older than 720h and not any(^v)",
+			expName: "(any(^pr-) or any(^dev-)) older than 720h0m0s and not any(^v)",
+			match:   [][]string{{"dev-1"}},
+			noMatch: [][]string{{"dev-1", "v1"}},
+		},
+		{
+			name: "older_than_invalid",
+			expr: "any(^pr-) older than soon",
+			err:  true,
+		},
+		{
+			name: "empty",
+			expr: " ",
+			err:  true,
+		},
+		{
+			name: "unknown_function",
+			expr: "some(^pr-)",
+			err:  true,
+		},
+		{
+			name: "missing_paren",
+			expr: "any(^pr-",
+			err:  true,
+		},
+		{
+			name: "empty_regexp",
+			expr: "any(^pr-, )",
+			err:  true,
+		},
+		{
+			name: "invalid_regexp",
+			expr: "any([)",
+			err:  true,
+		},
+		{
+			name: "trailing",
+			expr: "any(^pr-) any(^dev-)",
+			err:  true,
+		},
+		{
+			name: "dangling_operator",
+			expr: "any(^pr-) and",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := ParseTagFilter(tc.expr)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+
+			if got, want := f.Name(), tc.expName; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+			for _, tags := range tc.match {
+				if !f.Matches(tags) {
+					t.Errorf("expected %q to match %q", f.Name(), tags)
+				}
+			}
+			for _, tags := range tc.noMatch {
+				if f.Matches(tags) {
+					t.Errorf("expected %q to not match %q", f.Name(), tags)
+				}
+			}
+		})
+	}
+
+	if _, err := BuildTagFilterExpr("any(^pr-)", "^dev-", ""); err == nil {
+		t.Errorf("expected error for multiple tag filter types")
+	}
+}
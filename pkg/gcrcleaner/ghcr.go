@@ -0,0 +1,421 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// GHCRHost is the registry host of the GitHub Container Registry.
+const GHCRHost = "ghcr.io"
+
+// defaultGitHubURL is the base URL of the GitHub REST API.
+const defaultGitHubURL = "https://api.github.com"
+
+// gitHubPageSize is the number of results to request per page.
+const gitHubPageSize = 100
+
+// gitHubNextLinkRe extracts the URL of the next page from a Link header.
+var gitHubNextLinkRe = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+var (
+	_ Registry        = (*GHCRRegistry)(nil)
+	_ BlobFetcher     = (*GHCRRegistry)(nil)
+	_ ReferrersLister = (*GHCRRegistry)(nil)
+	_ Untagger        = (*GHCRRegistry)(nil)
+)
+
+// GHCRConfig is the configuration for a GHCRRegistry.
+type GHCRConfig struct {
+	// URL is the base URL of the GitHub REST API. The default is
+	// https://api.github.com.
+	URL string
+
+	// Token is a GitHub token with the read:packages and delete:packages
+	// scopes. If empty, the token is resolved from the keychain for ghcr.io.
+	Token string
+
+	// Owners are the organizations or users searched by Catalog.
+	Owners []string
+}
+
+// GHCRRegistry is a Registry for the GitHub Container Registry. ghcr.io does
+// not support deleting manifests through the registry API, so images are
+// listed and deleted as package versions with the GitHub Packages API.
+// Manifests are still fetched using the registry API.
+//
+// A package version is a single manifest and all of its tags. The Packages API
+// cannot remove a tag from a version, so DeleteTag returns ErrUntagUnsupported
+// and the tags are removed when the version is deleted.
+type GHCRRegistry struct {
+	baseURL  string
+	owners   []string
+	keychain gcrauthn.Keychain
+	logger   *Logger
+
+	manifests   Registry
+	client      *http.Client
+	concurrency int64
+
+	lock     sync.Mutex
+	token    string
+	scopes   map[string]string
+	versions map[string]map[string]int64
+}
+
+// NewGHCRRegistry creates a new GitHub Container Registry. The manifests
+// registry is used to fetch manifests, usually a RemoteRegistry.
+func NewGHCRRegistry(cfg *GHCRConfig, keychain gcrauthn.Keychain, logger *Logger, concurrency int64, manifests Registry) (*GHCRRegistry, error) {
+	if cfg.Token == "" && keychain == nil {
+		return nil, fmt.Errorf("github token or keychain is required")
+	}
+
+	baseURL := cfg.URL
+	if baseURL == "" {
+		baseURL = defaultGitHubURL
+	}
+
+	return &GHCRRegistry{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		owners:   cfg.Owners,
+		keychain: keychain,
+		logger:   logger,
+
+		manifests:   manifests,
+		client:      &http.Client{Timeout: 60 * time.Second},
+		concurrency: concurrency,
+
+		token:    cfg.Token,
+		scopes:   make(map[string]string, 4),
+		versions: make(map[string]map[string]int64, 8),
+	}, nil
+}
+
+// gitHubPackageVersion is a package version as returned by the GitHub API.
+type gitHubPackageVersion struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Metadata  struct {
+		Container struct {
+			Tags []string `json:"tags"`
+		} `json:"container"`
+	} `json:"metadata"`
+}
+
+// ListManifests lists all versions of the container package. The created time
+// is when the version was first pushed and the uploaded time is when it was
+// last updated (for example, tagged). The Packages API does not report media
+// types, so each tagged manifest is fetched to find image indexes.
+func (r *GHCRRegistry) ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error) {
+	owner, pkg, err := ghcrPackage(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := r.scope(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/%s/packages/container/%s/versions?per_page=%d",
+		r.baseURL, scope, url.PathEscape(pkg), gitHubPageSize)
+
+	manifests := make(map[string]ManifestInfo, 8)
+	versions := make(map[string]int64, 8)
+	for u != "" {
+		var page []*gitHubPackageVersion
+		next, err := r.do(ctx, http.MethodGet, u, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list package versions: %w", err)
+		}
+
+		for _, v := range page {
+			tags := v.Metadata.Container.Tags
+			if len(tags) == 0 {
+				tags = nil
+			}
+			sort.Strings(tags)
+
+			manifests[v.Name] = ManifestInfo{
+				Created:  v.CreatedAt.UTC(),
+				Uploaded: v.UpdatedAt.UTC(),
+				Tags:     tags,
+			}
+			versions[v.Name] = v.ID
+		}
+		u = next
+	}
+
+	if err := r.resolveMediaTypes(ctx, repo, manifests); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.versions[repo.Name()] = versions
+	r.lock.Unlock()
+
+	return manifests, nil
+}
+
+// resolveMediaTypes fetches every tagged manifest and records its media type.
+// Untagged manifests are not fetched: they are either children of an image
+// index or are fetched later to find their subject.
+func (r *GHCRRegistry) resolveMediaTypes(ctx context.Context, repo gcrname.Repository, manifests map[string]ManifestInfo) error {
+	type mediaType struct {
+		digest    string
+		mediaType string
+	}
+
+	w := worker.New[*mediaType](r.concurrency)
+	for digest, info := range manifests {
+		digest := digest
+
+		if len(info.Tags) == 0 {
+			continue
+		}
+
+		if err := w.Do(ctx, func() (*mediaType, error) {
+			ref := repo.Digest(digest)
+			raw, err := r.manifests.FetchManifest(ctx, ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch manifest %s: %w", ref, err)
+			}
+			return &mediaType{digest: digest, mediaType: raw.MediaType}, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+
+		info := manifests[result.Value.digest]
+		info.MediaType = result.Value.mediaType
+		manifests[result.Value.digest] = info
+	}
+	return ErrsToError(errs)
+}
+
+// DeleteTag returns ErrUntagUnsupported. The Packages API cannot remove a
+// single tag, so tags are removed when their version is deleted by
+// DeleteDigest.
+func (r *GHCRRegistry) DeleteTag(_ context.Context, tag gcrname.Tag) error {
+	return fmt.Errorf("failed to delete tag %s: %w", tag, ErrUntagUnsupported)
+}
+
+// CanUntag returns false, since tags are removed with their package version.
+func (r *GHCRRegistry) CanUntag() bool {
+	return false
+}
+
+// DeleteDigest deletes the package version of the manifest.
+func (r *GHCRRegistry) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	repo := digest.Context()
+	owner, pkg, err := ghcrPackage(repo)
+	if err != nil {
+		return err
+	}
+
+	scope, err := r.scope(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.versionID(ctx, repo, digest.DigestStr())
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("%s/%s/packages/container/%s/versions/%d",
+		r.baseURL, scope, url.PathEscape(pkg), id)
+	if _, err := r.do(ctx, http.MethodDelete, u, nil); err != nil {
+		return fmt.Errorf("failed to delete package version: %w", err)
+	}
+	return nil
+}
+
+// Catalog lists all container packages of the configured owners.
+func (r *GHCRRegistry) Catalog(ctx context.Context, _ gcrname.Registry) ([]string, error) {
+	if len(r.owners) == 0 {
+		return nil, fmt.Errorf("listing %s repositories requires at least one owner", GHCRHost)
+	}
+
+	var repos []string
+	for _, owner := range r.owners {
+		scope, err := r.scope(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		u := fmt.Sprintf("%s/%s/packages?package_type=container&per_page=%d",
+			r.baseURL, scope, gitHubPageSize)
+		for u != "" {
+			var page []struct {
+				Name string `json:"name"`
+			}
+			next, err := r.do(ctx, http.MethodGet, u, &page)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list packages: %w", err)
+			}
+
+			for _, p := range page {
+				repos = append(repos, owner+"/"+p.Name)
+			}
+			u = next
+		}
+	}
+	return repos, nil
+}
+
+// FetchManifest fetches the manifest using the registry API.
+func (r *GHCRRegistry) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	return r.manifests.FetchManifest(ctx, ref)
+}
+
+// FetchBlob fetches the blob using the registry API.
+func (r *GHCRRegistry) FetchBlob(ctx context.Context, digest gcrname.Digest) ([]byte, error) {
+	return fetchBlob(ctx, r.manifests, digest)
+}
+
+// ListReferrers lists the referrers using the registry API.
+func (r *GHCRRegistry) ListReferrers(ctx context.Context, subject gcrname.Digest) ([]string, error) {
+	return listReferrers(ctx, r.manifests, subject)
+}
+
+// versionID returns the package version ID of the digest. IDs are cached by
+// ListManifests, but the versions are listed again on a miss.
+func (r *GHCRRegistry) versionID(ctx context.Context, repo gcrname.Repository, digest string) (int64, error) {
+	r.lock.Lock()
+	id, ok := r.versions[repo.Name()][digest]
+	r.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	if _, err := r.ListManifests(ctx, repo); err != nil {
+		return 0, err
+	}
+
+	r.lock.Lock()
+	id, ok = r.versions[repo.Name()][digest]
+	r.lock.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no package version found for %s", repo.Digest(digest))
+	}
+	return id, nil
+}
+
+// scope returns the API path prefix for the owner: "orgs/<owner>" for
+// organizations and "users/<owner>" for users.
+func (r *GHCRRegistry) scope(ctx context.Context, owner string) (string, error) {
+	r.lock.Lock()
+	scope, ok := r.scopes[owner]
+	r.lock.Unlock()
+	if ok {
+		return scope, nil
+	}
+
+	scope = "orgs/" + url.PathEscape(owner)
+	if _, err := r.do(ctx, http.MethodGet, r.baseURL+"/"+scope, nil); err != nil {
+		var aerr *apiError
+		if !errors.As(err, &aerr) || aerr.StatusCode != http.StatusNotFound {
+			return "", fmt.Errorf("failed to lookup owner %q: %w", owner, err)
+		}
+		scope = "users/" + url.PathEscape(owner)
+	}
+
+	r.lock.Lock()
+	r.scopes[owner] = scope
+	r.lock.Unlock()
+	return scope, nil
+}
+
+// do performs an authenticated request against the GitHub API and returns the
+// URL of the next page, if any.
+func (r *GHCRRegistry) do(ctx context.Context, method, u string, out any) (string, error) {
+	token, err := r.authToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := newJSONRequest(ctx, method, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	var next string
+	if err := doJSON(r.client, req, out, func(resp *http.Response) {
+		if m := gitHubNextLinkRe.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		}
+	}); err != nil {
+		return "", err
+	}
+	return next, nil
+}
+
+// authToken returns the configured token, or resolves one from the keychain.
+func (r *GHCRRegistry) authToken() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.token != "" {
+		return r.token, nil
+	}
+
+	token, err := keychainToken(r.keychain, GHCRHost)
+	if err != nil {
+		return "", err
+	}
+	r.token = token
+	return r.token, nil
+}
+
+// ghcrPackage splits the repository into the package owner and package name.
+// Nested repositories (ghcr.io/owner/a/b) are a single package named "a/b".
+func ghcrPackage(repo gcrname.Repository) (string, string, error) {
+	owner, pkg, ok := strings.Cut(repo.RepositoryStr(), "/")
+	if !ok {
+		return "", "", fmt.Errorf("invalid ghcr.io repository %q: must be owner/package", repo.RepositoryStr())
+	}
+	return owner, pkg, nil
+}
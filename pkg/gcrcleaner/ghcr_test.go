@@ -0,0 +1,170 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/bearerkeychain"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestGHCRRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+
+	var lock sync.Mutex
+	var deleted []string
+
+	mux := http.NewServeMux()
+	authed := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if got, want := r.Header.Get("Authorization"), "Bearer ghp_token"; got != want {
+				http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux.HandleFunc("/orgs/acme", authed(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"login":"acme"}`)
+	}))
+	mux.HandleFunc("/orgs/octocat", authed(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}))
+
+	// Versions are served across two pages to exercise pagination.
+	mux.HandleFunc("/orgs/acme/packages/container/tools%2Fapp/versions", authed(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s?page=2>; rel="next", <http://%s%s?page=2>; rel="last"`,
+				r.Host, r.URL.EscapedPath(), r.Host, r.URL.EscapedPath()))
+			fmt.Fprintf(w, `[
+				{"id":1,"name":%q,"created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-02T00:00:00Z","metadata":{"container":{"tags":["v1","latest"]}}},
+				{"id":2,"name":%q,"created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z","metadata":{"container":{"tags":[]}}}
+			]`, aa, bb)
+			return
+		}
+		fmt.Fprintf(w, `[
+			{"id":3,"name":%q,"created_at":"2023-12-01T00:00:00Z","updated_at":"2023-12-01T00:00:00Z","metadata":{"container":{"tags":["v0"]}}}
+		]`, cc)
+	}))
+	mux.HandleFunc("/orgs/acme/packages/container/tools%2Fapp/versions/", authed(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		lock.Lock()
+		deleted = append(deleted, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("/orgs/acme/packages", authed(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Query().Get("package_type"), "container"; got != want {
+			http.Error(w, "bad package type", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `[{"name":"tools/app"},{"name":"web"}]`)
+	}))
+	mux.HandleFunc("/users/octocat/packages", authed(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"name":"dotfiles"}]`)
+	}))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	manifests := &fakeRegistry{
+		raw: map[string]*RawManifest{
+			aa: {Digest: aa, MediaType: "application/vnd.oci.image.index.v1+json"},
+			cc: {Digest: cc, MediaType: "application/vnd.oci.image.manifest.v1+json"},
+		},
+	}
+
+	// The token comes from the keychain, like -token or GCRCLEANER_TOKEN.
+	registry, err := NewGHCRRegistry(&GHCRConfig{
+		URL:    server.URL,
+		Owners: []string{"acme", "octocat"},
+	}, bearerkeychain.New("ghp_token"), NewLogger("error", io.Discard, io.Discard), 2, manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := gcrname.NewRepository("ghcr.io/acme/tools/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := registry.ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]ManifestInfo{
+		aa: {
+			MediaType: "application/vnd.oci.image.index.v1+json",
+			Created:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Uploaded:  time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Tags:      []string{"latest", "v1"},
+		},
+		bb: {
+			Created:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Uploaded: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		cc: {
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Created:   time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC),
+			Uploaded:  time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC),
+			Tags:      []string{"v0"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %#v to be %#v", got, want)
+	}
+
+	if err := registry.DeleteTag(ctx, repo.Tag("v0")); !errors.Is(err, ErrUntagUnsupported) {
+		t.Errorf("expected %v to be %v", err, ErrUntagUnsupported)
+	}
+	if err := registry.DeleteDigest(ctx, repo.Digest(cc)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := deleted, []string{"3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	repos, err := registry.Catalog(ctx, repo.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repos, []string{"acme/tools/app", "acme/web", "octocat/dotfiles"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
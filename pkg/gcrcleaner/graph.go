@@ -0,0 +1,498 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// cosignTagRe matches the tags cosign uses for signatures, attestations, and
+// SBOMs, as well as the OCI referrers fallback tag schema. The first capture
+// group is the hex-encoded digest of the subject.
+var cosignTagRe = regexp.MustCompile(`^sha256-([a-f0-9]{64})(\.(sig|att|sbom))?$`)
+
+// manifestGraph is the set of relationships between the manifests in a
+// repository: image indexes (manifest lists) and the manifests they reference,
+// and supporting artifacts (signatures, attestations, SBOMs, and OCI referrers)
+// and the subject they describe.
+type manifestGraph struct {
+	children map[string][]string
+	parents  map[string][]string
+
+	subjects  map[string]string
+	referrers map[string][]string
+
+	// unreadable are the manifests that could not be fetched to find their
+	// subject. They are kept.
+	unreadable map[string]struct{}
+}
+
+// newManifestGraph creates an empty graph.
+func newManifestGraph() *manifestGraph {
+	return &manifestGraph{
+		children:   make(map[string][]string),
+		parents:    make(map[string][]string),
+		subjects:   make(map[string]string),
+		referrers:  make(map[string][]string),
+		unreadable: make(map[string]struct{}),
+	}
+}
+
+// addEdge records that parent references child.
+func (g *manifestGraph) addEdge(parent, child string) {
+	g.children[parent] = append(g.children[parent], child)
+	g.parents[child] = append(g.parents[child], parent)
+}
+
+// addSubject records that artifact is a supporting artifact of subject.
+func (g *manifestGraph) addSubject(artifact, subject string) {
+	g.subjects[artifact] = subject
+	g.referrers[subject] = append(g.referrers[subject], artifact)
+}
+
+// isChild returns true if the manifest is an untagged child of an image index.
+// Children are not independent images.
+func (g *manifestGraph) isChild(m *manifest) bool {
+	return len(m.Info.Tags) == 0 && len(g.parents[m.Digest]) > 0
+}
+
+// isArtifact returns true if the manifest is a supporting artifact of another
+// manifest.
+func (g *manifestGraph) isArtifact(m *manifest) bool {
+	_, ok := g.subjects[m.Digest]
+	return ok
+}
+
+// before returns the digests that must be deleted before the given digest:
+// the image indexes that reference it and the artifacts that describe it.
+func (g *manifestGraph) before(d string) []string {
+	out := make([]string, 0, len(g.parents[d])+len(g.referrers[d]))
+	out = append(out, g.parents[d]...)
+	out = append(out, g.referrers[d]...)
+	return out
+}
+
+// after returns the digests that must be deleted after the given digest.
+func (g *manifestGraph) after(d string) []string {
+	out := make([]string, 0, len(g.children[d])+1)
+	out = append(out, g.children[d]...)
+	if s, ok := g.subjects[d]; ok {
+		out = append(out, s)
+	}
+	return out
+}
+
+// descendants returns the set of digests transitively referenced by the given
+// digests, including the digests themselves.
+func (g *manifestGraph) descendants(digests []string) map[string]struct{} {
+	seen := make(map[string]struct{}, len(digests))
+	queue := append([]string(nil), digests...)
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+
+		if _, ok := seen[d]; ok {
+			continue
+		}
+		seen[d] = struct{}{}
+		queue = append(queue, g.children[d]...)
+	}
+	return seen
+}
+
+// deletionOrder sorts the given digests into layers such that every parent is
+// in an earlier layer than all of its children, and every artifact is in an
+// earlier layer than its subject. Only edges where both ends are in digests are
+// considered. Digests in the same layer can be deleted concurrently.
+func (g *manifestGraph) deletionOrder(digests []string) [][]string {
+	pending := make(map[string]int, len(digests))
+	for _, d := range digests {
+		pending[d] = 0
+	}
+	for d := range pending {
+		for _, prev := range g.before(d) {
+			if _, ok := pending[prev]; ok {
+				pending[d]++
+			}
+		}
+	}
+
+	layers := make([][]string, 0, 2)
+	for len(pending) > 0 {
+		var layer []string
+		for d, count := range pending {
+			if count == 0 {
+				layer = append(layer, d)
+			}
+		}
+
+		// Registries are content-addressed, so a cycle should be impossible. If
+		// the data is somehow inconsistent, put everything that is left into a
+		// final layer rather than looping forever.
+		if len(layer) == 0 {
+			for d := range pending {
+				layer = append(layer, d)
+			}
+		}
+
+		sort.Strings(layer)
+		for _, d := range layer {
+			delete(pending, d)
+		}
+		for _, d := range layer {
+			for _, next := range g.after(d) {
+				if _, ok := pending[next]; ok {
+					pending[next]--
+				}
+			}
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// buildGraph fetches every image index in the list of manifests and records
+// the digests of the manifests it references. Manifests without a media type
+// are fetched too, since some registries do not report it, and their media
+// type is filled in.
+func (c *Cleaner) buildGraph(ctx context.Context, gcrrepo gcrname.Repository, manifests []*manifest) (*manifestGraph, error) {
+	type edges struct {
+		parent   string
+		children []string
+	}
+
+	w := worker.New[*edges](c.concurrency)
+	for _, m := range manifests {
+		m := m
+
+		unknown := m.Info.MediaType == ""
+		if !unknown && !gcrtypes.MediaType(m.Info.MediaType).IsIndex() {
+			continue
+		}
+
+		if err := w.Do(ctx, func() (*edges, error) {
+			c.logger.Debug("fetching image index",
+				"repo", gcrrepo.Name(),
+				"digest", m.Digest,
+				"unknown_media_type", unknown)
+
+			ref := gcrrepo.Digest(m.Digest)
+			raw, err := c.registry.FetchManifest(ctx, ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch image index %s: %w", ref, err)
+			}
+
+			if unknown {
+				mediaType := rawMediaType(raw)
+				m.Info.MediaType = string(mediaType)
+				if !mediaType.IsIndex() {
+					return nil, nil
+				}
+			}
+
+			im, err := gcrv1.ParseIndexManifest(bytes.NewReader(raw.Body))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse image index %s: %w", ref, err)
+			}
+
+			e := &edges{parent: m.Digest}
+			for _, desc := range im.Manifests {
+				e.children = append(e.children, desc.Digest.String())
+			}
+			return e, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	g := newManifestGraph()
+	errs := make([]error, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+
+		if result.Value == nil {
+			continue
+		}
+		for _, child := range result.Value.children {
+			g.addEdge(result.Value.parent, child)
+		}
+	}
+
+	if err := ErrsToError(errs); err != nil {
+		return nil, err
+	}
+
+	findSubjects(manifests, g)
+	return g, nil
+}
+
+// rawMediaType returns the media type of the raw manifest. If the registry did
+// not report it, it is read from the body. Image indexes and manifests without
+// a mediaType field are told apart by their "manifests" field.
+func rawMediaType(raw *RawManifest) gcrtypes.MediaType {
+	if raw.MediaType != "" {
+		return gcrtypes.MediaType(raw.MediaType)
+	}
+
+	var body struct {
+		MediaType gcrtypes.MediaType `json:"mediaType"`
+		Manifests json.RawMessage    `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw.Body, &body); err != nil {
+		return ""
+	}
+	switch {
+	case body.MediaType != "":
+		return body.MediaType
+	case body.Manifests != nil:
+		return gcrtypes.OCIImageIndex
+	default:
+		return gcrtypes.OCIManifestSchema1
+	}
+}
+
+// findSubjects records the subject of every cosign artifact and OCI referrers
+// fallback index in the list of manifests, which are identified by their tags.
+// Untagged referrers are found by findReferrers.
+func findSubjects(manifests []*manifest, g *manifestGraph) {
+	for _, m := range manifests {
+		if subject := cosignSubject(m.Info.Tags); subject != "" {
+			g.addSubject(m.Digest, subject)
+		}
+	}
+}
+
+// findReferrers records the subject of the untagged referrers that the policy
+// would otherwise delete as untagged images. Referrers pushed to registries
+// that implement the OCI referrers API are untagged, so they are listed with
+// the API. If the registry does not support it, only the candidates (untagged
+// manifests outside the grace period) are fetched and their "subject" field is
+// inspected. Candidates that cannot be read are marked unreadable and kept.
+// Nothing is requested if there are no candidates.
+func (c *Cleaner) findReferrers(ctx context.Context, gcrrepo gcrname.Repository, manifests []*manifest, g *manifestGraph, now time.Time, policy *Policy) error {
+	since, _ := policy.sinceFor(now, nil)
+
+	candidates := make(map[string]*manifest, len(manifests))
+	for _, m := range manifests {
+		if len(m.Info.Tags) > 0 || g.isChild(m) || g.isArtifact(m) || m.InUse != "" {
+			continue
+		}
+		if uploaded := m.uploaded(); uploaded.After(since) || policy.tooOld(uploaded) || policy.unknownTooNew(uploaded, since, now) {
+			continue
+		}
+		candidates[m.Digest] = m
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if lister, ok := referrersListerFor(c.registry, gcrrepo); ok {
+		err := c.listReferrers(ctx, gcrrepo, lister, manifests, g)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrReferrersUnsupported) {
+			c.logger.Warn("failed to list referrers, fetching manifests instead",
+				"repo", gcrrepo.Name(),
+				"error", err)
+		}
+	}
+
+	return c.probeSubjects(ctx, gcrrepo, candidates, g)
+}
+
+// listReferrers lists the referrers of every manifest that is not an artifact
+// and records the subject of the untagged manifests among them. Candidates are
+// included, since keep or a bucket can still keep them. The first manifest is
+// listed on its own, so that registries without the API cost one request.
+func (c *Cleaner) listReferrers(ctx context.Context, gcrrepo gcrname.Repository, lister ReferrersLister, manifests []*manifest, g *manifestGraph) error {
+	type referrers struct {
+		subject string
+		digests []string
+	}
+
+	untagged := make(map[string]struct{}, len(manifests))
+	subjects := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		if g.isArtifact(m) {
+			continue
+		}
+		subjects = append(subjects, m.Digest)
+		if len(m.Info.Tags) == 0 && !g.isChild(m) {
+			untagged[m.Digest] = struct{}{}
+		}
+	}
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	list := func(subject string) (*referrers, error) {
+		c.logger.Debug("listing referrers",
+			"repo", gcrrepo.Name(),
+			"digest", subject)
+
+		digests, err := lister.ListReferrers(ctx, gcrrepo.Digest(subject))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list referrers of %s: %w", subject, err)
+		}
+		return &referrers{subject: subject, digests: digests}, nil
+	}
+
+	first, err := list(subjects[0])
+	if err != nil {
+		return err
+	}
+
+	w := worker.New[*referrers](c.concurrency)
+	for _, subject := range subjects[1:] {
+		subject := subject
+
+		if err := w.Do(ctx, func() (*referrers, error) {
+			return list(subject)
+		}); err != nil {
+			return err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return err
+	}
+
+	all := []*referrers{first}
+	errs := make([]error, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+		all = append(all, result.Value)
+	}
+	if err := ErrsToError(errs); err != nil {
+		return err
+	}
+
+	for _, r := range all {
+		for _, d := range r.digests {
+			if _, ok := untagged[d]; ok {
+				g.addSubject(d, r.subject)
+			}
+		}
+	}
+	return nil
+}
+
+// probeSubjects fetches each candidate and records its subject, if any.
+// Candidates that cannot be fetched or parsed are logged and marked unreadable,
+// since they could be the referrers of an image that is kept.
+func (c *Cleaner) probeSubjects(ctx context.Context, gcrrepo gcrname.Repository, candidates map[string]*manifest, g *manifestGraph) error {
+	type probe struct {
+		digest  string
+		subject string
+		err     error
+	}
+
+	w := worker.New[*probe](c.concurrency)
+	for _, m := range candidates {
+		m := m
+
+		if g.isArtifact(m) {
+			continue
+		}
+
+		if err := w.Do(ctx, func() (*probe, error) {
+			ref := gcrrepo.Digest(m.Digest)
+			raw, err := c.registry.FetchManifest(ctx, ref)
+			if err != nil {
+				return &probe{digest: m.Digest, err: fmt.Errorf("failed to fetch manifest: %w", err)}, nil
+			}
+
+			var body struct {
+				Subject *gcrv1.Descriptor `json:"subject"`
+			}
+			if err := json.Unmarshal(raw.Body, &body); err != nil {
+				return &probe{digest: m.Digest, err: fmt.Errorf("failed to parse manifest: %w", err)}, nil
+			}
+
+			p := &probe{digest: m.Digest}
+			if body.Subject != nil {
+				p.subject = body.Subject.Digest.String()
+			}
+			return p, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		p := result.Value
+		switch {
+		case p.err != nil:
+			c.logger.Warn("failed to read manifest, keeping it",
+				"repo", gcrrepo.Name(),
+				"digest", p.digest,
+				"error", p.err)
+			g.unreadable[p.digest] = struct{}{}
+		case p.subject != "":
+			g.addSubject(p.digest, p.subject)
+		}
+	}
+	return nil
+}
+
+// cosignSubject returns the subject digest if every tag refers to the same
+// subject using the cosign or referrers fallback tag schema. Otherwise it
+// returns the empty string, since the manifest is also a regular image.
+func cosignSubject(tags []string) string {
+	var subject string
+	for _, t := range tags {
+		matches := cosignTagRe.FindStringSubmatch(t)
+		if matches == nil {
+			return ""
+		}
+
+		s := "sha256:" + matches[1]
+		if subject != "" && subject != s {
+			return ""
+		}
+		subject = s
+	}
+	return subject
+}
@@ -0,0 +1,396 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestManifestGraph_DeletionOrder(t *testing.T) {
+	t.Parallel()
+
+	// index -> (amd64, arm64), nested -> index, other -> arm64
+	g := newManifestGraph()
+	g.addEdge("index", "amd64")
+	g.addEdge("index", "arm64")
+	g.addEdge("nested", "index")
+	g.addEdge("other", "arm64")
+	g.addSubject("sig", "index")
+
+	cases := []struct {
+		name    string
+		digests []string
+		exp     [][]string
+	}{
+		{
+			name:    "empty",
+			digests: nil,
+			exp:     [][]string{},
+		},
+		{
+			name:    "unrelated",
+			digests: []string{"b", "a"},
+			exp:     [][]string{{"a", "b"}},
+		},
+		{
+			name:    "index_and_children",
+			digests: []string{"arm64", "amd64", "index"},
+			exp:     [][]string{{"index"}, {"amd64", "arm64"}},
+		},
+		{
+			name:    "nested",
+			digests: []string{"arm64", "amd64", "index", "nested"},
+			exp:     [][]string{{"nested"}, {"index"}, {"amd64", "arm64"}},
+		},
+		{
+			name:    "multiple_parents",
+			digests: []string{"arm64", "index", "other"},
+			exp:     [][]string{{"index", "other"}, {"arm64"}},
+		},
+		{
+			name:    "artifacts_before_subject",
+			digests: []string{"sig", "index", "arm64"},
+			exp:     [][]string{{"sig"}, {"index"}, {"arm64"}},
+		},
+		{
+			name:    "parent_not_deleted",
+			digests: []string{"arm64", "amd64"},
+			exp:     [][]string{{"amd64", "arm64"}},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := g.deletionOrder(tc.digests), tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCosignSubject(t *testing.T) {
+	t.Parallel()
+
+	hex := "4d4f0b2f0f3b54e1a3a30ab6a7b2c5a4d4f0b2f0f3b54e1a3a30ab6a7b2c5a41"
+
+	cases := []struct {
+		name string
+		tags []string
+		exp  string
+	}{
+		{
+			name: "empty",
+			tags: nil,
+			exp:  "",
+		},
+		{
+			name: "regular",
+			tags: []string{"latest"},
+			exp:  "",
+		},
+		{
+			name: "signature",
+			tags: []string{"sha256-" + hex + ".sig"},
+			exp:  "sha256:" + hex,
+		},
+		{
+			name: "attestation_and_sbom",
+			tags: []string{"sha256-" + hex + ".att", "sha256-" + hex + ".sbom"},
+			exp:  "sha256:" + hex,
+		},
+		{
+			name: "referrers_fallback",
+			tags: []string{"sha256-" + hex},
+			exp:  "sha256:" + hex,
+		},
+		{
+			name: "mixed",
+			tags: []string{"sha256-" + hex + ".sig", "latest"},
+			exp:  "",
+		},
+		{
+			name: "different_subjects",
+			tags: []string{"sha256-" + hex + ".sig", "sha256-" + strings.Repeat("a", 64) + ".sig"},
+			exp:  "",
+		},
+		{
+			name: "unknown_suffix",
+			tags: []string{"sha256-" + hex + ".foo"},
+			exp:  "",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := cosignSubject(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRawMediaType(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		raw  *RawManifest
+		exp  gcrtypes.MediaType
+	}{
+		{
+			name: "reported",
+			raw:  &RawManifest{MediaType: string(gcrtypes.DockerManifestList), Body: []byte(`{}`)},
+			exp:  gcrtypes.DockerManifestList,
+		},
+		{
+			name: "body",
+			raw:  &RawManifest{Body: []byte(`{"mediaType":"application/vnd.oci.image.index.v1+json"}`)},
+			exp:  gcrtypes.OCIImageIndex,
+		},
+		{
+			name: "index_without_media_type",
+			raw:  &RawManifest{Body: []byte(`{"schemaVersion":2,"manifests":[]}`)},
+			exp:  gcrtypes.OCIImageIndex,
+		},
+		{
+			name: "manifest_without_media_type",
+			raw:  &RawManifest{Body: []byte(`{"schemaVersion":2,"layers":[]}`)},
+			exp:  gcrtypes.OCIManifestSchema1,
+		},
+		{
+			name: "invalid",
+			raw:  &RawManifest{Body: []byte(`{`)},
+			exp:  "",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := rawMediaType(tc.raw), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCleaner_CleanWithResult_UnknownMediaType(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	index := "sha256:" + strings.Repeat("a", 64)
+	child := "sha256:" + strings.Repeat("b", 64)
+	other := "sha256:" + strings.Repeat("c", 64)
+
+	// The registry does not report media types, as some distribution
+	// registries do not.
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			index: {Created: old, Uploaded: old, Tags: []string{"latest"}},
+			child: {Created: old, Uploaded: old},
+			other: {Created: old, Uploaded: old},
+		},
+		raw: map[string]*RawManifest{
+			index: {
+				Digest: index,
+				Body:   []byte(`{"schemaVersion":2,"manifests":[{"digest":"` + child + `","size":2}]}`),
+			},
+			child: {Digest: child, Body: []byte(`{"schemaVersion":2,"layers":[]}`)},
+			other: {Digest: other, Body: []byte(`{"schemaVersion":2,"layers":[]}`)},
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(result.Deleted))
+	for _, ref := range result.Deleted {
+		got = append(got, ref.Digest)
+	}
+	if want := []string{other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+// referrersRegistry is a fakeRegistry that supports the referrers API.
+type referrersRegistry struct {
+	*fakeRegistry
+
+	referrers map[string][]string
+	err       error
+}
+
+func (r *referrersRegistry) ListReferrers(_ context.Context, subject gcrname.Digest) ([]string, error) {
+	return r.referrers[subject.DigestStr()], r.err
+}
+
+func TestCleaner_FindReferrers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	old := now.Add(-48 * time.Hour)
+	image := "sha256:" + strings.Repeat("a", 64)
+	sig := "sha256:" + strings.Repeat("b", 64)
+	loose := "sha256:" + strings.Repeat("c", 64)
+	recent := "sha256:" + strings.Repeat("d", 64)
+	broken := "sha256:" + strings.Repeat("e", 64)
+
+	gcrrepo, err := gcrname.NewRepository("registry.example/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newManifests := func() []*manifest {
+		newManifest := func(digest string, uploaded time.Time, tags ...string) *manifest {
+			return &manifest{
+				Repo:   gcrrepo.Name(),
+				Digest: digest,
+				Info:   ManifestInfo{Created: uploaded, Uploaded: uploaded, Tags: tags},
+			}
+		}
+		return []*manifest{
+			newManifest(image, old, "latest"),
+			newManifest(sig, old),
+			newManifest(loose, old),
+			newManifest(recent, now),
+			newManifest(broken, old),
+		}
+	}
+
+	newRegistry := func() *fakeRegistry {
+		return &fakeRegistry{
+			raw: map[string]*RawManifest{
+				sig: {
+					Digest: sig,
+					Body:   []byte(`{"schemaVersion":2,"subject":{"digest":"` + image + `","size":2}}`),
+				},
+				loose: {Digest: loose, Body: []byte(`{"schemaVersion":2}`)},
+			},
+		}
+	}
+
+	policy := &Policy{Grace: time.Hour}
+
+	t.Run("probe", func(t *testing.T) {
+		t.Parallel()
+
+		registry := newRegistry()
+		c := newTestCleaner(t, WithRegistry(registry))
+
+		g := newManifestGraph()
+		if err := c.findReferrers(ctx, gcrrepo, newManifests(), g, now, policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := g.subjects, map[string]string{sig: image}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+
+		// The broken manifest cannot be fetched, so it is kept.
+		if got, want := g.unreadable, map[string]struct{}{broken: {}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+
+		// Only the untagged manifests outside the grace period are fetched.
+		got := append([]string(nil), registry.fetched...)
+		sort.Strings(got)
+		if want := []string{sig, loose, broken}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	})
+
+	t.Run("referrers_api", func(t *testing.T) {
+		t.Parallel()
+
+		registry := newRegistry()
+		c := newTestCleaner(t, WithRegistry(&referrersRegistry{
+			fakeRegistry: registry,
+			referrers:    map[string][]string{image: {sig}},
+		}))
+
+		g := newManifestGraph()
+		if err := c.findReferrers(ctx, gcrrepo, newManifests(), g, now, policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := g.subjects, map[string]string{sig: image}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+		if got := registry.fetched; len(got) != 0 {
+			t.Errorf("expected no manifests to be fetched, got %q", got)
+		}
+	})
+
+	t.Run("referrers_api_unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		registry := newRegistry()
+		c := newTestCleaner(t, WithRegistry(&referrersRegistry{
+			fakeRegistry: registry,
+			err:          ErrReferrersUnsupported,
+		}))
+
+		g := newManifestGraph()
+		if err := c.findReferrers(ctx, gcrrepo, newManifests(), g, now, policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := g.subjects, map[string]string{sig: image}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	})
+
+	t.Run("no_candidates", func(t *testing.T) {
+		t.Parallel()
+
+		registry := newRegistry()
+		c := newTestCleaner(t, WithRegistry(registry))
+
+		g := newManifestGraph()
+		if err := c.findReferrers(ctx, gcrrepo, newManifests(), g, now, &Policy{Grace: 72 * time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if got := registry.fetched; len(got) != 0 {
+			t.Errorf("expected no manifests to be fetched, got %q", got)
+		}
+	})
+}
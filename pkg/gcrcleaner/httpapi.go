@@ -0,0 +1,137 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// maxErrorBodySize is the maximum number of bytes of an error response body to
+// include in an error message.
+const maxErrorBodySize = 4096
+
+// apiError is an unexpected response from a registry's HTTP API.
+type apiError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %d: %s",
+		e.Method, e.URL, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Temporary returns true if the request may succeed if retried.
+func (e *apiError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newJSONRequest builds a request with the given body encoded as JSON. If body
+// is nil, the request has no body.
+func newJSONRequest(ctx context.Context, method, u string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set("Accept", contentTypeJSON)
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		req.Header.Set(contentTypeHeader, contentTypeJSON)
+	}
+	return req, nil
+}
+
+// doJSON executes the request and decodes the JSON response into out, if out
+// is not nil. Any status code outside of 2xx is returned as an *apiError. The
+// inspect functions are called with every successful response, for example to
+// read pagination headers.
+func doJSON(client *http.Client, req *http.Request, out any, inspect ...func(*http.Response)) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &apiError{
+			Method:     req.Method,
+			URL:        req.URL.Redacted(),
+			StatusCode: resp.StatusCode,
+			Body:       string(b),
+		}
+	}
+
+	for _, fn := range inspect {
+		fn(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: failed to decode response: %w", req.Method, req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// keychainToken resolves the credentials for the registry host from the
+// keychain and returns the token to use with the registry's HTTP API: the
+// registry token (bearer), or else the password.
+func keychainToken(keychain gcrauthn.Keychain, host string) (string, error) {
+	registry, err := gcrname.NewRegistry(host)
+	if err != nil {
+		return "", err
+	}
+
+	authenticator, err := keychain.Resolve(registry)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve credentials for %s: %w", host, err)
+	}
+
+	cfg, err := authenticator.Authorization()
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials for %s: %w", host, err)
+	}
+
+	switch {
+	case cfg.RegistryToken != "":
+		return cfg.RegistryToken, nil
+	case cfg.Password != "":
+		return cfg.Password, nil
+	default:
+		return "", fmt.Errorf("no credentials found for %s", host)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// InUseLister lists the images that are in use, such as the images of running
+// workloads. Images in use are never deleted.
+type InUseLister interface {
+	// ListInUse returns the images in use. It is called once per run by
+	// Cleaner.ListInUse.
+	ListInUse(ctx context.Context) ([]*InUseImage, error)
+}
+
+// InUseImage is an image that is in use.
+type InUseImage struct {
+	// Ref is the tag or digest reference to the image.
+	Ref gcrname.Reference
+
+	// User describes what uses the image, such as "Deployment default/web in
+	// prod".
+	User string
+}
+
+// WithInUseLister configures the cleaner to keep the images that the lister
+// reports as in use.
+func WithInUseLister(lister InUseLister) CleanerOption {
+	return func(c *Cleaner) {
+		c.inUse = lister
+	}
+}
+
+// ListInUse lists the images in use once for a run over several repositories.
+// Pass them to each CleanWithResult of the run with WithInUseImages, so every
+// repository is cleaned against the same images. It returns nil if the cleaner
+// has no in-use lister.
+func (c *Cleaner) ListInUse(ctx context.Context) ([]*InUseImage, error) {
+	if c.inUse == nil {
+		return nil, nil
+	}
+
+	images, err := c.inUse.ListInUse(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images in use: %w", err)
+	}
+	return images, nil
+}
+
+// WithInUseImages gives the clean the images in use of the run, as listed by
+// Cleaner.ListInUse.
+func WithInUseImages(images []*InUseImage) CleanOption {
+	return func(o *cleanOptions) {
+		o.inUse = images
+		o.inUseListed = true
+	}
+}
+
+// markInUse sets InUse on the manifests of the repository that are in use.
+// Tags are resolved to digests with the tags in the repository, so an image
+// that is still used by a tag that has since moved is only kept if it is also
+// used by digest, such as by a running pod.
+func markInUse(gcrrepo gcrname.Repository, manifests []*manifest, images []*InUseImage) {
+	byDigest := make(map[string]*manifest, len(manifests))
+	byTag := make(map[string]*manifest, len(manifests))
+	for _, m := range manifests {
+		byDigest[m.Digest] = m
+		for _, tag := range m.Info.Tags {
+			byTag[tag] = m
+		}
+	}
+
+	for _, image := range images {
+		if image.Ref.Context().Name() != gcrrepo.Name() {
+			continue
+		}
+
+		var m *manifest
+		switch ref := image.Ref.(type) {
+		case gcrname.Digest:
+			m = byDigest[ref.DigestStr()]
+		case gcrname.Tag:
+			m = byTag[ref.TagStr()]
+		}
+		if m != nil && m.InUse == "" {
+			m.InUse = image.User
+		}
+	}
+}
+
+// parseImageRef parses an image reference from a workload, such as
+// "nginx:1.27", or the image ID of a running container, such as
+// "docker-pullable://gcr.io/p/r@sha256:...". Image IDs without a repository,
+// such as "sha256:...", are local to the node and return an error.
+func parseImageRef(s string) (gcrname.Reference, error) {
+	if _, after, ok := strings.Cut(s, "://"); ok {
+		s = after
+	}
+	if strings.HasPrefix(s, "sha256:") {
+		return nil, fmt.Errorf("image %q has no repository", s)
+	}
+
+	ref, err := gcrname.ParseReference(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image %q: %w", s, err)
+	}
+	return ref, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+type staticInUseLister struct {
+	images []*InUseImage
+	err    error
+	calls  atomic.Int64
+}
+
+func (l *staticInUseLister) ListInUse(_ context.Context) ([]*InUseImage, error) {
+	l.calls.Add(1)
+	return l.images, l.err
+}
+
+func TestCleaner_CleanWithResult_InUse(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+	dd := "sha256:" + strings.Repeat("d", 64)
+
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	newRegistry := func() *fakeRegistry {
+		registry := &fakeRegistry{
+			manifests: map[string]ManifestInfo{
+				aa: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"v1"}},
+				bb: {MediaType: mediaType, Created: old, Uploaded: old},
+				cc: {MediaType: mediaType, Created: old, Uploaded: old},
+				dd: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"v2"}},
+			},
+			raw: make(map[string]*RawManifest),
+		}
+		for digest := range registry.manifests {
+			registry.raw[digest] = &RawManifest{
+				Digest:    digest,
+				MediaType: mediaType,
+				Body:      []byte(`{"schemaVersion":2}`),
+			}
+		}
+		return registry
+	}
+
+	mustRef := func(s string) gcrname.Reference {
+		ref, err := gcrname.ParseReference(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+
+	lister := &staticInUseLister{
+		images: []*InUseImage{
+			{Ref: mustRef("registry.example/a/b:v1"), User: "Deployment default/web in prod"},
+			{Ref: mustRef("registry.example/a/b@" + bb), User: "Pod default/web-1 in prod"},
+			{Ref: mustRef("registry.example/a/other@" + cc), User: "Pod default/other in prod"},
+			{Ref: mustRef("registry.example/a/b:v3"), User: "Job default/missing in prod"},
+		},
+	}
+
+	policy := &Policy{
+		TagFilter: &TagFilterAny{re: regexp.MustCompile("^v")},
+		DryRun:    true,
+	}
+
+	t.Run("kept", func(t *testing.T) {
+		t.Parallel()
+
+		c := newTestCleaner(t, WithRegistry(newRegistry()), WithInUseLister(lister))
+
+		images, err := c.ListInUse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.CleanWithResult(ctx, "registry.example/a/b", policy, WithInUseImages(images))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]string, 0, len(result.Deleted))
+		for _, ref := range result.Deleted {
+			got = append(got, ref.Digest)
+		}
+		if want := []string{cc, dd, dd}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+
+		gotKept := make(map[string]string, len(result.Kept))
+		for _, ref := range result.Kept {
+			gotKept[ref.Digest] = ref.InUse
+		}
+		wantKept := map[string]string{
+			aa: "Deployment default/web in prod",
+			bb: "Pod default/web-1 in prod",
+		}
+		if !reflect.DeepEqual(gotKept, wantKept) {
+			t.Errorf("expected %q to be %q", gotKept, wantKept)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		c := newTestCleaner(t, WithRegistry(newRegistry()),
+			WithInUseLister(&staticInUseLister{err: fmt.Errorf("cluster unreachable")}))
+
+		if _, err := c.CleanPolicy(ctx, "registry.example/a/b", policy); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestCleaner_ListInUse(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: old, Uploaded: old},
+		},
+		raw: map[string]*RawManifest{
+			aa: {Digest: aa, MediaType: mediaType, Body: []byte(`{"schemaVersion":2}`)},
+		},
+	}
+	repos := []string{"registry.example/a/b", "registry.example/a/c", "registry.example/a/d"}
+	policy := &Policy{TagFilter: &TagFilterNull{}, DryRun: true}
+
+	t.Run("once_per_run", func(t *testing.T) {
+		t.Parallel()
+
+		lister := &staticInUseLister{}
+		c := newTestCleaner(t, WithRegistry(registry), WithInUseLister(lister))
+
+		images, err := c.ListInUse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, repo := range repos {
+			if _, err := c.CleanWithResult(ctx, repo, policy, WithInUseImages(images)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, want := lister.calls.Load(), int64(1); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	})
+
+	t.Run("not_listed", func(t *testing.T) {
+		t.Parallel()
+
+		lister := &staticInUseLister{}
+		c := newTestCleaner(t, WithRegistry(registry), WithInUseLister(lister))
+
+		if _, err := c.CleanWithResult(ctx, repos[0], policy); err == nil {
+			t.Errorf("expected error")
+		}
+		if got, want := lister.calls.Load(), int64(0); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	})
+
+	t.Run("clean_policy", func(t *testing.T) {
+		t.Parallel()
+
+		lister := &staticInUseLister{}
+		c := newTestCleaner(t, WithRegistry(registry), WithInUseLister(lister))
+
+		if _, err := c.CleanPolicy(ctx, repos[0], policy); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := lister.calls.Load(), int64(1); got != want {
+			t.Errorf("expected %d to be %d", got, want)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+
+		c := newTestCleaner(t, WithRegistry(registry),
+			WithInUseLister(&staticInUseLister{err: fmt.Errorf("cluster unreachable")}))
+
+		if _, err := c.ListInUse(ctx); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("no_lister", func(t *testing.T) {
+		t.Parallel()
+
+		c := newTestCleaner(t, WithRegistry(registry))
+
+		images, err := c.ListInUse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if images != nil {
+			t.Errorf("expected %d images to be 0", len(images))
+		}
+		if _, err := c.CleanWithResult(ctx, repos[0], policy); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
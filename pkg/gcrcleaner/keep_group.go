@@ -0,0 +1,88 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// keepGroupName is the name of the capture group that identifies a family.
+	keepGroupName = "group"
+
+	// KeepGroupUntagged is the family of all untagged images.
+	KeepGroupUntagged = "(untagged)"
+
+	// KeepGroupUngrouped is the family of all tagged images where no tag matches
+	// the expression. Parentheses are not valid in tags, so neither name can
+	// collide with a captured family.
+	KeepGroupUngrouped = "(ungrouped)"
+)
+
+// KeepGroup partitions images into families so the keep count applies to each
+// family separately. The family of an image is the value of the "group"
+// capture group for the first of its tags that matches.
+type KeepGroup struct {
+	re    *regexp.Regexp
+	index int
+}
+
+// BuildKeepGroup compiles the given regular expression, which must have a
+// capture group named "group" (e.g. "^(?P<group>.+)-[0-9a-f]{7}$"). If the
+// expression is empty, it returns nil.
+func BuildKeepGroup(s string) (*KeepGroup, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile keep_group_by regular expression %q: %w", s, err)
+	}
+
+	index := re.SubexpIndex(keepGroupName)
+	if index < 0 {
+		return nil, fmt.Errorf("keep_group_by regular expression %q must have a capture group named %q", s, keepGroupName)
+	}
+	return &KeepGroup{re: re, index: index}, nil
+}
+
+// Name returns the expression.
+func (g *KeepGroup) Name() string {
+	if g == nil {
+		return "(none)"
+	}
+	return g.re.String()
+}
+
+// Group returns the family for the given tags. If g is nil, every image is in
+// the same family.
+func (g *KeepGroup) Group(tags []string) string {
+	if g == nil {
+		return ""
+	}
+
+	if len(tags) == 0 {
+		return KeepGroupUntagged
+	}
+
+	for _, tag := range tags {
+		if matches := g.re.FindStringSubmatch(tag); matches != nil {
+			return matches[g.index]
+		}
+	}
+	return KeepGroupUngrouped
+}
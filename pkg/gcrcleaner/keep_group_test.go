@@ -0,0 +1,125 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"testing"
+)
+
+func TestBuildKeepGroup(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   string
+		err  bool
+		none bool
+	}{
+		{
+			name: "empty",
+			in:   "",
+			none: true,
+		},
+		{
+			name: "named_group",
+			in:   `^(?P<group>.+)-[0-9a-f]{7}$`,
+		},
+		{
+			name: "no_named_group",
+			in:   `^(.+)-[0-9a-f]{7}$`,
+			err:  true,
+		},
+		{
+			name: "invalid",
+			in:   `^(?P<group>`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			g, err := BuildKeepGroup(tc.in)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := g == nil, tc.none || tc.err; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestKeepGroup_Group(t *testing.T) {
+	t.Parallel()
+
+	g, err := BuildKeepGroup(`^(?P<group>.+)-[0-9a-f]{7}$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		group *KeepGroup
+		tags  []string
+		exp   string
+	}{
+		{
+			name:  "nil",
+			group: nil,
+			tags:  []string{"main-abcdef0"},
+			exp:   "",
+		},
+		{
+			name:  "untagged",
+			group: g,
+			tags:  nil,
+			exp:   KeepGroupUntagged,
+		},
+		{
+			name:  "match",
+			group: g,
+			tags:  []string{"feature/x-abcdef0"},
+			exp:   "feature/x",
+		},
+		{
+			name:  "first_match",
+			group: g,
+			tags:  []string{"latest", "main-abcdef0", "release-0123456"},
+			exp:   "main",
+		},
+		{
+			name:  "no_match",
+			group: g,
+			tags:  []string{"latest"},
+			exp:   KeepGroupUngrouped,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := tc.group.Group(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubernetesPageSize is the number of objects requested per page when listing
+// workloads.
+const kubernetesPageSize = 500
+
+// KubernetesCluster is a Kubernetes cluster whose workloads use images.
+type KubernetesCluster struct {
+	// Name identifies the cluster, such as the name of its kubeconfig context.
+	Name string
+
+	// Client is the client for the cluster.
+	Client kubernetes.Interface
+}
+
+// LoadKubernetesClusters creates a cluster for each of the given kubeconfig
+// contexts, or for the current context if none are given. The kubeconfig
+// files are merged like kubectl does. If none are given, the KUBECONFIG
+// environment variable and ~/.kube/config are used, falling back to the
+// in-cluster configuration when running in a pod.
+func LoadKubernetesClusters(kubeconfigs, contexts []string) ([]*KubernetesCluster, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if len(kubeconfigs) > 0 {
+		for _, pth := range kubeconfigs {
+			if _, err := os.Stat(pth); err != nil {
+				return nil, fmt.Errorf("failed to read kubeconfig: %w", err)
+			}
+		}
+		rules.Precedence = kubeconfigs
+	}
+
+	if len(contexts) == 0 {
+		contexts = []string{""}
+	}
+
+	clusters := make([]*KubernetesCluster, 0, len(contexts))
+	for _, name := range contexts {
+		cfg := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+			&clientcmd.ConfigOverrides{CurrentContext: name})
+
+		restConfig, err := cfg.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig context %q: %w", name, err)
+		}
+
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes client for context %q: %w", name, err)
+		}
+
+		if name == "" {
+			if raw, err := cfg.RawConfig(); err == nil {
+				name = raw.CurrentContext
+			}
+			if name == "" {
+				name = "in-cluster"
+			}
+		}
+
+		clusters = append(clusters, &KubernetesCluster{
+			Name:   name,
+			Client: client,
+		})
+	}
+	return clusters, nil
+}
+
+// KubernetesInUseLister lists the images of the Pods, Deployments,
+// StatefulSets, DaemonSets, CronJobs, and Jobs in all namespaces of Kubernetes
+// clusters. The images that pods are running are listed by digest, so they are
+// kept even if their tag has moved. The images are cached for the given time
+// to live, since they are listed for each run.
+type KubernetesInUseLister struct {
+	clusters []*KubernetesCluster
+	logger   *Logger
+	ttl      time.Duration
+
+	lock     sync.Mutex
+	images   []*InUseImage
+	listedAt time.Time
+}
+
+var _ InUseLister = (*KubernetesInUseLister)(nil)
+
+// NewKubernetesInUseLister creates a new lister for the images in use in the
+// given clusters.
+func NewKubernetesInUseLister(clusters []*KubernetesCluster, logger *Logger, ttl time.Duration) *KubernetesInUseLister {
+	return &KubernetesInUseLister{
+		clusters: clusters,
+		logger:   logger,
+		ttl:      ttl,
+	}
+}
+
+// ListInUse implements InUseLister. An error listing any cluster is returned,
+// since then any image could be in use.
+func (l *KubernetesInUseLister) ListInUse(ctx context.Context) ([]*InUseImage, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.images != nil && time.Since(l.listedAt) < l.ttl {
+		return l.images, nil
+	}
+
+	images := make([]*InUseImage, 0, 64)
+	for _, cluster := range l.clusters {
+		clusterImages, err := l.listCluster(ctx, cluster)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list images in cluster %s: %w", cluster.Name, err)
+		}
+		images = append(images, clusterImages...)
+	}
+
+	l.logger.Debug("listed images in use",
+		"clusters", len(l.clusters),
+		"images", len(images))
+
+	l.images = images
+	l.listedAt = time.Now()
+	return images, nil
+}
+
+// listCluster lists the images used by the workloads in the cluster. Each
+// image is listed once per cluster, with the first workload that uses it.
+func (l *KubernetesInUseLister) listCluster(ctx context.Context, cluster *KubernetesCluster) ([]*InUseImage, error) {
+	var images []*InUseImage
+	seen := make(map[string]struct{}, 64)
+
+	add := func(kind string, meta *metav1.ObjectMeta, image string) {
+		ref, err := parseImageRef(image)
+		if err != nil {
+			l.logger.Debug("skipping image in use",
+				"cluster", cluster.Name,
+				"kind", kind,
+				"namespace", meta.Namespace,
+				"name", meta.Name,
+				"error", err)
+			return
+		}
+
+		if _, ok := seen[ref.Name()]; ok {
+			return
+		}
+		seen[ref.Name()] = struct{}{}
+
+		images = append(images, &InUseImage{
+			Ref:  ref,
+			User: fmt.Sprintf("%s %s/%s in %s", kind, meta.Namespace, meta.Name, cluster.Name),
+		})
+	}
+
+	addSpec := func(kind string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) {
+		for _, c := range spec.InitContainers {
+			add(kind, meta, c.Image)
+		}
+		for _, c := range spec.Containers {
+			add(kind, meta, c.Image)
+		}
+		for _, c := range spec.EphemeralContainers {
+			add(kind, meta, c.Image)
+		}
+	}
+
+	client := cluster.Client
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list pods: %w", err)
+		}
+		for i := range list.Items {
+			pod := &list.Items[i]
+			addSpec("Pod", &pod.ObjectMeta, &pod.Spec)
+
+			// The image IDs are the digests that the containers are running.
+			for _, statuses := range [][]corev1.ContainerStatus{
+				pod.Status.InitContainerStatuses,
+				pod.Status.ContainerStatuses,
+				pod.Status.EphemeralContainerStatuses,
+			} {
+				for _, status := range statuses {
+					if status.ImageID != "" {
+						add("Pod", &pod.ObjectMeta, status.ImageID)
+					}
+				}
+			}
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list deployments: %w", err)
+		}
+		for i := range list.Items {
+			d := &list.Items[i]
+			addSpec("Deployment", &d.ObjectMeta, &d.Spec.Template.Spec)
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list statefulsets: %w", err)
+		}
+		for i := range list.Items {
+			s := &list.Items[i]
+			addSpec("StatefulSet", &s.ObjectMeta, &s.Spec.Template.Spec)
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list daemonsets: %w", err)
+		}
+		for i := range list.Items {
+			d := &list.Items[i]
+			addSpec("DaemonSet", &d.ObjectMeta, &d.Spec.Template.Spec)
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.BatchV1().CronJobs(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list cronjobs: %w", err)
+		}
+		for i := range list.Items {
+			c := &list.Items[i]
+			addSpec("CronJob", &c.ObjectMeta, &c.Spec.JobTemplate.Spec.Template.Spec)
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := listPages(func(opts metav1.ListOptions) (string, error) {
+		list, err := client.BatchV1().Jobs(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return "", fmt.Errorf("failed to list jobs: %w", err)
+		}
+		for i := range list.Items {
+			j := &list.Items[i]
+			addSpec("Job", &j.ObjectMeta, &j.Spec.Template.Spec)
+		}
+		return list.Continue, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// listPages calls list with the continue token of the previous page until
+// there are no more pages.
+func listPages(list func(opts metav1.ListOptions) (string, error)) error {
+	opts := metav1.ListOptions{Limit: kubernetesPageSize}
+	for {
+		next, err := list(opts)
+		if err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		opts.Continue = next
+	}
+}
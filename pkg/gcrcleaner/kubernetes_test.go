@@ -0,0 +1,217 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestKubernetesInUseLister_ListInUse(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	podSpec := func(images ...string) corev1.PodSpec {
+		var spec corev1.PodSpec
+		for _, image := range images {
+			spec.Containers = append(spec.Containers, corev1.Container{Image: image})
+		}
+		return spec
+	}
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Namespace: "default", Name: name}
+	}
+
+	prod := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: meta("web-1"),
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Image: "gcr.io/p/migrate:v1"}},
+				Containers:     []corev1.Container{{Image: "gcr.io/p/web:latest"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{ImageID: "docker-pullable://gcr.io/p/web@" + digest},
+					{ImageID: "sha256:" + strings.Repeat("b", 64)},
+				},
+			},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: meta("web"),
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{Spec: podSpec("gcr.io/p/web:latest", "gcr.io/p/proxy@"+digest)},
+			},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: meta("db"),
+			Spec: appsv1.StatefulSetSpec{
+				Template: corev1.PodTemplateSpec{Spec: podSpec("postgres:16")},
+			},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: meta("agent"),
+			Spec: appsv1.DaemonSetSpec{
+				Template: corev1.PodTemplateSpec{Spec: podSpec("gcr.io/p/agent:v2", "INVALID")},
+			},
+		},
+	)
+
+	staging := fake.NewSimpleClientset(
+		&batchv1.CronJob{
+			ObjectMeta: meta("report"),
+			Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{
+					Spec: batchv1.JobSpec{
+						Template: corev1.PodTemplateSpec{Spec: podSpec("gcr.io/p/report:2024")},
+					},
+				},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: meta("backfill"),
+			Spec: batchv1.JobSpec{
+				Template: corev1.PodTemplateSpec{Spec: podSpec("gcr.io/p/report:2024", "gcr.io/p/backfill:v1")},
+			},
+		},
+	)
+
+	lister := NewKubernetesInUseLister([]*KubernetesCluster{
+		{Name: "prod", Client: prod},
+		{Name: "staging", Client: staging},
+	}, NewLogger("error", io.Discard, io.Discard), time.Hour)
+
+	images, err := lister.ListInUse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(images))
+	for _, image := range images {
+		got = append(got, image.Ref.Name()+" "+image.User)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"gcr.io/p/agent:v2 DaemonSet default/agent in prod",
+		"gcr.io/p/backfill:v1 Job default/backfill in staging",
+		"gcr.io/p/migrate:v1 Pod default/web-1 in prod",
+		"gcr.io/p/proxy@" + digest + " Deployment default/web in prod",
+		"gcr.io/p/report:2024 CronJob default/report in staging",
+		"gcr.io/p/web:latest Pod default/web-1 in prod",
+		"gcr.io/p/web@" + digest + " Pod default/web-1 in prod",
+		"index.docker.io/library/postgres:16 StatefulSet default/db in prod",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The images are cached, so errors from the cluster are not seen until the
+	// cache expires.
+	prod.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, io.ErrUnexpectedEOF
+	})
+	if _, err := lister.ListInUse(ctx); err != nil {
+		t.Errorf("expected cached images, got %s", err)
+	}
+
+	lister.ttl = 0
+	if _, err := lister.ListInUse(ctx); err == nil {
+		t.Errorf("expected error listing pods")
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	cases := []struct {
+		name string
+		in   string
+		exp  string
+		err  bool
+	}{
+		{
+			name: "tag",
+			in:   "gcr.io/p/r:v1",
+			exp:  "gcr.io/p/r:v1",
+		},
+		{
+			name: "docker_hub",
+			in:   "nginx",
+			exp:  "index.docker.io/library/nginx:latest",
+		},
+		{
+			name: "digest",
+			in:   "gcr.io/p/r@" + digest,
+			exp:  "gcr.io/p/r@" + digest,
+		},
+		{
+			name: "tag_and_digest",
+			in:   "gcr.io/p/r:v1@" + digest,
+			exp:  "gcr.io/p/r@" + digest,
+		},
+		{
+			name: "image_id",
+			in:   "docker-pullable://gcr.io/p/r@" + digest,
+			exp:  "gcr.io/p/r@" + digest,
+		},
+		{
+			name: "local_image_id",
+			in:   digest,
+			err:  true,
+		},
+		{
+			name: "invalid",
+			in:   "INVALID",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ref, err := parseImageRef(tc.in)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := ref.Name(), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
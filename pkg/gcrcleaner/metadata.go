@@ -0,0 +1,412 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// defaultMetadataCacheSize is the number of manifests whose metadata is
+// cached.
+const defaultMetadataCacheSize = 10_000
+
+// manifestMetadata is the metadata of a manifest that is read from the
+// manifest itself, for registries that do not report it.
+type manifestMetadata struct {
+	// MediaType is the media type of the manifest.
+	MediaType string
+
+	// ArtifactType is the artifact type of the manifest, if any.
+	ArtifactType string
+
+	// Labels are the annotations of the manifest, and the labels of the image
+	// config if config is true.
+	Labels map[string]string
+
+	// Blobs are the sizes of the manifest, its config, and its layers, by
+	// digest.
+	Blobs map[string]int64
+
+	// config is true if the labels include the labels of the image config.
+	config bool
+}
+
+// apply fills in the metadata that the registry did not report.
+func (md *manifestMetadata) apply(m *manifest) {
+	if m.Info.MediaType == "" {
+		m.Info.MediaType = md.MediaType
+	}
+	if m.Info.ArtifactType == "" {
+		m.Info.ArtifactType = md.ArtifactType
+	}
+	if m.Info.Labels == nil {
+		m.Info.Labels = md.Labels
+	}
+	if m.Blobs == nil {
+		m.Blobs = md.Blobs
+	}
+}
+
+// fetchMetadata reads the media type, artifact type, annotations, and blob
+// sizes of the given manifests from the manifests themselves. If config is true, the labels
+// of the image config are read too, if the registry can fetch blobs. Metadata
+// is cached by digest, since manifests and configs never change.
+func (c *Cleaner) fetchMetadata(ctx context.Context, gcrrepo gcrname.Repository, manifests []*manifest, config bool) error {
+	blobs, hasBlobs := blobFetcherFor(c.registry, gcrrepo)
+
+	w := worker.New[worker.Void](c.concurrency)
+	for _, m := range manifests {
+		m := m
+
+		if md, ok := c.metadata.get(m.Digest, config); ok {
+			md.apply(m)
+			continue
+		}
+
+		if err := w.Do(ctx, func() (worker.Void, error) {
+			c.logger.Debug("fetching manifest metadata",
+				"repo", gcrrepo.Name(),
+				"digest", m.Digest,
+				"config", config)
+
+			ref := gcrrepo.Digest(m.Digest)
+			raw, err := c.registry.FetchManifest(ctx, ref)
+			if err != nil {
+				return worker.Void{}, fmt.Errorf("failed to fetch manifest %s: %w", ref, err)
+			}
+
+			var body struct {
+				MediaType    string             `json:"mediaType"`
+				ArtifactType string             `json:"artifactType"`
+				Config       *gcrv1.Descriptor  `json:"config"`
+				Layers       []gcrv1.Descriptor `json:"layers"`
+				Annotations  map[string]string  `json:"annotations"`
+			}
+			if err := json.Unmarshal(raw.Body, &body); err != nil {
+				return worker.Void{}, fmt.Errorf("failed to parse manifest %s: %w", ref, err)
+			}
+
+			md := &manifestMetadata{
+				MediaType:    raw.MediaType,
+				ArtifactType: artifactTypeOf(body.ArtifactType, body.Config),
+				config:       config,
+			}
+			if md.MediaType == "" {
+				md.MediaType = body.MediaType
+			}
+
+			// The children of image indexes are separate manifests, so an index
+			// only has its own size.
+			md.Blobs = make(map[string]int64, len(body.Layers)+2)
+			md.Blobs[m.Digest] = int64(len(raw.Body))
+			if body.Config != nil {
+				md.Blobs[body.Config.Digest.String()] = body.Config.Size
+			}
+			for _, layer := range body.Layers {
+				md.Blobs[layer.Digest.String()] = layer.Size
+			}
+
+			var configLabels map[string]string
+			if config && hasBlobs && body.Config != nil && body.Config.MediaType.IsConfig() {
+				configRef := gcrrepo.Digest(body.Config.Digest.String())
+				b, err := blobs.FetchBlob(ctx, configRef)
+				if err != nil {
+					return worker.Void{}, fmt.Errorf("failed to fetch image config %s: %w", configRef, err)
+				}
+
+				cfg, err := gcrv1.ParseConfigFile(bytes.NewReader(b))
+				if err != nil {
+					return worker.Void{}, fmt.Errorf("failed to parse image config %s: %w", configRef, err)
+				}
+				configLabels = cfg.Config.Labels
+			}
+
+			// An empty map records that the manifest has no labels, so it is not
+			// fetched again.
+			md.Labels = mergeLabels(configLabels, body.Annotations)
+			if md.Labels == nil {
+				md.Labels = map[string]string{}
+			}
+
+			c.metadata.add(m.Digest, md)
+			md.apply(m)
+			return worker.Void{}, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+		}
+	}
+	return ErrsToError(errs)
+}
+
+// artifactType returns the artifact type of the raw manifest, or the empty
+// string if it has none or cannot be parsed.
+func artifactType(body []byte) string {
+	var m struct {
+		ArtifactType string            `json:"artifactType"`
+		Config       *gcrv1.Descriptor `json:"config"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ""
+	}
+	return artifactTypeOf(m.ArtifactType, m.Config)
+}
+
+// artifactTypeOf returns the artifact type of a manifest with the given
+// artifactType field and config. Artifacts that predate the artifactType field
+// are identified by the media type of their config (e.g. Helm charts and
+// BuildKit caches). Container images have no artifact type.
+func artifactTypeOf(artifactType string, config *gcrv1.Descriptor) string {
+	if artifactType != "" {
+		return artifactType
+	}
+	if config != nil && !config.MediaType.IsConfig() {
+		return string(config.MediaType)
+	}
+	return ""
+}
+
+// needsMetadata returns true if the metadata of the manifest must be fetched
+// to decide whether it is deleted. Children of image indexes and supporting
+// artifacts follow their parent or subject, and images with a protected tag
+// are always kept. Expressions that reference labels need them even though
+// registries such as GCR and Artifact Registry do not list them. Time sources
+// that read labels date every image, including protected ones, since they
+// also fill buckets.
+// In quota mode, the blobs of every manifest are needed to compute the size of
+// the repository.
+func needsMetadata(m *manifest, graph *manifestGraph, policy *Policy) bool {
+	if policy.Quota > 0 && m.Blobs == nil {
+		return true
+	}
+	if graph.isChild(m) || graph.isArtifact(m) {
+		return false
+	}
+	if policy.TimeSource.needsLabels() && m.Info.Labels == nil {
+		return true
+	}
+	if _, _, ok := protectedTag(policy.ProtectedTags, m.Info.Tags); ok {
+		return false
+	}
+
+	return (policy.needsLabels() && m.Info.Labels == nil) ||
+		(policy.Expression.references("media_type") && m.Info.MediaType == "") ||
+		(policy.TypeFilter.needsMediaType() && m.Info.MediaType == "") ||
+		(policy.TypeFilter.needsArtifactType() && m.Info.ArtifactType == "")
+}
+
+// WithMetadataCacheDir configures the cleaner to also cache the manifest
+// metadata that it fetches in the given directory, one file per digest, so it
+// is kept across runs of the CLI and restarts of the server. Errors reading or
+// writing the directory are ignored and the metadata is fetched again.
+func WithMetadataCacheDir(dir string) CleanerOption {
+	return func(c *Cleaner) {
+		if c.metadata != nil {
+			c.metadata.dir = dir
+		}
+	}
+}
+
+// metadataCache is a bounded cache of the metadata of manifests, by digest.
+// When it is full, the oldest entries are evicted first. If dir is set, the
+// metadata is also stored on disk, where it is never evicted.
+type metadataCache struct {
+	lock    sync.Mutex
+	size    int
+	dir     string
+	entries map[string]*manifestMetadata
+	order   []string
+}
+
+// metadataFile is the representation of manifestMetadata on disk.
+type metadataFile struct {
+	MediaType    string            `json:"media_type,omitempty"`
+	ArtifactType string            `json:"artifact_type,omitempty"`
+	Labels       map[string]string `json:"labels"`
+	Blobs        map[string]int64  `json:"blobs,omitempty"`
+	Config       bool              `json:"config,omitempty"`
+}
+
+// newMetadataCache creates a new cache for the metadata of up to size
+// manifests.
+func newMetadataCache(size int) *metadataCache {
+	return &metadataCache{
+		size:    size,
+		entries: make(map[string]*manifestMetadata, 64),
+	}
+}
+
+// get returns the cached metadata of the digest, reading it from disk if it is
+// not in memory. If config is true, only metadata that includes the labels of
+// the image config is returned. It is safe to call on a nil cache.
+func (c *metadataCache) get(digest string, config bool) (*manifestMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	md, ok := c.entries[digest]
+	c.lock.Unlock()
+
+	if !ok {
+		if md, ok = c.read(digest); ok {
+			c.remember(digest, md)
+		}
+	}
+	if !ok || (config && !md.config) {
+		return nil, false
+	}
+	return md, true
+}
+
+// add caches the metadata of the digest, replacing metadata without the labels
+// of the image config. It is safe to call on a nil cache.
+func (c *metadataCache) add(digest string, md *manifestMetadata) {
+	if c == nil {
+		return
+	}
+
+	if c.remember(digest, md) {
+		c.write(digest, md)
+	}
+}
+
+// remember caches the metadata of the digest in memory, and returns true if it
+// was added or replaced.
+func (c *metadataCache) remember(digest string, md *manifestMetadata) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if existing, ok := c.entries[digest]; ok {
+		if md.config && !existing.config {
+			c.entries[digest] = md
+			return true
+		}
+		return false
+	}
+
+	if c.size < 1 {
+		return true
+	}
+	for len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[digest] = md
+	c.order = append(c.order, digest)
+	return true
+}
+
+// path returns the path of the file for the digest, or the empty string if
+// the cache is not stored on disk or the digest is invalid.
+func (c *metadataCache) path(digest string) string {
+	if c.dir == "" {
+		return ""
+	}
+
+	h, err := gcrv1.NewHash(digest)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(c.dir, h.Algorithm+"-"+h.Hex+".json")
+}
+
+// read reads the metadata of the digest from disk.
+func (c *metadataCache) read(digest string) (*manifestMetadata, bool) {
+	pth := c.path(digest)
+	if pth == "" {
+		return nil, false
+	}
+
+	b, err := os.ReadFile(pth)
+	if err != nil {
+		return nil, false
+	}
+
+	var f metadataFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, false
+	}
+	if f.Labels == nil {
+		f.Labels = map[string]string{}
+	}
+
+	return &manifestMetadata{
+		MediaType:    f.MediaType,
+		ArtifactType: f.ArtifactType,
+		Labels:       f.Labels,
+		Blobs:        f.Blobs,
+		config:       f.Config,
+	}, true
+}
+
+// write writes the metadata of the digest to disk. The file is renamed into
+// place, so concurrent readers never see a partial file.
+func (c *metadataCache) write(digest string, md *manifestMetadata) {
+	pth := c.path(digest)
+	if pth == "" {
+		return
+	}
+
+	b, err := json.Marshal(&metadataFile{
+		MediaType:    md.MediaType,
+		ArtifactType: md.ArtifactType,
+		Labels:       md.Labels,
+		Blobs:        md.Blobs,
+		Config:       md.config,
+	})
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, ".metadata-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return
+	}
+	if err := f.Close(); err != nil {
+		return
+	}
+	_ = os.Rename(f.Name(), pth)
+}
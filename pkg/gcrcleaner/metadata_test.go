@@ -0,0 +1,190 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCleaner_FetchMetadata(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cfg := "sha256:" + strings.Repeat("c", 64)
+	dd := "sha256:" + strings.Repeat("d", 64)
+
+	registry := &fakeRegistry{
+		raw: map[string]*RawManifest{
+			aa: {
+				Digest:    aa,
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Body: []byte(fmt.Sprintf(`{
+					"schemaVersion": 2,
+					"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": %q, "size": 1},
+					"annotations": {"gcr-cleaner.expires-after": "1d"}
+				}`, cfg)),
+			},
+			bb: {
+				Digest:    bb,
+				MediaType: "application/vnd.oci.image.index.v1+json",
+				Body:      []byte(`{"schemaVersion": 2, "manifests": []}`),
+			},
+			dd: {
+				Digest:    dd,
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Body: []byte(fmt.Sprintf(`{
+					"schemaVersion": 2,
+					"config": {"mediaType": "application/vnd.cncf.helm.config.v1+json", "digest": %q, "size": 1}
+				}`, cfg)),
+			},
+		},
+		blobs: map[string][]byte{
+			cfg: []byte(`{"config": {"Labels": {"gcr-cleaner.keep": "true", "gcr-cleaner.expires-after": "7d"}}}`),
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+	repo := mustRepository(t, "registry.example/a/b")
+
+	manifests := []*manifest{{Digest: aa}, {Digest: bb}, {Digest: dd}}
+	if err := c.fetchMetadata(ctx, repo, manifests, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Annotations take precedence over config labels.
+	if got, want := manifests[0].Info.Labels, map[string]string{
+		LabelKeep:         "true",
+		LabelExpiresAfter: "1d",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := manifests[1].Info.Labels, map[string]string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Images have no artifact type, and older artifacts use their config media
+	// type.
+	for i, want := range []string{"", "", "application/vnd.cncf.helm.config.v1+json"} {
+		if got := manifests[i].Info.ArtifactType; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+	if got, want := manifests[1].Info.MediaType, "application/vnd.oci.image.index.v1+json"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// The second run is served from the cache.
+	registry.raw, registry.blobs = nil, nil
+	again := []*manifest{{Digest: aa}, {Digest: bb}}
+	if err := c.fetchMetadata(ctx, repo, again, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := again[0].Info.Labels, manifests[0].Info.Labels; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	t.Parallel()
+
+	c := newMetadataCache(2)
+	c.add("a", &manifestMetadata{MediaType: "a", config: true})
+	c.add("b", &manifestMetadata{MediaType: "b", config: true})
+	c.add("c", &manifestMetadata{MediaType: "c"})
+
+	if _, ok := c.get("a", false); ok {
+		t.Errorf("expected a to be evicted")
+	}
+	for _, digest := range []string{"b", "c"} {
+		md, ok := c.get(digest, false)
+		if !ok {
+			t.Fatalf("expected %s to be cached", digest)
+		}
+		if got, want := md.MediaType, digest; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+
+	// Metadata without the config labels does not satisfy a request for them,
+	// and is replaced once they are fetched.
+	if _, ok := c.get("c", true); ok {
+		t.Errorf("expected c to be cached without config labels")
+	}
+	c.add("c", &manifestMetadata{MediaType: "c", config: true})
+	if _, ok := c.get("c", true); !ok {
+		t.Errorf("expected c to be cached with config labels")
+	}
+
+	var nilCache *metadataCache
+	nilCache.add("a", &manifestMetadata{})
+	if _, ok := nilCache.get("a", false); ok {
+		t.Errorf("expected nil cache to be empty")
+	}
+}
+
+func TestMetadataCache_Dir(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	aa := "sha256:" + strings.Repeat("a", 64)
+	dir := t.TempDir()
+
+	registry := &fakeRegistry{
+		raw: map[string]*RawManifest{
+			aa: {
+				Digest:    aa,
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Body:      []byte(`{"schemaVersion": 2, "annotations": {"gcr-cleaner.keep": "true"}}`),
+			},
+		},
+	}
+	repo := mustRepository(t, "registry.example/a/b")
+
+	c := newTestCleaner(t, WithRegistry(registry), WithMetadataCacheDir(dir))
+	if err := c.fetchMetadata(ctx, repo, []*manifest{{Digest: aa}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new cleaner, such as the next run of the CLI, reads the metadata from
+	// disk instead of the registry.
+	registry.raw = nil
+	again := newTestCleaner(t, WithRegistry(registry), WithMetadataCacheDir(dir))
+	manifests := []*manifest{{Digest: aa}}
+	if err := again.fetchMetadata(ctx, repo, manifests, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := manifests[0].Info.Labels, map[string]string{LabelKeep: "true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := manifests[0].Info.MediaType, "application/vnd.oci.image.manifest.v1+json"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// Invalid digests are not stored on disk.
+	cache := newMetadataCache(0)
+	cache.dir = dir
+	cache.add("../escape", &manifestMetadata{})
+	if _, ok := cache.get("../escape", false); ok {
+		t.Errorf("expected invalid digest not to be cached")
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Policy is a fully-resolved retention policy for a single repository.
+type Policy struct {
+	// Name is the name of the policy, used for logging.
+	Name string
+
+	// Grace is the duration in which to ignore references.
+	Grace time.Duration
+
+	// UntaggedGrace, if set, replaces Grace for untagged images.
+	UntaggedGrace time.Duration
+
+	// TaggedGrace, if set, replaces Grace for tagged images. Parts of the tag
+	// filter can set their own grace period, which replaces both.
+	TaggedGrace time.Duration
+
+	// OlderThan, if set, is an absolute cutoff. Images uploaded after it are not
+	// deleted, regardless of the grace period.
+	OlderThan time.Time
+
+	// NewerThan, if set, is an absolute cutoff. Images uploaded at or before it
+	// are not deleted.
+	NewerThan time.Time
+
+	// Keep is the minimum number of images to keep.
+	Keep int64
+
+	// KeepGroup, if set, applies Keep to each family of images separately.
+	KeepGroup *KeepGroup
+
+	// Buckets, if set, keeps the newest image in each period of the schedule.
+	Buckets *Buckets
+
+	// TagFilter determines which tagged images are deletion candidates.
+	TagFilter TagFilter
+
+	// Expression, if set, decides which images are deletion candidates instead
+	// of TagFilter.
+	Expression *Expression
+
+	// ProtectedTags are evaluated before all other rules. Images with a tag that
+	// matches any of them are never deleted.
+	ProtectedTags []*regexp.Regexp
+
+	// Semver, if set, decides which images with semantic version tags are kept.
+	// Tags that are not semantic versions are still matched by TagFilter.
+	Semver *SemverPolicy
+
+	// UntagOnly removes only the tags that match TagFilter from images that
+	// also have other tags, instead of deleting the entire image.
+	UntagOnly bool
+
+	// TimeSource, if set, is where the time of each image comes from for both
+	// the grace period and the keep order.
+	TimeSource *TimeSource
+
+	// Quota, if set, is the maximum deduplicated size of the repository in
+	// bytes. Deletion candidates are deleted from oldest to newest only until
+	// the repository fits, and the rest are kept.
+	Quota int64
+
+	// TypeFilter, if set, selects the manifests the policy applies to by media
+	// type and artifact type. Other manifests are kept.
+	TypeFilter *TypeFilter
+
+	// RetentionLabels lets images pin themselves with the gcr-cleaner.keep
+	// label and set their own expiry with the gcr-cleaner.expires-after label.
+	// Labels the registry does not report are fetched.
+	RetentionLabels bool
+
+	// DeleteOrphans deletes supporting artifacts whose subject is not in the
+	// repository once they are older than the grace period. Artifacts can be
+	// stored apart from their subject, so they are kept by default.
+	DeleteOrphans bool
+
+	// DryRun disables actual deletion.
+	DryRun bool
+}
+
+// Since returns the timestamp before which refs are candidates for deletion,
+// relative to the given time.
+func (p *Policy) Since(now time.Time) time.Time {
+	return p.cutoff(graceSince(now, p.Grace))
+}
+
+// sinceFor returns the timestamp before which an image with the given tags is
+// a candidate for deletion, and a description of the grace period that
+// applies, such as "untagged_grace 24h0m0s".
+func (p *Policy) sinceFor(now time.Time, tags []string) (time.Time, string) {
+	grace, from := p.graceFor(tags)
+	since := graceSince(now, grace)
+	if cutoff := p.cutoff(since); !cutoff.Equal(since) {
+		return cutoff, "older_than " + cutoff.Format(time.RFC3339)
+	}
+	return since, from
+}
+
+// cutoff returns the earlier of since and OlderThan.
+func (p *Policy) cutoff(since time.Time) time.Time {
+	if !p.OlderThan.IsZero() && p.OlderThan.Before(since) {
+		return p.OlderThan.UTC()
+	}
+	return since
+}
+
+// tooOld returns true if NewerThan is set and the time is not after it.
+func (p *Policy) tooOld(t time.Time) bool {
+	return !p.NewerThan.IsZero() && !t.After(p.NewerThan)
+}
+
+// unknownTooNew returns true if the time is unknown (zero) and the grace period
+// or an absolute cutoff applies, since then the image cannot be known to be old
+// enough to delete.
+func (p *Policy) unknownTooNew(t, since, now time.Time) bool {
+	return t.IsZero() && (since.Before(now) || !p.NewerThan.IsZero())
+}
+
+// needsLabels returns true if the policy reads the labels of images, which
+// some registries do not list.
+func (p *Policy) needsLabels() bool {
+	return p.RetentionLabels || p.Expression.references("labels") || p.TimeSource.needsLabels()
+}
+
+// validateCutoffs returns an error if the absolute cutoffs cannot both be met.
+func validateCutoffs(olderThan, newerThan time.Time) error {
+	if !olderThan.IsZero() && !newerThan.IsZero() && !newerThan.Before(olderThan) {
+		return fmt.Errorf("newer_than must be before older_than")
+	}
+	return nil
+}
+
+// graceFor returns the grace period for an image with the given tags and a
+// description of where it came from.
+func (p *Policy) graceFor(tags []string) (time.Duration, string) {
+	if len(tags) == 0 {
+		if p.UntaggedGrace > 0 {
+			return p.UntaggedGrace, "untagged_grace " + p.UntaggedGrace.String()
+		}
+		return p.Grace, "grace " + p.Grace.String()
+	}
+
+	grace, from := p.Grace, "grace "+p.Grace.String()
+	if p.TaggedGrace > 0 {
+		grace, from = p.TaggedGrace, "tagged_grace "+p.TaggedGrace.String()
+	}
+	if p.Expression == nil && p.TagFilter != nil && p.TagFilter.Matches(tags) {
+		grace, from = tagFilterGrace(p.TagFilter, tags, grace, from)
+	}
+	return grace, from
+}
+
+// graceSince returns the timestamp that is the grace period before now.
+func graceSince(now time.Time, grace time.Duration) time.Time {
+	// Convert duration to a negative value, since we're about to "add" it to the
+	// since time.
+	sub := grace
+	if sub > 0 {
+		sub = sub * -1
+	}
+	return now.UTC().Add(sub)
+}
+
+// PolicyConfig is the declarative policy file format. It maps repository
+// patterns to named policies.
+type PolicyConfig struct {
+	// Defaults are applied to every repository before any named policy.
+	Defaults PolicySpec `json:"defaults"`
+
+	// Policies is the map of named policies.
+	Policies map[string]*PolicySpec `json:"policies"`
+
+	// Repos is the ordered list of repository rules. The first rule that matches
+	// a repository wins.
+	Repos []*PolicyRule `json:"repos"`
+}
+
+// PolicySpec is a partial policy. Fields that are unset do not override
+// earlier values. Protected tags are added to the earlier protected tags, so
+// they can never be removed.
+type PolicySpec struct {
+	Grace           *duration       `json:"grace,omitempty"`
+	UntaggedGrace   *duration       `json:"untagged_grace,omitempty"`
+	TaggedGrace     *duration       `json:"tagged_grace,omitempty"`
+	OlderThan       *time.Time      `json:"older_than,omitempty"`
+	NewerThan       *time.Time      `json:"newer_than,omitempty"`
+	Keep            *int64          `json:"keep,omitempty"`
+	KeepGroupBy     *string         `json:"keep_group_by,omitempty"`
+	Buckets         *Buckets        `json:"buckets,omitempty"`
+	TagFilter       *string         `json:"tag_filter,omitempty"`
+	TagFilterAny    *string         `json:"tag_filter_any,omitempty"`
+	TagFilterAll    *string         `json:"tag_filter_all,omitempty"`
+	Expression      *string         `json:"expression,omitempty"`
+	ProtectedTags   []string        `json:"protected_tags,omitempty"`
+	Semver          *SemverSpec     `json:"semver,omitempty"`
+	UntagOnly       *bool           `json:"untag_only,omitempty"`
+	TimeSource      *TimeSourceSpec `json:"time_source,omitempty"`
+	Quota           *byteSize       `json:"quota,omitempty"`
+	TypeFilter      *TypeFilterSpec `json:"type_filter,omitempty"`
+	RetentionLabels *bool           `json:"retention_labels,omitempty"`
+	DeleteOrphans   *bool           `json:"delete_orphans,omitempty"`
+	DryRun          *bool           `json:"dry_run,omitempty"`
+
+	// tagFilter is the compiled tag filter, populated by compile.
+	tagFilter TagFilter
+
+	// expression is the compiled expression, populated by compile.
+	expression *Expression
+
+	// keepGroup is the compiled keep group, populated by compile.
+	keepGroup *KeepGroup
+
+	// protectedTags are the compiled protected tags, populated by compile.
+	protectedTags []*regexp.Regexp
+
+	// semver is the semver policy, populated by compile.
+	semver *SemverPolicy
+
+	// timeSource is the time source, populated by compile.
+	timeSource *TimeSource
+
+	// typeFilter is the compiled type filter, populated by compile.
+	typeFilter *TypeFilter
+}
+
+// PolicyRule matches repositories to a named policy. Exactly one of Exact,
+// Prefix, or Glob must be given. Any policy fields set directly on the rule
+// override the named policy.
+type PolicyRule struct {
+	// Exact matches the full repository name.
+	Exact string `json:"exact,omitempty"`
+
+	// Prefix matches any repository that starts with the value.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Glob matches the repository using shell patterns. "*" does not match "/".
+	Glob string `json:"glob,omitempty"`
+
+	// Policy is the name of the policy to apply.
+	Policy string `json:"policy,omitempty"`
+
+	PolicySpec
+}
+
+// LoadPolicyConfig reads and validates the policy file at the given path. The
+// file may be YAML or JSON.
+func LoadPolicyConfig(pth string) (*PolicyConfig, error) {
+	b, err := os.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	cfg, err := ParsePolicyConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", pth, err)
+	}
+	return cfg, nil
+}
+
+// ParsePolicyConfig parses and validates the given YAML or JSON policy
+// configuration.
+func ParsePolicyConfig(b []byte) (*PolicyConfig, error) {
+	var cfg PolicyConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// validate checks the configuration for errors and compiles all tag filters.
+func (c *PolicyConfig) validate() error {
+	var errs []error
+
+	if err := c.Defaults.compile(); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+
+	names := make([]string, 0, len(c.Policies))
+	for name := range c.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := c.Policies[name]
+		if spec == nil {
+			c.Policies[name] = &PolicySpec{}
+			continue
+		}
+		if err := spec.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("policies.%s: %w", name, err))
+		}
+	}
+
+	for i, rule := range c.Repos {
+		if rule == nil {
+			errs = append(errs, fmt.Errorf("repos[%d]: rule is empty", i))
+			continue
+		}
+		if err := rule.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("repos[%d]: %w", i, err))
+			continue
+		}
+		if rule.Policy != "" {
+			if _, ok := c.Policies[rule.Policy]; !ok {
+				errs = append(errs, fmt.Errorf("repos[%d]: unknown policy %q", i, rule.Policy))
+			}
+		}
+		if err := rule.PolicySpec.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("repos[%d]: %w", i, err))
+		}
+	}
+
+	// The absolute cutoffs are layered like the rest of the policy, so the
+	// defaults and the layers of each rule, which are what Resolve produces, must
+	// be able to match.
+	if err := layeredCutoffs(&c.Defaults); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+	for i, rule := range c.Repos {
+		if rule == nil {
+			continue
+		}
+		if err := layeredCutoffs(&c.Defaults, c.Policies[rule.Policy], &rule.PolicySpec); err != nil {
+			errs = append(errs, fmt.Errorf("repos[%d]: %w", i, err))
+		}
+	}
+
+	return ErrsToError(errs)
+}
+
+// layeredCutoffs returns an error if the absolute cutoffs of the specs, applied
+// in order, cannot both be met. Nil specs are skipped.
+func layeredCutoffs(specs ...*PolicySpec) error {
+	var olderThan, newerThan time.Time
+	for _, s := range specs {
+		if s == nil {
+			continue
+		}
+		if s.OlderThan != nil {
+			olderThan = *s.OlderThan
+		}
+		if s.NewerThan != nil {
+			newerThan = *s.NewerThan
+		}
+	}
+	return validateCutoffs(olderThan, newerThan)
+}
+
+// Resolve returns the policy for the given repository. The base policy is
+// layered with the file defaults, the named policy of the first matching rule,
+// and finally any overrides on the rule itself. If c is nil, a copy of base is
+// returned.
+func (c *PolicyConfig) Resolve(repo string, base *Policy) *Policy {
+	p := *base
+	if c == nil {
+		return &p
+	}
+
+	// Dry-run requested by the caller can never be disabled by the file, so
+	// compute the file's value separately and combine them at the end.
+	p.DryRun = false
+	c.Defaults.apply(&p)
+
+	for _, rule := range c.Repos {
+		if !rule.matches(repo) {
+			continue
+		}
+
+		if rule.Policy != "" {
+			c.Policies[rule.Policy].apply(&p)
+			p.Name = rule.Policy
+		} else {
+			p.Name = rule.pattern()
+		}
+		rule.PolicySpec.apply(&p)
+		break
+	}
+
+	p.DryRun = p.DryRun || base.DryRun
+	return &p
+}
+
+// compile validates the spec and compiles the tag filter, keep group, and
+// semver policy, if any.
+func (s *PolicySpec) compile() error {
+	if s.Keep != nil && *s.Keep < 0 {
+		return fmt.Errorf("keep must not be negative")
+	}
+
+	if s.Quota != nil && *s.Quota < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+
+	if err := s.Buckets.validate(); err != nil {
+		return err
+	}
+
+	protectedTags, err := BuildProtectedTags(s.ProtectedTags)
+	if err != nil {
+		return err
+	}
+	s.protectedTags = protectedTags
+
+	if s.KeepGroupBy != nil {
+		keepGroup, err := BuildKeepGroup(*s.KeepGroupBy)
+		if err != nil {
+			return err
+		}
+		s.keepGroup = keepGroup
+	}
+
+	semver, err := s.Semver.policy()
+	if err != nil {
+		return err
+	}
+	s.semver = semver
+
+	timeSource, err := s.TimeSource.source()
+	if err != nil {
+		return err
+	}
+	s.timeSource = timeSource
+
+	typeFilter, err := s.TypeFilter.filter()
+	if err != nil {
+		return err
+	}
+	s.typeFilter = typeFilter
+
+	if s.Expression != nil {
+		expression, err := BuildExpression(*s.Expression)
+		if err != nil {
+			return err
+		}
+		s.expression = expression
+	}
+
+	if s.TagFilter == nil && s.TagFilterAny == nil && s.TagFilterAll == nil {
+		return nil
+	}
+
+	var expr, any, all string
+	if s.TagFilter != nil {
+		expr = *s.TagFilter
+	}
+	if s.TagFilterAny != nil {
+		any = *s.TagFilterAny
+	}
+	if s.TagFilterAll != nil {
+		all = *s.TagFilterAll
+	}
+
+	tagFilter, err := BuildTagFilterExpr(expr, any, all)
+	if err != nil {
+		return err
+	}
+	s.tagFilter = tagFilter
+	return nil
+}
+
+// apply overrides any values in p with the values set in the spec.
+func (s *PolicySpec) apply(p *Policy) {
+	if s.Grace != nil {
+		p.Grace = time.Duration(*s.Grace)
+	}
+	if s.UntaggedGrace != nil {
+		p.UntaggedGrace = time.Duration(*s.UntaggedGrace)
+	}
+	if s.TaggedGrace != nil {
+		p.TaggedGrace = time.Duration(*s.TaggedGrace)
+	}
+	if s.OlderThan != nil {
+		p.OlderThan = *s.OlderThan
+	}
+	if s.NewerThan != nil {
+		p.NewerThan = *s.NewerThan
+	}
+	if s.Keep != nil {
+		p.Keep = *s.Keep
+	}
+	if s.KeepGroupBy != nil {
+		p.KeepGroup = s.keepGroup
+	}
+	if s.Buckets != nil {
+		p.Buckets = s.Buckets
+	}
+	if s.tagFilter != nil {
+		p.TagFilter = s.tagFilter
+	}
+	if s.Expression != nil {
+		p.Expression = s.expression
+	}
+	if len(s.protectedTags) > 0 {
+		p.ProtectedTags = append(p.ProtectedTags[:len(p.ProtectedTags):len(p.ProtectedTags)], s.protectedTags...)
+	}
+	if s.semver != nil {
+		p.Semver = s.semver
+	}
+	if s.UntagOnly != nil {
+		p.UntagOnly = *s.UntagOnly
+	}
+	if s.timeSource != nil {
+		p.TimeSource = s.timeSource
+	}
+	if s.Quota != nil {
+		p.Quota = int64(*s.Quota)
+	}
+	if s.typeFilter != nil {
+		p.TypeFilter = s.typeFilter
+	}
+	if s.RetentionLabels != nil {
+		p.RetentionLabels = *s.RetentionLabels
+	}
+	if s.DeleteOrphans != nil {
+		p.DeleteOrphans = *s.DeleteOrphans
+	}
+	if s.DryRun != nil {
+		p.DryRun = *s.DryRun
+	}
+}
+
+// validate ensures exactly one pattern is given and that it is valid.
+func (r *PolicyRule) validate() error {
+	count := 0
+	for _, v := range []string{r.Exact, r.Prefix, r.Glob} {
+		if v != "" {
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("exactly one of exact, prefix, or glob must be specified")
+	}
+
+	if r.Glob != "" {
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", r.Glob, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the rule matches the given repository.
+func (r *PolicyRule) matches(repo string) bool {
+	switch {
+	case r.Exact != "":
+		return repo == r.Exact
+	case r.Prefix != "":
+		return strings.HasPrefix(repo, r.Prefix)
+	case r.Glob != "":
+		ok, _ := path.Match(r.Glob, repo)
+		return ok
+	default:
+		return false
+	}
+}
+
+// pattern returns the human-readable pattern of the rule.
+func (r *PolicyRule) pattern() string {
+	switch {
+	case r.Exact != "":
+		return "exact(" + r.Exact + ")"
+	case r.Prefix != "":
+		return "prefix(" + r.Prefix + ")"
+	default:
+		return "glob(" + r.Glob + ")"
+	}
+}
@@ -0,0 +1,542 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicyConfig(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{
+			name: "empty",
+			in:   ``,
+		},
+		{
+			name: "valid_yaml",
+			in: `
+defaults:
+  grace: 24h
+policies:
+  releases:
+    keep: 10
+    tag_filter_all: ^v\d+
+repos:
+  - exact: gcr.io/my-project/app
+    policy: releases
+  - glob: gcr.io/my-project/*/nightly
+    keep: 3
+`,
+		},
+		{
+			name: "valid_json",
+			in:   `{"policies": {"ci": {"tag_filter_any": "^pr-"}}, "repos": [{"prefix": "gcr.io/a/", "policy": "ci"}]}`,
+		},
+		{
+			name: "unknown_field",
+			in:   `defaults: {kep: 3}`,
+			err:  `unknown field "kep"`,
+		},
+		{
+			name: "unknown_policy",
+			in:   `repos: [{exact: gcr.io/a/b, policy: nope}]`,
+			err:  `unknown policy "nope"`,
+		},
+		{
+			name: "no_pattern",
+			in:   `repos: [{keep: 3}]`,
+			err:  "exactly one of exact, prefix, or glob",
+		},
+		{
+			name: "multiple_patterns",
+			in:   `repos: [{exact: gcr.io/a/b, prefix: gcr.io/a/}]`,
+			err:  "exactly one of exact, prefix, or glob",
+		},
+		{
+			name: "bad_glob",
+			in:   `repos: [{glob: "gcr.io/[a"}]`,
+			err:  "invalid glob",
+		},
+		{
+			name: "bad_regex",
+			in:   `policies: {ci: {tag_filter_any: "("}}`,
+			err:  "policies.ci: failed to compile",
+		},
+		{
+			name: "both_filters",
+			in:   `defaults: {tag_filter_any: a, tag_filter_all: b}`,
+			err:  "only one tag filter type",
+		},
+		{
+			name: "bad_grace",
+			in:   `defaults: {grace: banana}`,
+			err:  "invalid duration",
+		},
+		{
+			name: "bad_keep_group",
+			in:   `defaults: {keep_group_by: "^(.+)-[0-9a-f]{7}$"}`,
+			err:  `must have a capture group named "group"`,
+		},
+		{
+			name: "time_source",
+			in:   `policies: {nightly: {time_source: {type: tag, pattern: '^nightly-(\d{8})$', layout: "20060102"}}}`,
+		},
+		{
+			name: "bad_time_source",
+			in:   `defaults: {time_source: {type: label}}`,
+			err:  "requires a label",
+		},
+		{
+			name: "type_filter",
+			in:   `policies: {charts: {type_filter: {artifact_types: ["application/vnd.cncf.helm.*"]}}}`,
+		},
+		{
+			name: "bad_type_filter",
+			in:   `defaults: {type_filter: {exclude_media_types: ["application/[vnd"]}}`,
+			err:  "invalid type pattern",
+		},
+		{
+			name: "quota",
+			in:   `policies: {ci: {quota: 50GiB}}`,
+		},
+		{
+			name: "conflicting_cutoffs",
+			in:   `defaults: {older_than: "2024-09-01T00:00:00Z", newer_than: "2024-10-01T00:00:00Z"}`,
+			err:  "defaults: newer_than must be before older_than",
+		},
+		{
+			name: "layered_cutoffs",
+			in: `
+defaults:
+  older_than: "2024-10-01T00:00:00Z"
+repos:
+  - prefix: gcr.io/p/
+    newer_than: "2024-09-01T00:00:00Z"
+`,
+		},
+		{
+			name: "conflicting_layered_cutoffs",
+			in: `
+defaults:
+  older_than: "2024-09-01T00:00:00Z"
+policies:
+  recent:
+    newer_than: "2024-08-01T00:00:00Z"
+repos:
+  - prefix: gcr.io/p/
+    newer_than: "2024-10-01T00:00:00Z"
+  - prefix: gcr.io/q/
+    policy: recent
+    older_than: "2024-07-01T00:00:00Z"
+`,
+			err: "repos[1]: newer_than must be before older_than",
+		},
+		{
+			name: "zero_keep",
+			in:   `defaults: {keep: 0}`,
+		},
+		{
+			name: "negative_keep",
+			in:   `defaults: {keep: -1}`,
+			err:  "keep must not be negative",
+		},
+		{
+			name: "negative_quota",
+			in:   `defaults: {quota: -1}`,
+			err:  "quota must not be negative",
+		},
+		{
+			name: "bad_quota",
+			in:   `defaults: {quota: 50XB}`,
+			err:  "unknown unit",
+		},
+		{
+			name: "expression",
+			in:   `policies: {ci: {expression: 'tags.size() == 0 || now - uploaded > duration("336h")'}}`,
+		},
+		{
+			name: "bad_expression",
+			in:   `defaults: {expression: 'tags.size() > "1"'}`,
+			err:  "failed to compile expression",
+		},
+		{
+			name: "buckets",
+			in:   `policies: {nightly: {buckets: {daily: 7, weekly: 8, monthly: 12}}}`,
+		},
+		{
+			name: "negative_buckets",
+			in:   `defaults: {buckets: {daily: -1}}`,
+			err:  "bucket counts must be positive",
+		},
+		{
+			name: "semver",
+			in:   `policies: {releases: {semver: {keep_majors: 2, keep_minors: 1, keep_patches: 3, prerelease_grace: 336h}}}`,
+		},
+		{
+			name: "negative_semver",
+			in:   `defaults: {semver: {keep_patches: -1}}`,
+			err:  "semver keep counts must be positive",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParsePolicyConfig([]byte(tc.in))
+			if err != nil {
+				if tc.err == "" {
+					t.Fatal(err)
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+			} else if tc.err != "" {
+				t.Fatalf("expected error containing %q", tc.err)
+			}
+		})
+	}
+}
+
+func TestPolicyConfig_Resolve(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := ParsePolicyConfig([]byte(`
+defaults:
+  grace: 1h
+  protected_tags: [^latest$]
+policies:
+  releases:
+    keep: 10
+    tag_filter_all: ^v
+    protected_tags: [^stable$]
+  ci:
+    grace: 72h
+    tag_filter_any: ^pr-
+    dry_run: true
+repos:
+  - exact: gcr.io/p/app
+    policy: releases
+  - prefix: gcr.io/p/ci/
+    policy: ci
+    keep: 2
+  - glob: gcr.io/p/*/nightly
+    keep: 7
+  - prefix: gcr.io/p/
+    policy: ci
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := &Policy{
+		Name:      "default",
+		Keep:      1,
+		TagFilter: &TagFilterNull{},
+	}
+
+	cases := []struct {
+		name      string
+		repo      string
+		base      *Policy
+		expName   string
+		expGrace  time.Duration
+		expKeep   int64
+		expFilter string
+		expProt   []string
+		expDryRun bool
+	}{
+		{
+			name:      "no_match",
+			repo:      "gcr.io/other/app",
+			expName:   "default",
+			expGrace:  time.Hour,
+			expKeep:   1,
+			expFilter: "(none)",
+			expProt:   []string{"^latest$"},
+		},
+		{
+			name:      "exact",
+			repo:      "gcr.io/p/app",
+			expName:   "releases",
+			expGrace:  time.Hour,
+			expKeep:   10,
+			expFilter: "all(^v)",
+			expProt:   []string{"^latest$", "^stable$"},
+		},
+		{
+			name:      "prefix_override",
+			repo:      "gcr.io/p/ci/app",
+			expName:   "ci",
+			expGrace:  72 * time.Hour,
+			expKeep:   2,
+			expFilter: "any(^pr-)",
+			expProt:   []string{"^latest$"},
+			expDryRun: true,
+		},
+		{
+			name:      "glob",
+			repo:      "gcr.io/p/team/nightly",
+			expName:   "glob(gcr.io/p/*/nightly)",
+			expGrace:  time.Hour,
+			expKeep:   7,
+			expFilter: "(none)",
+			expProt:   []string{"^latest$"},
+		},
+		{
+			name:      "glob_does_not_cross_slash",
+			repo:      "gcr.io/p/a/b/nightly",
+			expName:   "ci",
+			expGrace:  72 * time.Hour,
+			expKeep:   1,
+			expFilter: "any(^pr-)",
+			expProt:   []string{"^latest$"},
+			expDryRun: true,
+		},
+		{
+			name: "base_dry_run_wins",
+			repo: "gcr.io/p/app",
+			base: &Policy{
+				Name:          "default",
+				TagFilter:     &TagFilterNull{},
+				ProtectedTags: []*regexp.Regexp{regexp.MustCompile("^prod-")},
+				DryRun:        true,
+			},
+			expName:   "releases",
+			expGrace:  time.Hour,
+			expKeep:   10,
+			expFilter: "all(^v)",
+			expProt:   []string{"^prod-", "^latest$", "^stable$"},
+			expDryRun: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := base
+			if tc.base != nil {
+				b = tc.base
+			}
+
+			got := cfg.Resolve(tc.repo, b)
+			if got, want := got.Name, tc.expName; got != want {
+				t.Errorf("expected name %q to be %q", got, want)
+			}
+			if got, want := got.Grace, tc.expGrace; got != want {
+				t.Errorf("expected grace %s to be %s", got, want)
+			}
+			if got, want := got.Keep, tc.expKeep; got != want {
+				t.Errorf("expected keep %d to be %d", got, want)
+			}
+			if got, want := got.TagFilter.Name(), tc.expFilter; got != want {
+				t.Errorf("expected tag filter %q to be %q", got, want)
+			}
+			prot := make([]string, 0, len(got.ProtectedTags))
+			for _, re := range got.ProtectedTags {
+				prot = append(prot, re.String())
+			}
+			if want := tc.expProt; !reflect.DeepEqual(prot, want) {
+				t.Errorf("expected protected tags %q to be %q", prot, want)
+			}
+			if got, want := got.DryRun, tc.expDryRun; got != want {
+				t.Errorf("expected dry run %t to be %t", got, want)
+			}
+		})
+	}
+
+	t.Run("nil_config", func(t *testing.T) {
+		t.Parallel()
+
+		var cfg *PolicyConfig
+		got := cfg.Resolve("gcr.io/p/app", base)
+		if got == base {
+			t.Errorf("expected a copy of the base policy")
+		}
+		if got, want := *got, *base; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %#v to be %#v", got, want)
+		}
+	})
+}
+
+func TestPolicy_GraceFor(t *testing.T) {
+	t.Parallel()
+
+	day := 24 * time.Hour
+
+	filter, err := ParseTagFilter("any(^pr-) older than 720h or any(^tmp-) older than 24h or any(^dev-)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	andFilter, err := ParseTagFilter("any(^pr-) older than 720h and any(-tmp$) older than 48h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		policy  *Policy
+		tags    []string
+		exp     time.Duration
+		expFrom string
+	}{
+		{
+			name:    "grace",
+			policy:  &Policy{Grace: day},
+			tags:    []string{"latest"},
+			exp:     day,
+			expFrom: "grace 24h0m0s",
+		},
+		{
+			name:    "untagged",
+			policy:  &Policy{Grace: 3 * day, UntaggedGrace: day, TaggedGrace: 30 * day},
+			tags:    nil,
+			exp:     day,
+			expFrom: "untagged_grace 24h0m0s",
+		},
+		{
+			name:    "tagged",
+			policy:  &Policy{Grace: 3 * day, UntaggedGrace: day, TaggedGrace: 30 * day},
+			tags:    []string{"latest"},
+			exp:     30 * day,
+			expFrom: "tagged_grace 720h0m0s",
+		},
+		{
+			name:    "untagged_defaults_to_grace",
+			policy:  &Policy{Grace: 3 * day, TaggedGrace: 30 * day},
+			tags:    nil,
+			exp:     3 * day,
+			expFrom: "grace 72h0m0s",
+		},
+		{
+			name:    "filter",
+			policy:  &Policy{TaggedGrace: 2 * day, TagFilter: filter},
+			tags:    []string{"pr-1"},
+			exp:     30 * day,
+			expFrom: "any(^pr-) older than 720h0m0s",
+		},
+		{
+			name:    "filter_or_shortest",
+			policy:  &Policy{TaggedGrace: 2 * day, TagFilter: filter},
+			tags:    []string{"pr-1", "tmp-1"},
+			exp:     day,
+			expFrom: "any(^tmp-) older than 24h0m0s",
+		},
+		{
+			name:    "filter_or_default",
+			policy:  &Policy{TaggedGrace: 2 * day, TagFilter: filter},
+			tags:    []string{"pr-1", "dev-1"},
+			exp:     2 * day,
+			expFrom: "tagged_grace 48h0m0s",
+		},
+		{
+			name:    "filter_and_longest",
+			policy:  &Policy{TagFilter: andFilter},
+			tags:    []string{"pr-1-tmp"},
+			exp:     30 * day,
+			expFrom: "any(^pr-) older than 720h0m0s",
+		},
+		{
+			name:    "filter_does_not_match",
+			policy:  &Policy{Grace: day, TagFilter: filter},
+			tags:    []string{"latest"},
+			exp:     day,
+			expFrom: "grace 24h0m0s",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			grace, from := tc.policy.graceFor(tc.tags)
+			if got, want := grace, tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+			if got, want := from, tc.expFrom; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPolicy_SinceFor(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 10, 15, 0, 0, 0, 0, time.UTC)
+	olderThan := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		policy  *Policy
+		exp     time.Time
+		expFrom string
+	}{
+		{
+			name:    "grace",
+			policy:  &Policy{Grace: 24 * time.Hour},
+			exp:     now.Add(-24 * time.Hour),
+			expFrom: "grace 24h0m0s",
+		},
+		{
+			name:    "older_than",
+			policy:  &Policy{Grace: 24 * time.Hour, OlderThan: olderThan},
+			exp:     olderThan,
+			expFrom: "older_than 2024-10-01T00:00:00Z",
+		},
+		{
+			name:    "grace_before_older_than",
+			policy:  &Policy{Grace: 30 * 24 * time.Hour, OlderThan: olderThan},
+			exp:     now.Add(-30 * 24 * time.Hour),
+			expFrom: "grace 720h0m0s",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			since, from := tc.policy.sinceFor(now, nil)
+			if got, want := since, tc.exp; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+			if got, want := from, tc.expFrom; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+			if got, want := tc.policy.Since(now), tc.exp; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
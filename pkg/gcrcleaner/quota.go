@@ -0,0 +1,254 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// sizeRe matches a size with an optional unit.
+var sizeRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z]*)$`)
+
+// sizeUnits are the multipliers of the supported size units, in lowercase.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a size in bytes with an optional decimal (e.g. "50GB") or
+// binary (e.g. "50GiB") unit. Units are case-insensitive.
+func ParseSize(s string) (int64, error) {
+	matches := sizeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit, ok := sizeUnits[strings.ToLower(matches[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, matches[2])
+	}
+
+	n, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return int64(n * unit), nil
+}
+
+// FormatSize formats a size in bytes with a binary unit, such as "49.8 GiB".
+func FormatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	v := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		v /= unit
+		if (v < unit && v > -unit) || suffix == "TiB" {
+			return fmt.Sprintf("%.1f %s", v, suffix)
+		}
+	}
+	panic("unreachable")
+}
+
+// byteSize is a size in bytes that is a number or a string like "50GiB" in
+// JSON.
+type byteSize int64
+
+func (s byteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(s))
+}
+
+func (s *byteSize) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case float64:
+		*s = byteSize(val)
+		return nil
+	case string:
+		n, err := ParseSize(val)
+		if err != nil {
+			return err
+		}
+		*s = byteSize(n)
+		return nil
+	default:
+		return fmt.Errorf("invalid size type %T", val)
+	}
+}
+
+// RepoSize is the deduplicated storage size of a repository before and after
+// cleaning, in quota mode.
+type RepoSize struct {
+	// Before is the size before cleaning, in bytes.
+	Before int64 `json:"before"`
+
+	// After is the size after cleaning, or after the planned deletions in
+	// dry-run mode, in bytes.
+	After int64 `json:"after"`
+
+	// Reclaimable is the storage that cleaning frees, in bytes. It only counts
+	// the blobs that no remaining manifest references.
+	Reclaimable int64 `json:"reclaimable"`
+
+	// Quota is the quota of the repository in quota mode, in bytes.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// String returns a human-readable description of the sizes.
+func (s *RepoSize) String() string {
+	str := fmt.Sprintf("%s -> %s, %s reclaimable",
+		FormatSize(s.Before), FormatSize(s.After), FormatSize(s.Reclaimable))
+	if s.Quota > 0 {
+		str += fmt.Sprintf(" (quota %s)", FormatSize(s.Quota))
+	}
+	return str
+}
+
+// measureSizes computes the size of the repository before and after the given
+// manifests are deleted. The blobs of manifests that were not fetched yet are
+// fetched first. Deleted manifests are dropped one by one, since the plan
+// already includes their children and artifacts.
+func (c *Cleaner) measureSizes(ctx context.Context, gcrrepo gcrname.Repository, manifests []*manifest, graph *manifestGraph, deleted []*manifest, quota int64) (*RepoSize, error) {
+	var missing []*manifest
+	for _, m := range manifests {
+		if m.Blobs == nil {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) > 0 {
+		if err := c.fetchMetadata(ctx, gcrrepo, missing, false); err != nil {
+			return nil, fmt.Errorf("failed to fetch manifest sizes: %w", err)
+		}
+	}
+
+	sizes := newRepoSizes(manifests, graph)
+	before := sizes.size()
+	for _, m := range deleted {
+		sizes.drop(m)
+	}
+	after := sizes.size()
+
+	return &RepoSize{
+		Before:      before,
+		After:       after,
+		Reclaimable: before - after,
+		Quota:       quota,
+	}, nil
+}
+
+// repoSizes tracks the deduplicated size of the blobs of the manifests in a
+// repository as manifests are removed. Layers shared by several images count
+// once, and only stop counting when every manifest that uses them is removed.
+type repoSizes struct {
+	graph     *manifestGraph
+	manifests map[string]*manifest
+
+	refs    map[string]int
+	sizes   map[string]int64
+	removed map[string]struct{}
+	total   int64
+}
+
+// newRepoSizes computes the size of the given manifests. The blobs of each
+// manifest must have been fetched.
+func newRepoSizes(manifests []*manifest, graph *manifestGraph) *repoSizes {
+	s := &repoSizes{
+		graph:     graph,
+		manifests: make(map[string]*manifest, len(manifests)),
+		refs:      make(map[string]int, len(manifests)*4),
+		sizes:     make(map[string]int64, len(manifests)*4),
+		removed:   make(map[string]struct{}, len(manifests)),
+	}
+
+	for _, m := range manifests {
+		s.manifests[m.Digest] = m
+		for blob, size := range m.Blobs {
+			if s.refs[blob] == 0 {
+				s.sizes[blob] = size
+				s.total += size
+			}
+			s.refs[blob]++
+		}
+	}
+	return s
+}
+
+// remove removes the manifest with its untagged children that no other
+// remaining index references, and its supporting artifacts.
+func (s *repoSizes) remove(digest string) {
+	m, ok := s.manifests[digest]
+	if _, removed := s.removed[digest]; !ok || removed {
+		return
+	}
+	s.drop(m)
+
+	for _, artifact := range s.graph.referrers[digest] {
+		s.remove(artifact)
+	}
+
+CHILDREN:
+	for _, child := range s.graph.children[digest] {
+		cm, ok := s.manifests[child]
+		if !ok || !s.graph.isChild(cm) {
+			continue
+		}
+		for _, parent := range s.graph.parents[child] {
+			if _, ok := s.removed[parent]; !ok {
+				continue CHILDREN
+			}
+		}
+		s.remove(child)
+	}
+}
+
+// drop removes only the given manifest.
+func (s *repoSizes) drop(m *manifest) {
+	if _, ok := s.removed[m.Digest]; ok {
+		return
+	}
+	s.removed[m.Digest] = struct{}{}
+	for blob := range m.Blobs {
+		s.refs[blob]--
+		if s.refs[blob] == 0 {
+			s.total -= s.sizes[blob]
+		}
+	}
+}
+
+// size returns the current size of the repository.
+func (s *repoSizes) size() int64 {
+	return s.total
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   string
+		exp  int64
+		err  bool
+	}{
+		{
+			name: "bytes",
+			in:   "1024",
+			exp:  1024,
+		},
+		{
+			name: "decimal",
+			in:   "50GB",
+			exp:  50_000_000_000,
+		},
+		{
+			name: "binary",
+			in:   "50GiB",
+			exp:  50 << 30,
+		},
+		{
+			name: "lowercase_with_space",
+			in:   "1.5 mib",
+			exp:  3 << 19,
+		},
+		{
+			name: "unknown_unit",
+			in:   "50XB",
+			err:  true,
+		},
+		{
+			name: "negative",
+			in:   "-1GB",
+			err:  true,
+		},
+		{
+			name: "empty",
+			in:   "",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			n, err := ParseSize(tc.in)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := n, tc.exp; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in  int64
+		exp string
+	}{
+		{in: 0, exp: "0 B"},
+		{in: 1023, exp: "1023 B"},
+		{in: 1536, exp: "1.5 KiB"},
+		{in: 50 << 30, exp: "50.0 GiB"},
+		{in: 2048 << 40, exp: "2048.0 TiB"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.exp, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := FormatSize(tc.in), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRepoSizes(t *testing.T) {
+	t.Parallel()
+
+	// index -> (amd64, arm64), shared -> (arm64), indexSig -> index
+	graph := newManifestGraph()
+	graph.addEdge("index", "amd64")
+	graph.addEdge("index", "arm64")
+	graph.addEdge("shared", "arm64")
+	graph.addSubject("indexSig", "index")
+
+	manifests := []*manifest{
+		{Digest: "index", Blobs: map[string]int64{"index": 1}},
+		{Digest: "amd64", Blobs: map[string]int64{"amd64": 1, "base": 100, "amd64Layer": 10}},
+		{Digest: "arm64", Blobs: map[string]int64{"arm64": 1, "base": 100, "arm64Layer": 20}},
+		{Digest: "shared", Blobs: map[string]int64{"shared": 1}},
+		{Digest: "indexSig", Blobs: map[string]int64{"indexSig": 1, "sig": 5}},
+	}
+
+	sizes := newRepoSizes(manifests, graph)
+	if got, want := sizes.size(), int64(140); got != want {
+		t.Fatalf("expected %d to be %d", got, want)
+	}
+
+	// The signature and the amd64 child go with the index, but arm64 is still
+	// referenced by the other index and keeps the shared base layer.
+	sizes.remove("index")
+	if got, want := sizes.size(), int64(122); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	sizes.remove("shared")
+	if got, want := sizes.size(), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+
+	// Removing a manifest twice does not count its blobs twice.
+	sizes.remove("shared")
+	if got, want := sizes.size(), int64(0); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestCleaner_CleanWithResult_Size(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	digest := func(c string) string {
+		return "sha256:" + strings.Repeat(c, 64)
+	}
+	aa, bb := digest("a"), digest("b")
+
+	// Both images share the base layer, so deleting bb only reclaims its config,
+	// its own layer, and the manifest itself.
+	manifest := func(d, config, layer string) *RawManifest {
+		return &RawManifest{
+			Digest:    d,
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Body: []byte(fmt.Sprintf(`{"schemaVersion":2,`+
+				`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":10},`+
+				`"layers":[`+
+				`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":1000},`+
+				`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":100}]}`,
+				config, digest("0"), layer)),
+		}
+	}
+	rawA := manifest(aa, digest("1"), digest("2"))
+	rawB := manifest(bb, digest("3"), digest("4"))
+
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {Created: old, Uploaded: old, Tags: []string{"latest"}},
+			bb: {Created: old, Uploaded: old},
+		},
+		raw: map[string]*RawManifest{
+			aa: rawA,
+			bb: rawB,
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := int64(len(rawA.Body)+len(rawB.Body)) + 1000 + 2*110
+	reclaimable := int64(len(rawB.Body)) + 110
+	want := &RepoSize{
+		Before:      before,
+		After:       before - reclaimable,
+		Reclaimable: reclaimable,
+	}
+	if got := result.Size; got == nil || *got != *want {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+}
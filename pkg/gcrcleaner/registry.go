@@ -0,0 +1,350 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// Registry is the interface the cleaner uses to talk to a container registry.
+// Implementations must be safe for concurrent use.
+type Registry interface {
+	// ListManifests lists every manifest in the repository, keyed by digest.
+	ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error)
+
+	// DeleteTag deletes the tag, but not the manifest it points to.
+	DeleteTag(ctx context.Context, tag gcrname.Tag) error
+
+	// DeleteDigest deletes the manifest. All tags pointing to the manifest have
+	// already been deleted.
+	DeleteDigest(ctx context.Context, digest gcrname.Digest) error
+
+	// Catalog lists the names of all repositories in the registry, without the
+	// registry prefix.
+	Catalog(ctx context.Context, registry gcrname.Registry) ([]string, error)
+
+	// FetchManifest fetches the raw manifest for the reference.
+	FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error)
+}
+
+// ManifestInfo is the metadata about a single manifest in a repository.
+type ManifestInfo struct {
+	// Size is the size of the image in bytes.
+	Size uint64
+
+	// MediaType is the media type of the manifest.
+	MediaType string
+
+	// ArtifactType is the artifact type of the manifest, if the registry
+	// reports it. Container images have none.
+	ArtifactType string
+
+	// Created is the time the image was created.
+	Created time.Time
+
+	// Uploaded is the time the image was uploaded to the registry.
+	Uploaded time.Time
+
+	// Tags is the list of tags that point to the manifest.
+	Tags []string
+
+	// Labels are the annotations of the manifest and the labels of the image
+	// config, if the registry reports them. Annotations take precedence.
+	Labels map[string]string
+}
+
+// RawManifest is a manifest as returned by the registry.
+type RawManifest struct {
+	// Digest is the digest of the manifest.
+	Digest string
+
+	// MediaType is the media type of the manifest.
+	MediaType string
+
+	// Body is the raw manifest contents.
+	Body []byte
+}
+
+// BatchDeleter is implemented by registries that can delete many tags and
+// digests in a single request. The cleaner uses it instead of DeleteTag and
+// DeleteDigest when the registry for a repository supports it.
+type BatchDeleter interface {
+	// DeleteBatch deletes the refs, which are all in the same repository. It
+	// returns a slice of the same length as refs with the error for each ref,
+	// or nil if the ref was deleted.
+	DeleteBatch(ctx context.Context, refs []gcrname.Reference) []error
+}
+
+// BlobFetcher is implemented by registries that can fetch blobs by digest.
+// The cleaner uses it to read the labels in image configs.
+type BlobFetcher interface {
+	// FetchBlob fetches the contents of the blob.
+	FetchBlob(ctx context.Context, digest gcrname.Digest) ([]byte, error)
+}
+
+// ErrUntagUnsupported is returned by DeleteTag when the registry can only
+// remove a tag by deleting the manifest it points to.
+var ErrUntagUnsupported = errors.New("registry cannot remove a tag without deleting its manifest")
+
+// Untagger is implemented by registries that report whether they can remove a
+// single tag. Registries that do not implement it are assumed to be able to.
+type Untagger interface {
+	// CanUntag returns false if DeleteTag returns ErrUntagUnsupported, because
+	// tags are only removed when their manifest is deleted.
+	CanUntag() bool
+}
+
+// ReferrersLister is implemented by registries that can list the referrers of
+// a manifest, such as with the OCI referrers API. The cleaner uses it to find
+// untagged signatures, attestations, and SBOMs without fetching every untagged
+// manifest.
+type ReferrersLister interface {
+	// ListReferrers returns the digests of the manifests whose subject is the
+	// given manifest. It returns ErrReferrersUnsupported if the registry does
+	// not support listing referrers for the repository.
+	ListReferrers(ctx context.Context, subject gcrname.Digest) ([]string, error)
+}
+
+// ErrReferrersUnsupported is returned by ReferrersLister when the registry does
+// not implement the referrers API.
+var ErrReferrersUnsupported = errors.New("registry does not support the referrers API")
+
+// ScopedCataloger is implemented by registries that can list the repositories
+// under a path without listing the entire registry.
+type ScopedCataloger interface {
+	// CatalogScope lists the repositories under the given path in the registry
+	// (e.g. "my-project"). Like Catalog, the repositories do not include the
+	// registry host.
+	CatalogScope(ctx context.Context, registry gcrname.Registry, scope string) ([]string, error)
+}
+
+// registryFor returns the registry that handles the given host. If the
+// registry is a RegistryRouter, this is the routed registry.
+func registryFor(registry Registry, host string) Registry {
+	if router, ok := registry.(*RegistryRouter); ok {
+		return router.For(host)
+	}
+	return registry
+}
+
+// batchDeleterFor returns the BatchDeleter for the repository, if the registry
+// that handles the repository supports batch deletion.
+func batchDeleterFor(registry Registry, repo gcrname.Repository) (BatchDeleter, bool) {
+	batch, ok := registryFor(registry, repo.RegistryStr()).(BatchDeleter)
+	return batch, ok
+}
+
+// blobFetcherFor returns the BlobFetcher for the repository, if the registry
+// that handles the repository supports fetching blobs.
+func blobFetcherFor(registry Registry, repo gcrname.Repository) (BlobFetcher, bool) {
+	blobs, ok := registryFor(registry, repo.RegistryStr()).(BlobFetcher)
+	return blobs, ok
+}
+
+// fetchBlob fetches the blob using the registry, if it supports fetching
+// blobs. Registries that delegate manifest requests to another registry use it
+// to delegate blob requests too.
+func fetchBlob(ctx context.Context, registry Registry, digest gcrname.Digest) ([]byte, error) {
+	blobs, ok := registry.(BlobFetcher)
+	if !ok {
+		return nil, fmt.Errorf("registry does not support fetching blobs")
+	}
+	return blobs.FetchBlob(ctx, digest)
+}
+
+// canUntag returns true if the registry for the repository can remove a single
+// tag.
+func canUntag(registry Registry, repo gcrname.Repository) bool {
+	untagger, ok := registryFor(registry, repo.RegistryStr()).(Untagger)
+	return !ok || untagger.CanUntag()
+}
+
+// referrersListerFor returns the ReferrersLister for the repository, if the
+// registry that handles the repository supports listing referrers.
+func referrersListerFor(registry Registry, repo gcrname.Repository) (ReferrersLister, bool) {
+	referrers, ok := registryFor(registry, repo.RegistryStr()).(ReferrersLister)
+	return referrers, ok
+}
+
+// listReferrers lists the referrers using the registry, if it supports listing
+// referrers. Registries that delegate manifest requests to another registry
+// use it to delegate referrers requests too.
+func listReferrers(ctx context.Context, registry Registry, subject gcrname.Digest) ([]string, error) {
+	referrers, ok := registry.(ReferrersLister)
+	if !ok {
+		return nil, ErrReferrersUnsupported
+	}
+	return referrers.ListReferrers(ctx, subject)
+}
+
+// scopedCatalogerFor returns the ScopedCataloger for the registry, if the
+// registry that handles it supports scoped listing.
+func scopedCatalogerFor(registry Registry, host gcrname.Registry) (ScopedCataloger, bool) {
+	scoped, ok := registryFor(registry, host.RegistryStr()).(ScopedCataloger)
+	return scoped, ok
+}
+
+var _ Registry = (*RegistryRouter)(nil)
+
+// RegistryRouter is a Registry that dispatches each call to another Registry
+// based on the registry host of the repository. Hosts that do not match any
+// route use the fallback.
+type RegistryRouter struct {
+	routes   []*registryRoute
+	fallback Registry
+}
+
+type registryRoute struct {
+	pattern  string
+	registry Registry
+}
+
+// NewRegistryRouter creates a new router with the given fallback registry.
+func NewRegistryRouter(fallback Registry) *RegistryRouter {
+	return &RegistryRouter{fallback: fallback}
+}
+
+// Handle routes all repositories whose registry host matches the pattern to
+// the given registry. Patterns use shell syntax (e.g.
+// "*.dkr.ecr.*.amazonaws.com"). Routes are evaluated in the order in which
+// they were added.
+func (r *RegistryRouter) Handle(pattern string, registry Registry) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+	}
+
+	r.routes = append(r.routes, &registryRoute{
+		pattern:  pattern,
+		registry: registry,
+	})
+	return nil
+}
+
+// For returns the registry that handles the given host.
+func (r *RegistryRouter) For(host string) Registry {
+	for _, route := range r.routes {
+		if ok, _ := path.Match(route.pattern, host); ok {
+			return route.registry
+		}
+	}
+	return r.fallback
+}
+
+// ListManifests lists manifests using the registry for the repository's host.
+func (r *RegistryRouter) ListManifests(ctx context.Context, repo gcrname.Repository) (map[string]ManifestInfo, error) {
+	return r.For(repo.RegistryStr()).ListManifests(ctx, repo)
+}
+
+// DeleteTag deletes the tag using the registry for the tag's host.
+func (r *RegistryRouter) DeleteTag(ctx context.Context, tag gcrname.Tag) error {
+	return r.For(tag.RegistryStr()).DeleteTag(ctx, tag)
+}
+
+// DeleteDigest deletes the manifest using the registry for the digest's host.
+func (r *RegistryRouter) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	return r.For(digest.RegistryStr()).DeleteDigest(ctx, digest)
+}
+
+// Catalog lists repositories using the registry for the host.
+func (r *RegistryRouter) Catalog(ctx context.Context, registry gcrname.Registry) ([]string, error) {
+	return r.For(registry.RegistryStr()).Catalog(ctx, registry)
+}
+
+// FetchManifest fetches the manifest using the registry for the reference's
+// host.
+func (r *RegistryRouter) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	return r.For(ref.Context().RegistryStr()).FetchManifest(ctx, ref)
+}
+
+// RegistryConfig is the configuration for NewRegistry.
+type RegistryConfig struct {
+	// DockerHub, if set, enables deleting from Docker Hub with the Docker Hub
+	// API. Otherwise Docker Hub repositories use the registry API, which cannot
+	// delete.
+	DockerHub *DockerHubConfig
+
+	// GHCR is the configuration for ghcr.io. The default resolves the token from
+	// the keychain.
+	GHCR *GHCRConfig
+
+	// ArtifactRegistryAPI uses the Artifact Registry API instead of the Docker
+	// API for Artifact Registry repositories.
+	ArtifactRegistryAPI bool
+
+	// ECRAPI uses the ECR API, with the AWS SDK credential chain, instead of the
+	// Docker API and the keychain for Amazon ECR repositories.
+	ECRAPI bool
+}
+
+// NewRegistry creates a router for every supported registry. Docker Hub,
+// ghcr.io, and, if enabled, Amazon ECR and Artifact Registry use their own
+// APIs, and all other hosts use the registry API.
+func NewRegistry(cfg *RegistryConfig, keychain gcrauthn.Keychain, logger *Logger, concurrency int64) (*RegistryRouter, error) {
+	if cfg == nil {
+		cfg = new(RegistryConfig)
+	}
+
+	remote := NewRemoteRegistry(keychain, logger, concurrency)
+	router := NewRegistryRouter(remote)
+
+	if cfg.DockerHub != nil {
+		hub, err := NewDockerHubRegistry(cfg.DockerHub, remote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create docker hub registry: %w", err)
+		}
+		for _, host := range DockerHubHosts {
+			if err := router.Handle(host, hub); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ghcrConfig := cfg.GHCR
+	if ghcrConfig == nil {
+		ghcrConfig = new(GHCRConfig)
+	}
+	ghcr, err := NewGHCRRegistry(ghcrConfig, keychain, logger, concurrency, remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ghcr.io registry: %w", err)
+	}
+	if err := router.Handle(GHCRHost, ghcr); err != nil {
+		return nil, err
+	}
+
+	if cfg.ECRAPI {
+		ecr := NewECRRegistry(nil)
+		for _, pattern := range ECRHostPatterns {
+			if err := router.Handle(pattern, ecr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.ArtifactRegistryAPI {
+		ar := NewArtifactRegistry(nil, keychain, logger, concurrency, remote)
+		if err := router.Handle(ArtifactRegistryHostPattern, ar); err != nil {
+			return nil, err
+		}
+	}
+
+	return router, nil
+}
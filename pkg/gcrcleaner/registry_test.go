@@ -0,0 +1,333 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+var (
+	_ Registry    = (*fakeRegistry)(nil)
+	_ BlobFetcher = (*fakeRegistry)(nil)
+)
+
+// fakeRegistry is an in-memory Registry that records deletions.
+type fakeRegistry struct {
+	manifests map[string]ManifestInfo
+	raw       map[string]*RawManifest
+	blobs     map[string][]byte
+	repos     []string
+
+	lock    sync.Mutex
+	deleted []string
+	fetched []string
+}
+
+func (r *fakeRegistry) ListManifests(_ context.Context, _ gcrname.Repository) (map[string]ManifestInfo, error) {
+	return r.manifests, nil
+}
+
+func (r *fakeRegistry) DeleteTag(_ context.Context, tag gcrname.Tag) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.deleted = append(r.deleted, tag.TagStr())
+	return nil
+}
+
+func (r *fakeRegistry) DeleteDigest(_ context.Context, digest gcrname.Digest) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.deleted = append(r.deleted, digest.DigestStr())
+	return nil
+}
+
+func (r *fakeRegistry) Catalog(_ context.Context, _ gcrname.Registry) ([]string, error) {
+	return r.repos, nil
+}
+
+func (r *fakeRegistry) FetchManifest(_ context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	r.lock.Lock()
+	r.fetched = append(r.fetched, ref.Identifier())
+	r.lock.Unlock()
+
+	raw, ok := r.raw[ref.Identifier()]
+	if !ok {
+		return nil, fmt.Errorf("manifest %s not found", ref)
+	}
+	return raw, nil
+}
+
+func (r *fakeRegistry) FetchBlob(_ context.Context, digest gcrname.Digest) ([]byte, error) {
+	b, ok := r.blobs[digest.DigestStr()]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", digest)
+	}
+	return b, nil
+}
+
+func TestCleaner_WithRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	cc := "sha256:" + strings.Repeat("c", 64)
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: "application/vnd.oci.image.index.v1+json", Created: old, Uploaded: old, Tags: []string{"v1"}},
+			bb: {MediaType: "application/vnd.oci.image.manifest.v1+json", Created: old, Uploaded: old},
+			cc: {MediaType: "application/vnd.oci.image.manifest.v1+json", Created: old, Uploaded: old},
+		},
+		raw: map[string]*RawManifest{
+			aa: {
+				Digest:    aa,
+				MediaType: "application/vnd.oci.image.index.v1+json",
+				Body:      []byte(`{"schemaVersion":2,"manifests":[{"digest":"` + bb + `"}]}`),
+			},
+			cc: {
+				Digest:    cc,
+				MediaType: "application/vnd.oci.image.manifest.v1+json",
+				Body:      []byte(`{"schemaVersion":2}`),
+			},
+		},
+		repos: []string{"team/b", "team/c", "other"},
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+
+	deleted, err := c.CleanPolicy(ctx, "registry.example/a/b", &Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the loose untagged manifest is deleted. The child of the tagged
+	// index is protected.
+	if got, want := len(deleted), 1; got != want {
+		t.Fatalf("expected %d deleted refs to be %d: %q", got, want, deleted)
+	}
+	if got, want := registry.deleted, []string{cc}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	repos, err := c.ListChildRepositories(ctx, []string{"registry.example/team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := repos, []string{"registry.example/team/b", "registry.example/team/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	t.Parallel()
+
+	logger := NewLogger("error", io.Discard, io.Discard)
+	keychain := gcrauthn.NewMultiKeychain()
+
+	cases := []struct {
+		name string
+		cfg  *RegistryConfig
+		host string
+		exp  string
+	}{
+		{
+			name: "default",
+			cfg:  nil,
+			host: "gcr.io",
+			exp:  "*gcrcleaner.RemoteRegistry",
+		},
+		{
+			name: "ghcr",
+			cfg:  nil,
+			host: "ghcr.io",
+			exp:  "*gcrcleaner.GHCRRegistry",
+		},
+		{
+			name: "ecr_disabled",
+			cfg:  nil,
+			host: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			exp:  "*gcrcleaner.RemoteRegistry",
+		},
+		{
+			name: "ecr",
+			cfg:  &RegistryConfig{ECRAPI: true},
+			host: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			exp:  "*gcrcleaner.ECRRegistry",
+		},
+		{
+			name: "ecr_fips",
+			cfg:  &RegistryConfig{ECRAPI: true},
+			host: "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com",
+			exp:  "*gcrcleaner.ECRRegistry",
+		},
+		{
+			name: "ecr_china",
+			cfg:  &RegistryConfig{ECRAPI: true},
+			host: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			exp:  "*gcrcleaner.ECRRegistry",
+		},
+		{
+			name: "docker_hub_disabled",
+			cfg:  nil,
+			host: "index.docker.io",
+			exp:  "*gcrcleaner.RemoteRegistry",
+		},
+		{
+			name: "docker_hub",
+			cfg: &RegistryConfig{
+				DockerHub: &DockerHubConfig{Username: "user", Token: "token", Namespaces: []string{"org"}},
+			},
+			host: "index.docker.io",
+			exp:  "*gcrcleaner.DockerHubRegistry",
+		},
+		{
+			name: "artifact_registry_disabled",
+			cfg:  nil,
+			host: "us-docker.pkg.dev",
+			exp:  "*gcrcleaner.RemoteRegistry",
+		},
+		{
+			name: "artifact_registry",
+			cfg:  &RegistryConfig{ArtifactRegistryAPI: true},
+			host: "us-docker.pkg.dev",
+			exp:  "*gcrcleaner.ArtifactRegistry",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			router, err := NewRegistry(tc.cfg, keychain, logger, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%T", router.For(tc.host)), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+// tagsWithManifestRegistry is a fakeRegistry that can only remove tags by
+// deleting their manifest, like ghcr.io.
+type tagsWithManifestRegistry struct {
+	*fakeRegistry
+}
+
+func (r *tagsWithManifestRegistry) DeleteTag(_ context.Context, _ gcrname.Tag) error {
+	return ErrUntagUnsupported
+}
+
+func (r *tagsWithManifestRegistry) CanUntag() bool {
+	return false
+}
+
+func TestCleaner_CleanWithResult_CannotUntag(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-1"}},
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(&tagsWithManifestRegistry{registry}))
+
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{
+		TagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag is reported as deleted with its manifest.
+	got := make([]string, 0, len(result.Deleted))
+	for _, ref := range result.Deleted {
+		got = append(got, ref.Ref)
+	}
+	if want := []string{"pr-1", aa}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := registry.deleted, []string{aa}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestCleaner_CleanWithResult_CannotUntag_UntagOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	old := time.Now().UTC().Add(-time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-1", "v1"}},
+			bb: {MediaType: mediaType, Created: old, Uploaded: old, Tags: []string{"pr-2"}},
+		},
+	}
+
+	c := newTestCleaner(t, WithRegistry(&tagsWithManifestRegistry{registry}))
+
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{
+		TagFilter: &TagFilterAny{re: regexp.MustCompile("^pr-")},
+		UntagOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image that would only lose a tag is kept with all of its tags.
+	got := make([]string, 0, len(result.Deleted))
+	for _, ref := range result.Deleted {
+		got = append(got, ref.Ref)
+	}
+	if want := []string{"pr-2", bb}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	if got, want := len(result.Kept), 1; got != want {
+		t.Fatalf("expected %d kept refs to be %d", got, want)
+	}
+	if got, want := result.Kept[0].Digest, aa; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := result.Kept[0].NotUntagged, []string{"pr-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
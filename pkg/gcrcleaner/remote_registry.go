@@ -0,0 +1,393 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// annotationCreated is the OCI pre-defined annotation for the date and time
+// on which the image was built.
+const annotationCreated = "org.opencontainers.image.created"
+
+var (
+	_ Registry        = (*RemoteRegistry)(nil)
+	_ BlobFetcher     = (*RemoteRegistry)(nil)
+	_ ReferrersLister = (*RemoteRegistry)(nil)
+)
+
+// RemoteRegistry is the default Registry. It talks to Container Registry,
+// Artifact Registry, and any other Docker Registry v2 / OCI distribution
+// registry using the registry HTTP API.
+type RemoteRegistry struct {
+	keychain    gcrauthn.Keychain
+	logger      *Logger
+	concurrency int64
+}
+
+// NewRemoteRegistry creates a new registry that authenticates using the given
+// keychain.
+func NewRemoteRegistry(keychain gcrauthn.Keychain, logger *Logger, concurrency int64) *RemoteRegistry {
+	return &RemoteRegistry{
+		keychain:    keychain,
+		logger:      logger,
+		concurrency: concurrency,
+	}
+}
+
+// ListManifests lists all manifests in the repository with their metadata.
+// Container Registry and Artifact Registry include the manifest metadata
+// (including timestamps) in their tags list response. If that extension is
+// missing, the repository is on a standard distribution registry and the
+// metadata is resolved from each manifest instead.
+func (r *RemoteRegistry) ListManifests(ctx context.Context, gcrrepo gcrname.Repository) (map[string]ManifestInfo, error) {
+	tags, err := gcrgoogle.List(gcrrepo,
+		gcrgoogle.WithContext(ctx),
+		gcrgoogle.WithUserAgent(userAgent),
+		gcrgoogle.WithAuthFromKeychain(r.keychain))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tags.Manifests) > 0 || len(tags.Tags) == 0 {
+		manifests := make(map[string]ManifestInfo, len(tags.Manifests))
+		for digest, m := range tags.Manifests {
+			manifests[digest] = ManifestInfo{
+				Size:      m.Size,
+				MediaType: m.MediaType,
+				Created:   m.Created,
+				Uploaded:  m.Uploaded,
+				Tags:      m.Tags,
+			}
+		}
+		return manifests, nil
+	}
+
+	r.logger.Debug("registry does not include manifest metadata, resolving manifests",
+		"repo", gcrrepo.Name(),
+		"tags", len(tags.Tags))
+	return r.listDistributionManifests(ctx, gcrrepo, tags.Tags)
+}
+
+// DeleteTag deletes the tag.
+func (r *RemoteRegistry) DeleteTag(ctx context.Context, tag gcrname.Tag) error {
+	return gcrremote.Delete(tag, r.remoteOptions(ctx)...)
+}
+
+// DeleteDigest deletes the manifest.
+func (r *RemoteRegistry) DeleteDigest(ctx context.Context, digest gcrname.Digest) error {
+	return gcrremote.Delete(digest, r.remoteOptions(ctx)...)
+}
+
+// Catalog lists all repositories in the registry.
+func (r *RemoteRegistry) Catalog(ctx context.Context, registry gcrname.Registry) ([]string, error) {
+	return gcrremote.Catalog(ctx, registry, r.remoteOptions(ctx)...)
+}
+
+// FetchManifest fetches the manifest for the reference.
+func (r *RemoteRegistry) FetchManifest(ctx context.Context, ref gcrname.Reference) (*RawManifest, error) {
+	desc, err := gcrremote.Get(ref, r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawManifest{
+		Digest:    desc.Digest.String(),
+		MediaType: string(desc.MediaType),
+		Body:      desc.Manifest,
+	}, nil
+}
+
+// ListReferrers lists the referrers of the manifest with the referrers API.
+// Registries without the API, such as Container Registry, return
+// ErrReferrersUnsupported, since referrers there are found by their fallback
+// tags.
+func (r *RemoteRegistry) ListReferrers(ctx context.Context, subject gcrname.Digest) ([]string, error) {
+	idx, err := gcrremote.Referrers(subject, r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Referrers falls back to the referrers tag schema if the API is missing,
+	// and returns the empty index if that tag does not exist either. Fallback
+	// tags are already in the tags list, so only the API is of interest.
+	if idx == gcrempty.Index {
+		return nil, ErrReferrersUnsupported
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse referrers of %s: %w", subject, err)
+	}
+
+	digests := make([]string, 0, len(im.Manifests))
+	for _, desc := range im.Manifests {
+		digests = append(digests, desc.Digest.String())
+	}
+	return digests, nil
+}
+
+// FetchBlob fetches the blob with the given digest.
+func (r *RemoteRegistry) FetchBlob(ctx context.Context, digest gcrname.Digest) ([]byte, error) {
+	layer, err := gcrremote.Layer(digest, r.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// listDistributionManifests builds the manifest metadata for a standard Docker
+// Registry v2 / OCI distribution registry. Each tag is resolved to its digest,
+// and the creation time is read from the "org.opencontainers.image.created"
+// annotation or from the "created" field of the image config. Image indexes use
+// the newest creation time of their children. Untagged children of image
+// indexes are included, since the registry has no other way to list them. The
+// registry does not record upload times, so the uploaded time is the created
+// time, or unknown (zero) if the creation time is missing or predates Docker,
+// as with reproducible builds.
+func (r *RemoteRegistry) listDistributionManifests(ctx context.Context, gcrrepo gcrname.Repository, tags []string) (map[string]ManifestInfo, error) {
+	// Resolve all tags to digests.
+	type taggedDigest struct {
+		tag    string
+		digest string
+	}
+
+	tw := worker.New[*taggedDigest](r.concurrency)
+	for _, tag := range tags {
+		tag := tag
+
+		if err := tw.Do(ctx, func() (*taggedDigest, error) {
+			ref := gcrrepo.Tag(tag)
+			desc, err := gcrremote.Head(ref, r.remoteOptions(ctx)...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve tag %s: %w", ref, err)
+			}
+			return &taggedDigest{tag: tag, digest: desc.Digest.String()}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	tagResults, err := tw.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tagsByDigest := make(map[string][]string, len(tagResults))
+	errs := make([]error, 0, len(tagResults))
+	for _, result := range tagResults {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+		tagsByDigest[result.Value.digest] = append(tagsByDigest[result.Value.digest], result.Value.tag)
+	}
+	if err := ErrsToError(errs); err != nil {
+		return nil, err
+	}
+
+	// Describe each unique digest.
+	dw := worker.New[map[string]ManifestInfo](r.concurrency)
+	for digest := range tagsByDigest {
+		digest := digest
+
+		if err := dw.Do(ctx, func() (map[string]ManifestInfo, error) {
+			infos := make(map[string]ManifestInfo, 1)
+			if _, err := r.describeManifest(ctx, gcrrepo, digest, infos); err != nil {
+				return nil, err
+			}
+			return infos, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	digestResults, err := dw.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]ManifestInfo, len(tagsByDigest))
+	for _, result := range digestResults {
+		if result.Error != nil {
+			errs = append(errs, result.Error)
+			continue
+		}
+		for digest, info := range result.Value {
+			manifests[digest] = info
+		}
+	}
+	if err := ErrsToError(errs); err != nil {
+		return nil, err
+	}
+
+	for digest, tags := range tagsByDigest {
+		info := manifests[digest]
+		sort.Strings(tags)
+		info.Tags = tags
+		manifests[digest] = info
+	}
+	return manifests, nil
+}
+
+// describeManifest fetches the manifest with the given digest and records its
+// metadata (and the metadata of any children) in infos. It returns the
+// creation time of the manifest.
+func (r *RemoteRegistry) describeManifest(ctx context.Context, gcrrepo gcrname.Repository, digest string, infos map[string]ManifestInfo) (time.Time, error) {
+	if info, ok := infos[digest]; ok {
+		return info.Created, nil
+	}
+
+	ref := gcrrepo.Digest(digest)
+	desc, err := gcrremote.Get(ref, r.remoteOptions(ctx)...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch manifest %s: %w", ref, err)
+	}
+
+	info := ManifestInfo{
+		MediaType:    string(desc.MediaType),
+		ArtifactType: artifactType(desc.Manifest),
+	}
+
+	switch {
+	case desc.MediaType.IsIndex():
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read image index %s: %w", ref, err)
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse image index %s: %w", ref, err)
+		}
+
+		info.Created = parseCreatedAnnotation(im.Annotations)
+		info.Labels = mergeLabels(nil, im.Annotations)
+		for _, child := range im.Manifests {
+			childCreated, err := r.describeManifest(ctx, gcrrepo, child.Digest.String(), infos)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if im.Annotations[annotationCreated] == "" && childCreated.After(info.Created) {
+				info.Created = childCreated
+			}
+			info.Size += infos[child.Digest.String()].Size
+		}
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read image %s: %w", ref, err)
+		}
+		m, err := img.Manifest()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse image %s: %w", ref, err)
+		}
+
+		info.Created = parseCreatedAnnotation(m.Annotations)
+		info.Labels = mergeLabels(nil, m.Annotations)
+		if info.Created.IsZero() {
+			// Artifacts that use an image manifest may not have a valid image
+			// config, which is not fatal.
+			cfg, err := img.ConfigFile()
+			if err != nil {
+				r.logger.Debug("failed to read image config",
+					"ref", ref.String(),
+					"error", err)
+			} else {
+				info.Created = cfg.Created.Time
+				info.Labels = mergeLabels(cfg.Config.Labels, m.Annotations)
+			}
+		}
+		for _, layer := range m.Layers {
+			info.Size += uint64(layer.Size)
+		}
+	default:
+		// Other artifacts have no standard place for a creation time other than
+		// the annotation.
+		m, err := gcrv1.ParseManifest(bytes.NewReader(desc.Manifest))
+		if err == nil {
+			info.Created = parseCreatedAnnotation(m.Annotations)
+			info.Labels = mergeLabels(nil, m.Annotations)
+		}
+	}
+
+	info.Created = info.Created.UTC()
+	if !info.Created.Before(dockerExistence) {
+		info.Uploaded = info.Created
+	}
+	infos[digest] = info
+	return info.Created, nil
+}
+
+// parseCreatedAnnotation returns the value of the created annotation, or the
+// zero time if it is missing or invalid.
+func parseCreatedAnnotation(annotations map[string]string) time.Time {
+	v, ok := annotations[annotationCreated]
+	if !ok {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// mergeLabels returns the labels and annotations in a single map, where
+// annotations take precedence. It returns nil if both are empty.
+func mergeLabels(labels, annotations map[string]string) map[string]string {
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(labels)+len(annotations))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for k, v := range annotations {
+		out[k] = v
+	}
+	return out
+}
+
+// remoteOptions returns the common options for remote registry calls.
+func (r *RemoteRegistry) remoteOptions(ctx context.Context) []gcrremote.Option {
+	return []gcrremote.Option{
+		gcrremote.WithContext(ctx),
+		gcrremote.WithUserAgent(userAgent),
+		gcrremote.WithAuthFromKeychain(r.keychain),
+		gcrremote.WithJobs(int(r.concurrency)),
+	}
+}
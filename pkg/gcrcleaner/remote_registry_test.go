@@ -0,0 +1,276 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestRemoteRegistry_ListManifests_Distribution(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	created := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+	img := pushTestImage(t, repo, created, "v1", "latest")
+	imgDigest := mustDigest(t, img)
+
+	annotated := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+	idx := pushTestIndex(t, repo, map[string]string{annotationCreated: annotated.Format(time.RFC3339)},
+		[]time.Time{created, created.Add(time.Hour)}, "multi")
+	idxDigest := mustDigest(t, idx)
+
+	r := NewRemoteRegistry(gcrauthn.NewMultiKeychain(), NewLogger("error", io.Discard, io.Discard), 4)
+	infos, err := r.ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image, the index, and the index's two children.
+	if got, want := len(infos), 4; got != want {
+		t.Fatalf("expected %d manifests to be %d: %#v", got, want, infos)
+	}
+
+	if got, want := infos[imgDigest].Tags, []string{"latest", "v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := infos[imgDigest].Created, created; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+	if got, want := infos[imgDigest].Uploaded, created; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	if got, want := infos[idxDigest].Tags, []string{"multi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := infos[idxDigest].Created, annotated; !got.Equal(want) {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+
+	im, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range im.Manifests {
+		info, ok := infos[desc.Digest.String()]
+		if !ok {
+			t.Errorf("expected child %s to be listed", desc.Digest)
+			continue
+		}
+		if len(info.Tags) != 0 {
+			t.Errorf("expected child %s to be untagged, got %q", desc.Digest, info.Tags)
+		}
+	}
+}
+
+func TestCleaner_Clean_Distribution(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	now := time.Now().UTC()
+	pushTestImage(t, repo, now.Add(-96*time.Hour), "v1")
+	pushTestImage(t, repo, now.Add(-72*time.Hour), "pr-1")
+	pushTestImage(t, repo, now.Add(-48*time.Hour), "pr-2")
+	pushTestIndex(t, repo, nil, []time.Time{now.Add(-24 * time.Hour), now.Add(-24 * time.Hour)}, "pr-3")
+
+	c := newTestCleaner(t)
+	deleted, err := c.CleanPolicy(ctx, repo.Name(), &Policy{
+		Keep:      1,
+		TagFilter: &TagFilterAny{re: regexp.MustCompile(`^pr-`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deletedTags []string
+	for _, ref := range deleted {
+		if ref.Ref != ref.Digest {
+			deletedTags = append(deletedTags, ref.Ref)
+		}
+	}
+	if got, want := deletedTags, []string{"pr-1", "pr-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := len(deleted), 4; got != want {
+		t.Errorf("expected %d deleted refs to be %d: %q", got, want, deleted)
+	}
+
+	remaining, err := gcrremote.List(repo, gcrremote.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(remaining)
+	if got, want := remaining, []string{"pr-3", "v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestCleaner_Clean_Distribution_UnknownTime(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	repo := newTestRepository(t)
+
+	// Reproducible builds set the creation time to the epoch, and some images
+	// have none at all. Neither says when the image was uploaded.
+	now := time.Now().UTC()
+	pushTestImage(t, repo, time.Unix(0, 0), "pr-1")
+	pushTestImage(t, repo, time.Time{}, "pr-2")
+	pushTestImage(t, repo, now.Add(-48*time.Hour), "pr-3")
+
+	infos, err := NewRemoteRegistry(gcrauthn.NewMultiKeychain(), NewLogger("error", io.Discard, io.Discard), 4).
+		ListManifests(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for digest, info := range infos {
+		if info.Tags[0] != "pr-3" && !info.Uploaded.IsZero() {
+			t.Errorf("expected %s (%q) to have an unknown upload time, got %s", digest, info.Tags, info.Uploaded)
+		}
+	}
+
+	c := newTestCleaner(t)
+	deleted, err := c.CleanPolicy(ctx, repo.Name(), &Policy{
+		Grace:     time.Hour,
+		TagFilter: &TagFilterAny{re: regexp.MustCompile(`^pr-`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deletedTags []string
+	for _, ref := range deleted {
+		if ref.Ref != ref.Digest {
+			deletedTags = append(deletedTags, ref.Ref)
+		}
+	}
+	if got, want := deletedTags, []string{"pr-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+// newTestCleaner creates a cleaner with anonymous auth that discards logs.
+func newTestCleaner(tb testing.TB, opts ...CleanerOption) *Cleaner {
+	tb.Helper()
+
+	logger := NewLogger("error", io.Discard, io.Discard)
+	c, err := NewCleaner(gcrauthn.NewMultiKeychain(), logger, 4, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// newTestRepository starts an in-memory registry and returns a repository in
+// it.
+func newTestRepository(tb testing.TB) gcrname.Repository {
+	tb.Helper()
+
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	tb.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	repo, err := gcrname.NewRepository(u.Host + "/test/repo")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return repo
+}
+
+// pushTestImage pushes a random image with the given creation time and tags.
+func pushTestImage(tb testing.TB, repo gcrname.Repository, created time.Time, tags ...string) gcrv1.Image {
+	tb.Helper()
+
+	img := newTestImage(tb, created)
+	for _, tag := range tags {
+		if err := gcrremote.Write(repo.Tag(tag), img); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return img
+}
+
+// pushTestIndex pushes an image index with one random image per creation
+// time.
+func pushTestIndex(tb testing.TB, repo gcrname.Repository, annotations map[string]string, created []time.Time, tags ...string) gcrv1.ImageIndex {
+	tb.Helper()
+
+	var idx gcrv1.ImageIndex = empty.Index
+	for _, c := range created {
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: newTestImage(tb, c)})
+	}
+	if annotations != nil {
+		idx = mutate.Annotations(idx, annotations).(gcrv1.ImageIndex)
+	}
+
+	for _, tag := range tags {
+		if err := gcrremote.WriteIndex(repo.Tag(tag), idx); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return idx
+}
+
+// newTestImage creates a random image with the given creation time.
+func newTestImage(tb testing.TB, created time.Time) gcrv1.Image {
+	tb.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	img, err = mutate.CreatedAt(img, gcrv1.Time{Time: created})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return img
+}
+
+// mustDigest returns the digest of the image or index.
+func mustDigest(tb testing.TB, v interface{ Digest() (gcrv1.Hash, error) }) string {
+	tb.Helper()
+
+	h, err := v.Digest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return h.String()
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// LabelKeep is the label or annotation that pins an image when it is set to
+	// "true".
+	LabelKeep = "gcr-cleaner.keep"
+
+	// LabelExpiresAfter is the label or annotation that sets how long after its
+	// upload an image is deleted, such as "7d".
+	LabelExpiresAfter = "gcr-cleaner.expires-after"
+)
+
+// retention is the retention that an image requests with its labels.
+type retention struct {
+	// keep pins the image.
+	keep bool
+
+	// expiresAfter, if set, replaces the grace period of the image.
+	expiresAfter time.Duration
+}
+
+// parseRetention returns the retention set by the labels, or nil if they set
+// none.
+func parseRetention(labels map[string]string) (*retention, error) {
+	keepValue, hasKeep := labels[LabelKeep]
+	expiresValue, hasExpires := labels[LabelExpiresAfter]
+	if !hasKeep && !hasExpires {
+		return nil, nil
+	}
+
+	var r retention
+	if hasKeep {
+		keep, err := strconv.ParseBool(keepValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label %q: %w", LabelKeep, keepValue, err)
+		}
+		r.keep = keep
+	}
+	if hasExpires {
+		d, err := ParseDuration(expiresValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label %q: %w", LabelExpiresAfter, expiresValue, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %s label %q: duration must be positive", LabelExpiresAfter, expiresValue)
+		}
+		r.expiresAfter = d
+	}
+	return &r, nil
+}
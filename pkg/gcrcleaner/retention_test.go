@@ -0,0 +1,86 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		labels map[string]string
+		exp    *retention
+		err    bool
+	}{
+		{
+			name: "none",
+			labels: map[string]string{
+				"org.opencontainers.image.source": "https://github.com/example/app",
+			},
+			exp: nil,
+		},
+		{
+			name:   "keep",
+			labels: map[string]string{LabelKeep: "true"},
+			exp:    &retention{keep: true},
+		},
+		{
+			name:   "expires_after",
+			labels: map[string]string{LabelExpiresAfter: "7d"},
+			exp:    &retention{expiresAfter: 7 * 24 * time.Hour},
+		},
+		{
+			name:   "both",
+			labels: map[string]string{LabelKeep: "false", LabelExpiresAfter: "12h"},
+			exp:    &retention{expiresAfter: 12 * time.Hour},
+		},
+		{
+			name:   "invalid_keep",
+			labels: map[string]string{LabelKeep: "yes"},
+			err:    true,
+		},
+		{
+			name:   "invalid_expires_after",
+			labels: map[string]string{LabelExpiresAfter: "soon"},
+			err:    true,
+		},
+		{
+			name:   "zero_expires_after",
+			labels: map[string]string{LabelExpiresAfter: "0d"},
+			err:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := parseRetention(tc.labels)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := r, tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %#v to be %#v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// semverRe matches a semantic version (https://semver.org) with an optional
+// "v" prefix.
+var semverRe = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+[0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*)?$`)
+
+// SemverPolicy retains images tagged with semantic versions by release line
+// instead of by age. Releases are ranked by version, not by creation time. A
+// count of zero keeps every major, minor, or patch.
+type SemverPolicy struct {
+	// KeepMajors is the number of newest major versions to keep.
+	KeepMajors int64
+
+	// KeepMinors is the number of newest minor versions to keep in each kept
+	// major version.
+	KeepMinors int64
+
+	// KeepPatches is the number of newest patch versions to keep in each kept
+	// minor version.
+	KeepPatches int64
+
+	// PrereleaseGrace is the duration for which prereleases are kept. Older
+	// prereleases are deleted. A grace of zero keeps every prerelease.
+	// Prereleases do not count against any of the keep counts.
+	PrereleaseGrace time.Duration
+}
+
+// String returns a human-readable description of the policy.
+func (p *SemverPolicy) String() string {
+	count := func(n int64) string {
+		if n <= 0 {
+			return "all"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	grace := "all"
+	if p.PrereleaseGrace > 0 {
+		grace = p.PrereleaseGrace.String()
+	}
+
+	return fmt.Sprintf("majors=%s, minors=%s, patches=%s, prerelease_grace=%s",
+		count(p.KeepMajors), count(p.KeepMinors), count(p.KeepPatches), grace)
+}
+
+// SemverSpec is the JSON and YAML representation of a SemverPolicy.
+type SemverSpec struct {
+	KeepMajors      int64    `json:"keep_majors,omitempty"`
+	KeepMinors      int64    `json:"keep_minors,omitempty"`
+	KeepPatches     int64    `json:"keep_patches,omitempty"`
+	PrereleaseGrace duration `json:"prerelease_grace,omitempty"`
+}
+
+// policy validates the spec and builds the policy. It returns nil if s is nil.
+func (s *SemverSpec) policy() (*SemverPolicy, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	if s.KeepMajors < 0 || s.KeepMinors < 0 || s.KeepPatches < 0 {
+		return nil, fmt.Errorf("semver keep counts must be positive")
+	}
+	if s.PrereleaseGrace < 0 {
+		return nil, fmt.Errorf("semver prerelease_grace must be positive")
+	}
+
+	return &SemverPolicy{
+		KeepMajors:      s.KeepMajors,
+		KeepMinors:      s.KeepMinors,
+		KeepPatches:     s.KeepPatches,
+		PrereleaseGrace: time.Duration(s.PrereleaseGrace),
+	}, nil
+}
+
+// semver is a parsed semantic version. Build metadata is discarded because it
+// does not affect precedence.
+type semver struct {
+	major, minor, patch uint64
+	prerelease          string
+}
+
+// parseSemver parses the tag as a semantic version. It returns false if the
+// tag is not a semantic version.
+func parseSemver(tag string) (*semver, bool) {
+	matches := semverRe.FindStringSubmatch(tag)
+	if matches == nil {
+		return nil, false
+	}
+
+	var parts [3]uint64
+	for i := range parts {
+		n, err := strconv.ParseUint(matches[i+1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = n
+	}
+
+	return &semver{
+		major:      parts[0],
+		minor:      parts[1],
+		patch:      parts[2],
+		prerelease: matches[4],
+	}, true
+}
+
+// String returns the version without a "v" prefix or build metadata.
+func (v *semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.prerelease != "" {
+		s += "-" + v.prerelease
+	}
+	return s
+}
+
+// semverDecision is the result of the semver policy for a single manifest.
+type semverDecision struct {
+	// Keep is true if the semver policy keeps the manifest.
+	Keep bool
+
+	// Reason explains the decision.
+	Reason string
+
+	// Other are the tags of the manifest that are not semantic versions.
+	Other []string
+}
+
+// decide applies the policy to the manifests that have at least one semantic
+// version tag. The returned map only contains those manifests. A manifest is
+// kept if any of its versions is kept.
+func (p *SemverPolicy) decide(manifests []*manifest, now time.Time) map[string]*semverDecision {
+	type line struct{ major, minor uint64 }
+
+	// Collect the release versions of all manifests.
+	majors := make(map[uint64]struct{}, 4)
+	minors := make(map[uint64]map[uint64]struct{}, 4)
+	patches := make(map[line]map[uint64]struct{}, 8)
+
+	versions := make(map[string][]*semver, len(manifests))
+	others := make(map[string][]string, len(manifests))
+	for _, m := range manifests {
+		for _, tag := range m.Info.Tags {
+			v, ok := parseSemver(tag)
+			if !ok {
+				others[m.Digest] = append(others[m.Digest], tag)
+				continue
+			}
+			versions[m.Digest] = append(versions[m.Digest], v)
+
+			if v.prerelease != "" {
+				continue
+			}
+
+			majors[v.major] = struct{}{}
+			if minors[v.major] == nil {
+				minors[v.major] = make(map[uint64]struct{}, 4)
+			}
+			minors[v.major][v.minor] = struct{}{}
+
+			l := line{v.major, v.minor}
+			if patches[l] == nil {
+				patches[l] = make(map[uint64]struct{}, 4)
+			}
+			patches[l][v.patch] = struct{}{}
+		}
+	}
+
+	keptMajors := newestVersions(majors, p.KeepMajors)
+	keptMinors := make(map[uint64]map[uint64]struct{}, len(keptMajors))
+	for major := range keptMajors {
+		keptMinors[major] = newestVersions(minors[major], p.KeepMinors)
+	}
+	keptPatches := make(map[line]map[uint64]struct{}, len(patches))
+	for l, set := range patches {
+		if _, ok := keptMinors[l.major][l.minor]; ok {
+			keptPatches[l] = newestVersions(set, p.KeepPatches)
+		}
+	}
+
+	prereleaseSince := now.UTC().Add(-p.PrereleaseGrace)
+
+	decisions := make(map[string]*semverDecision, len(versions))
+	for _, m := range manifests {
+		vs, ok := versions[m.Digest]
+		if !ok {
+			continue
+		}
+
+		decision := &semverDecision{Other: others[m.Digest]}
+		for _, v := range vs {
+			var keep bool
+			var reason string
+
+			switch {
+			case v.prerelease != "" && p.PrereleaseGrace <= 0:
+				keep = true
+				reason = fmt.Sprintf("prerelease %s is kept without a prerelease grace", v)
+			case v.prerelease != "":
+				keep = m.uploaded().After(prereleaseSince)
+				if keep {
+					reason = fmt.Sprintf("prerelease %s is newer than %s", v, p.PrereleaseGrace)
+				} else {
+					reason = fmt.Sprintf("prerelease %s is older than %s", v, p.PrereleaseGrace)
+				}
+			case !hasVersion(keptMajors, v.major):
+				reason = fmt.Sprintf("%s is not in the newest %d major versions", v, p.KeepMajors)
+			case !hasVersion(keptMinors[v.major], v.minor):
+				reason = fmt.Sprintf("%s is not in the newest %d minor versions of %d", v, p.KeepMinors, v.major)
+			case !hasVersion(keptPatches[line{v.major, v.minor}], v.patch):
+				reason = fmt.Sprintf("%s is not in the newest %d patch versions of %d.%d", v, p.KeepPatches, v.major, v.minor)
+			default:
+				keep = true
+				reason = fmt.Sprintf("%s is a retained release", v)
+			}
+
+			if keep {
+				decision.Keep = true
+				decision.Reason = reason
+				break
+			}
+			if decision.Reason == "" {
+				decision.Reason = reason
+			}
+		}
+		decisions[m.Digest] = decision
+	}
+	return decisions
+}
+
+// newestVersions returns the n largest numbers in the set, or the entire set
+// if n is zero.
+func newestVersions(set map[uint64]struct{}, n int64) map[uint64]struct{} {
+	if n <= 0 || int64(len(set)) <= n {
+		return set
+	}
+
+	sorted := make([]uint64, 0, len(set))
+	for v := range set {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] > sorted[j]
+	})
+
+	kept := make(map[uint64]struct{}, n)
+	for _, v := range sorted[:n] {
+		kept[v] = struct{}{}
+	}
+	return kept
+}
+
+// hasVersion returns true if the set contains v.
+func hasVersion(set map[uint64]struct{}, v uint64) bool {
+	_, ok := set[v]
+	return ok
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseSemver(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		tag  string
+		exp  *semver
+	}{
+		{
+			name: "release",
+			tag:  "1.2.3",
+			exp:  &semver{major: 1, minor: 2, patch: 3},
+		},
+		{
+			name: "v_prefix",
+			tag:  "v10.0.1",
+			exp:  &semver{major: 10, minor: 0, patch: 1},
+		},
+		{
+			name: "prerelease",
+			tag:  "v2.0.0-rc.1",
+			exp:  &semver{major: 2, prerelease: "rc.1"},
+		},
+		{
+			name: "build_metadata",
+			tag:  "1.0.0-beta+exp.sha.5114f85",
+			exp:  &semver{major: 1, prerelease: "beta"},
+		},
+		{
+			name: "short",
+			tag:  "v1.2",
+		},
+		{
+			name: "leading_zero",
+			tag:  "1.02.3",
+		},
+		{
+			name: "suffix",
+			tag:  "1.2.3_linux",
+		},
+		{
+			name: "latest",
+			tag:  "latest",
+		},
+		{
+			name: "overflow",
+			tag:  "99999999999999999999.0.0",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			v, ok := parseSemver(tc.tag)
+			if got, want := ok, tc.exp != nil; got != want {
+				t.Fatalf("expected %t to be %t", got, want)
+			}
+			if got, want := v, tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %#v to be %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestSemverPolicy_Decide(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+
+	newManifest := func(digest string, age time.Duration, tags ...string) *manifest {
+		return &manifest{
+			Repo:   "gcr.io/p/r",
+			Digest: digest,
+			Info: ManifestInfo{
+				Tags:     tags,
+				Created:  now.Add(-age),
+				Uploaded: now.Add(-age),
+			},
+		}
+	}
+
+	day := 24 * time.Hour
+
+	cases := []struct {
+		name      string
+		policy    *SemverPolicy
+		manifests []*manifest
+		exp       []string
+	}{
+		{
+			name:   "patches_per_minor",
+			policy: &SemverPolicy{KeepPatches: 2},
+			manifests: []*manifest{
+				newManifest("1.4.0", day, "v1.4.0"),
+				newManifest("1.4.1", day, "v1.4.1"),
+				newManifest("1.4.2", day, "v1.4.2"),
+				newManifest("1.3.0", day, "v1.3.0"),
+			},
+			exp: []string{"1.3.0", "1.4.1", "1.4.2"},
+		},
+		{
+			name:   "ranked_by_version_not_age",
+			policy: &SemverPolicy{KeepPatches: 1},
+			manifests: []*manifest{
+				newManifest("1.0.9", 30*day, "1.0.9"),
+				newManifest("1.0.10", 60*day, "1.0.10"),
+			},
+			exp: []string{"1.0.10"},
+		},
+		{
+			name:   "majors_and_minors",
+			policy: &SemverPolicy{KeepMajors: 2, KeepMinors: 1, KeepPatches: 3},
+			manifests: []*manifest{
+				newManifest("3.1.0", day, "v3.1.0"),
+				newManifest("3.0.5", day, "v3.0.5"),
+				newManifest("2.9.1", day, "v2.9.1"),
+				newManifest("2.8.0", day, "v2.8.0"),
+				newManifest("1.9.9", day, "v1.9.9"),
+			},
+			exp: []string{"2.9.1", "3.1.0"},
+		},
+		{
+			name:   "prereleases",
+			policy: &SemverPolicy{KeepPatches: 1, PrereleaseGrace: 14 * day},
+			manifests: []*manifest{
+				newManifest("new-rc", day, "v2.0.0-rc.2"),
+				newManifest("old-rc", 20*day, "v2.0.0-rc.1"),
+				newManifest("1.0.0", 30*day, "v1.0.0"),
+			},
+			exp: []string{"1.0.0", "new-rc"},
+		},
+		{
+			name:   "prereleases_without_grace",
+			policy: &SemverPolicy{KeepPatches: 1},
+			manifests: []*manifest{
+				newManifest("new-rc", day, "v2.0.0-rc.2"),
+				newManifest("old-rc", 365*day, "v2.0.0-rc.1"),
+				newManifest("1.0.0", 30*day, "v1.0.0"),
+			},
+			exp: []string{"1.0.0", "new-rc", "old-rc"},
+		},
+		{
+			name:   "prereleases_do_not_count",
+			policy: &SemverPolicy{KeepPatches: 1, PrereleaseGrace: 14 * day},
+			manifests: []*manifest{
+				newManifest("1.0.1-rc", day, "1.0.1-rc.1"),
+				newManifest("1.0.0", day, "1.0.0"),
+			},
+			exp: []string{"1.0.0", "1.0.1-rc"},
+		},
+		{
+			name:   "any_kept_version",
+			policy: &SemverPolicy{KeepPatches: 1},
+			manifests: []*manifest{
+				newManifest("both", day, "1.0.0", "1.1.0"),
+				newManifest("1.0.1", day, "1.0.1"),
+			},
+			exp: []string{"1.0.1", "both"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			decisions := tc.policy.decide(tc.manifests, now)
+			if got, want := len(decisions), len(tc.manifests); got != want {
+				t.Fatalf("expected %d decisions to be %d", got, want)
+			}
+
+			got := make([]string, 0, len(decisions))
+			for digest, decision := range decisions {
+				if decision.Keep {
+					got = append(got, digest)
+				}
+			}
+			sort.Strings(got)
+
+			if want := tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,20 +37,36 @@ const (
 
 // Server is a cleaning server.
 type Server struct {
-	cleaner *Cleaner
-	logger  *Logger
+	cleaner  *Cleaner
+	logger   *Logger
+	policies *PolicyConfig
+}
+
+// ServerOption is an option for configuring the server.
+type ServerOption func(s *Server)
+
+// WithPolicyConfig configures the server to resolve the policy for each
+// repository against the given policy configuration.
+func WithPolicyConfig(cfg *PolicyConfig) ServerOption {
+	return func(s *Server) {
+		s.policies = cfg
+	}
 }
 
 // NewServer creates a new server for handler functions.
-func NewServer(cleaner *Cleaner) (*Server, error) {
+func NewServer(cleaner *Cleaner, opts ...ServerOption) (*Server, error) {
 	if cleaner == nil {
 		return nil, fmt.Errorf("missing cleaner")
 	}
 
-	return &Server{
+	s := &Server{
 		cleaner: cleaner,
 		logger:  cleaner.logger,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
 // PubSubHandler is an http handler that invokes the cleaner from a pubsub
@@ -100,22 +118,61 @@ func (s *Server) HTTPHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		deleted, status, err := s.clean(ctx, r.Body)
+		out, status, err := s.clean(ctx, r.Body)
 		if err != nil {
 			s.handleError(w, err, status)
 			return
 		}
+		results := out.Results
 
 		refs := make([]string, 0, 16)
-		for _, v := range deleted {
-			refs = append(refs, v...)
+		refsByRepo := make(map[string][]string, len(results))
+		artifactsBySubject := make(map[string]map[string][]string)
+		untaggedByRepo := make(map[string][]string)
+		keptByRepo := make(map[string][]*KeptRef)
+		cutoffByRepo := make(map[string]time.Time, len(results))
+		sizeByRepo := make(map[string]*RepoSize)
+		var reclaimable int64
+		for repo, result := range results {
+			if len(result.Kept) > 0 {
+				keptByRepo[repo] = result.Kept
+			}
+			cutoffByRepo[repo] = result.Cutoff
+			if result.Size != nil {
+				sizeByRepo[repo] = result.Size
+				reclaimable += result.Size.Reclaimable
+			}
+
+			for _, ref := range result.Deleted {
+				refs = append(refs, ref.Ref)
+				refsByRepo[repo] = append(refsByRepo[repo], ref.Ref)
+
+				if ref.Untagged {
+					untaggedByRepo[repo] = append(untaggedByRepo[repo], ref.Ref)
+				}
+
+				if ref.Subject != "" {
+					if artifactsBySubject[repo] == nil {
+						artifactsBySubject[repo] = make(map[string][]string)
+					}
+					artifactsBySubject[repo][ref.Subject] = append(artifactsBySubject[repo][ref.Subject], ref.Ref)
+				}
+			}
 		}
 		sort.Strings(refs)
 
 		b, err := json.Marshal(&cleanResp{
-			Count:      len(deleted),
-			Refs:       refs,
-			RefsByRepo: deleted,
+			Count:              len(refsByRepo),
+			Refs:               refs,
+			RefsByRepo:         refsByRepo,
+			ArtifactsBySubject: artifactsBySubject,
+			UntaggedByRepo:     untaggedByRepo,
+			KeptByRepo:         keptByRepo,
+			Cutoff:             out.Cutoff,
+			NewerThan:          out.NewerThan,
+			CutoffByRepo:       cutoffByRepo,
+			SizeByRepo:         sizeByRepo,
+			Reclaimable:        reclaimable,
 		})
 		if err != nil {
 			err = fmt.Errorf("failed to marshal JSON errors: %w", err)
@@ -129,8 +186,21 @@ func (s *Server) HTTPHandler() http.HandlerFunc {
 	}
 }
 
+// cleanOutput is the result of a clean request.
+type cleanOutput struct {
+	// Results are the results of the repositories where refs were deleted or
+	// kept.
+	Results map[string]*CleanResult
+
+	// Cutoff is the effective cutoff of the payload.
+	Cutoff time.Time
+
+	// NewerThan is the newer_than cutoff of the payload, if any.
+	NewerThan *time.Time
+}
+
 // clean reads the given body as JSON and starts a cleaner instance.
-func (s *Server) clean(ctx context.Context, r io.ReadCloser) (map[string][]string, int, error) {
+func (s *Server) clean(ctx context.Context, r io.ReadCloser) (*cleanOutput, int, error) {
 	var p Payload
 	if err := json.NewDecoder(r).Decode(&p); err != nil {
 		return nil, 500, fmt.Errorf("failed to decode payload as JSON: %w", err)
@@ -140,17 +210,9 @@ func (s *Server) clean(ctx context.Context, r io.ReadCloser) (map[string][]strin
 		"version", version.HumanVersion,
 		"payload", p)
 
-	// Convert duration to a negative value, since we're about to "add" it to the
-	// since time.
-	sub := time.Duration(p.Grace)
-	if p.Grace > 0 {
-		sub = sub * -1
-	}
-
-	since := time.Now().UTC().Add(sub)
-	tagFilter, err := BuildTagFilter(p.TagFilterAny, p.TagFilterAll)
+	basePolicy, err := p.policy()
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("failed to build tag filter: %w", err)
+		return nil, http.StatusBadRequest, err
 	}
 
 	// Gather all the repositories.
@@ -176,29 +238,54 @@ func (s *Server) clean(ctx context.Context, r io.ReadCloser) (map[string][]strin
 		repos = allRepos
 	}
 
+	cutoff := basePolicy.Since(time.Now())
 	s.logger.Info("deleting refs",
-		"since", since,
+		"since", cutoff,
+		"newer_than", basePolicy.NewerThan,
 		"repos", repos)
 
+	// List the images in use once, so every repository is cleaned against the
+	// same images. If they cannot be listed, nothing is deleted, since any image
+	// could be in use.
+	inUse, err := s.cleaner.ListInUse(ctx)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
 	// Do the deletion.
-	deleted := make(map[string][]string, len(repos))
+	results := make(map[string]*CleanResult, len(repos))
 	for _, repo := range repos {
-		s.logger.Info("deleting refs for repo", "repo", repo)
+		policy := s.policies.Resolve(repo, basePolicy)
+		s.logger.Info("deleting refs for repo",
+			"repo", repo,
+			"policy", policy.Name)
 
-		childrenDeleted, err := s.cleaner.Clean(ctx, repo, since, p.Keep, tagFilter, p.DryRun)
+		result, err := s.cleaner.CleanWithResult(ctx, repo, policy, WithInUseImages(inUse))
 		if err != nil {
 			return nil, http.StatusBadRequest, fmt.Errorf("failed to clean repo %q: %w", repo, err)
 		}
 
-		if len(childrenDeleted) > 0 {
-			s.logger.Info("deleted refs", "repo", repo, "refs", childrenDeleted)
-			deleted[repo] = append(deleted[repo], childrenDeleted...)
+		if len(result.Kept) > 0 {
+			s.logger.Info("kept refs", "repo", repo, "refs", result.Kept)
+			results[repo] = result
+		}
+		if len(result.Deleted) > 0 {
+			s.logger.Info("deleted refs", "repo", repo, "refs", result.Deleted)
+			results[repo] = result
 		}
 	}
 
-	s.logger.Info("deleted refs", "refs", deleted)
+	s.logger.Info("deleted refs", "refs", results)
 
-	return deleted, http.StatusOK, nil
+	out := &cleanOutput{
+		Results: results,
+		Cutoff:  cutoff,
+	}
+	if !basePolicy.NewerThan.IsZero() {
+		newerThan := basePolicy.NewerThan.UTC()
+		out.NewerThan = &newerThan
+	}
+	return out, http.StatusOK, nil
 }
 
 // handleError returns a JSON-formatted error message
@@ -226,9 +313,39 @@ type Payload struct {
 	// given to new, untagged layers. The default is no grace.
 	Grace duration `json:"grace"`
 
+	// OlderThan is an absolute cutoff. If given, images uploaded after it are
+	// not deleted, even if they are outside the grace period.
+	OlderThan time.Time `json:"older_than"`
+
+	// NewerThan is an absolute cutoff. If given, images uploaded at or before it
+	// are not deleted.
+	NewerThan time.Time `json:"newer_than"`
+
+	// UntaggedGrace is the grace period for untagged images. If unset, Grace
+	// applies.
+	UntaggedGrace duration `json:"untagged_grace"`
+
+	// TaggedGrace is the grace period for tagged images. If unset, Grace
+	// applies.
+	TaggedGrace duration `json:"tagged_grace"`
+
 	// Keep is the minimum number of images to keep.
 	Keep int64 `json:"keep"`
 
+	// KeepGroupBy is a regular expression with a capture group named "group".
+	// If given, images are partitioned into families by the captured value of
+	// their tags, and Keep applies to each family.
+	KeepGroupBy string `json:"keep_group_by"`
+
+	// Buckets is a grandfather-father-son schedule. If given, the newest image
+	// in each period is kept and all other candidates are deleted.
+	Buckets *Buckets `json:"buckets,omitempty"`
+
+	// TagFilter is a tag filter expression that combines regular expressions
+	// with "and", "or", and "not", such as "any(^pr-) and not any(^release-)". It
+	// cannot be given with TagFilterAny or TagFilterAll.
+	TagFilter string `json:"tag_filter"`
+
 	// TagFilterAny is the tags pattern to be allowed removing. If given, any
 	// image with at least one tag that matches this given regular expression will
 	// be deleted. The image will be deleted even if it has other tags that do not
@@ -241,6 +358,49 @@ type Payload struct {
 	// given regular expression.
 	TagFilterAll string `json:"tag_filter_all"`
 
+	// Expression is a CEL expression that is evaluated for each image and
+	// returns true if the image should be deleted. If given, it replaces the tag
+	// filters.
+	Expression string `json:"expression"`
+
+	// ProtectedTags is a list of regular expressions. Images with any tag that
+	// matches one of them are never deleted, regardless of the other fields.
+	ProtectedTags []string `json:"protected_tags"`
+
+	// Semver enables semantic-version aware retention for images tagged with
+	// semantic versions. Other tags are still matched by the tag filters.
+	Semver *SemverSpec `json:"semver,omitempty"`
+
+	// UntagOnly removes only the tags that match the tag filter from images
+	// that also have other tags. The image is deleted only if all of its tags
+	// match.
+	UntagOnly bool `json:"untag_only"`
+
+	// TimeSource is where the time of each image comes from for both the grace
+	// period and the keep order. By default, the upload time is used for the
+	// grace period and the creation time for the keep order.
+	TimeSource *TimeSourceSpec `json:"time_source,omitempty"`
+
+	// TypeFilter selects the manifests to clean by media type and artifact type,
+	// such as only container images or only Helm charts. Other manifests are
+	// kept.
+	TypeFilter *TypeFilterSpec `json:"type_filter,omitempty"`
+
+	// RetentionLabels lets images pin themselves with a "gcr-cleaner.keep=true"
+	// label or annotation, and set their own expiry with a
+	// "gcr-cleaner.expires-after" label or annotation such as "7d".
+	RetentionLabels bool `json:"retention_labels"`
+
+	// DeleteOrphans deletes signatures, attestations, and other supporting
+	// artifacts whose subject is not in the same repository. Only enable it if
+	// artifacts are stored with their images.
+	DeleteOrphans bool `json:"delete_orphans"`
+
+	// Quota is the storage quota of each repository, in bytes or as a string
+	// like "50GiB". If given, the images that the other fields would delete are
+	// deleted from oldest to newest only until the repository fits in the quota.
+	Quota byteSize `json:"quota"`
+
 	// DryRun instructs the server to not perform actual cleaning. The response
 	// will include repositories that would have been deleted.
 	DryRun bool `json:"dry_run"`
@@ -249,6 +409,79 @@ type Payload struct {
 	Recursive bool `json:"recursive"`
 }
 
+// policy builds the base policy from the payload.
+func (p *Payload) policy() (*Policy, error) {
+	tagFilter, err := BuildTagFilterExpr(p.TagFilter, p.TagFilterAny, p.TagFilterAll)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tag filter: %w", err)
+	}
+
+	protectedTags, err := BuildProtectedTags(p.ProtectedTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build protected tags: %w", err)
+	}
+
+	keepGroup, err := BuildKeepGroup(p.KeepGroupBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build keep group: %w", err)
+	}
+
+	semver, err := p.Semver.policy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build semver policy: %w", err)
+	}
+
+	expression, err := BuildExpression(p.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	timeSource, err := p.TimeSource.source()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build time source: %w", err)
+	}
+
+	typeFilter, err := p.TypeFilter.filter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build type filter: %w", err)
+	}
+
+	if err := p.Buckets.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := validateCutoffs(p.OlderThan, p.NewerThan); err != nil {
+		return nil, err
+	}
+
+	if p.Quota < 0 {
+		return nil, fmt.Errorf("quota must not be negative")
+	}
+
+	return &Policy{
+		Name:            "default",
+		Grace:           time.Duration(p.Grace),
+		UntaggedGrace:   time.Duration(p.UntaggedGrace),
+		TaggedGrace:     time.Duration(p.TaggedGrace),
+		OlderThan:       p.OlderThan,
+		NewerThan:       p.NewerThan,
+		Keep:            p.Keep,
+		KeepGroup:       keepGroup,
+		Buckets:         p.Buckets,
+		TagFilter:       tagFilter,
+		Expression:      expression,
+		ProtectedTags:   protectedTags,
+		Semver:          semver,
+		UntagOnly:       p.UntagOnly,
+		TimeSource:      timeSource,
+		TypeFilter:      typeFilter,
+		RetentionLabels: p.RetentionLabels,
+		DeleteOrphans:   p.DeleteOrphans,
+		Quota:           int64(p.Quota),
+		DryRun:          p.DryRun,
+	}, nil
+}
+
 type pubsubMessage struct {
 	Message struct {
 		Data []byte `json:"data"`
@@ -261,6 +494,39 @@ type cleanResp struct {
 	Count      int                 `json:"count"`
 	Refs       []string            `json:"refs"`
 	RefsByRepo map[string][]string `json:"refs_by_repo"`
+
+	// ArtifactsBySubject groups the deleted signatures, attestations, SBOMs, and
+	// other referrers by repository and subject digest.
+	ArtifactsBySubject map[string]map[string][]string `json:"artifacts_by_subject,omitempty"`
+
+	// UntaggedByRepo lists the tags that were removed in untag-only mode from
+	// images that were kept. These tags are also in Refs and RefsByRepo.
+	UntaggedByRepo map[string][]string `json:"untagged_by_repo,omitempty"`
+
+	// KeptByRepo lists the images that were kept because of a protected tag, to
+	// fill a retention bucket, because of a label, or because they are in use.
+	KeptByRepo map[string][]*KeptRef `json:"kept_by_repo,omitempty"`
+
+	// Cutoff is the effective cutoff of the grace period and older_than. Images
+	// uploaded after it were not deleted.
+	Cutoff time.Time `json:"cutoff"`
+
+	// NewerThan is the newer_than cutoff, if any. Images uploaded at or before
+	// it were not deleted.
+	NewerThan *time.Time `json:"newer_than,omitempty"`
+
+	// CutoffByRepo is the effective cutoff for each repository in RefsByRepo or
+	// KeptByRepo, which can differ because of policies.
+	CutoffByRepo map[string]time.Time `json:"cutoff_by_repo,omitempty"`
+
+	// SizeByRepo is the storage size of each repository before and after
+	// cleaning and the storage reclaimed, for repositories where anything was
+	// deleted or that have a quota.
+	SizeByRepo map[string]*RepoSize `json:"size_by_repo,omitempty"`
+
+	// Reclaimable is the total storage reclaimed in all repositories, in bytes.
+	// In dry-run mode, it is the storage that would be reclaimed.
+	Reclaimable int64 `json:"reclaimable"`
 }
 
 type errorResp struct {
@@ -333,7 +599,7 @@ func (d *duration) UnmarshalJSON(b []byte) error {
 		*d = duration(time.Duration(val))
 		return nil
 	case string:
-		s, err := time.ParseDuration(val)
+		s, err := ParseDuration(val)
 		if err != nil {
 			return err
 		}
@@ -343,3 +609,55 @@ func (d *duration) UnmarshalJSON(b []byte) error {
 		return fmt.Errorf("invalid duration type %T", val)
 	}
 }
+
+// durationUnitRe matches a single number and unit of a duration.
+var durationUnitRe = regexp.MustCompile(`^([0-9]*(?:\.[0-9]*)?)([a-zµμ]+)`)
+
+// ParseDuration parses a duration like time.ParseDuration, but also accepts
+// days ("d") and weeks ("w"), such as "30d" or "2w3d12h". A day is always 24
+// hours.
+func ParseDuration(s string) (time.Duration, error) {
+	if !strings.ContainsAny(s, "dw") {
+		return time.ParseDuration(s)
+	}
+
+	orig := s
+	sign := time.Duration(1)
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+
+	var total time.Duration
+	for s != "" {
+		matches := durationUnitRe.FindStringSubmatch(s)
+		if matches == nil || matches[1] == "" || matches[1] == "." {
+			return 0, fmt.Errorf("time: invalid duration %q", orig)
+		}
+		s = s[len(matches[0]):]
+
+		var unit time.Duration
+		switch matches[2] {
+		case "d":
+			unit = 24 * time.Hour
+		case "w":
+			unit = 7 * 24 * time.Hour
+		default:
+			d, err := time.ParseDuration(matches[0])
+			if err != nil {
+				return 0, fmt.Errorf("time: invalid duration %q", orig)
+			}
+			total += d
+			continue
+		}
+
+		n, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("time: invalid duration %q", orig)
+		}
+		total += time.Duration(n * float64(unit))
+	}
+	return sign * total, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	t.Parallel()
+
+	day := 24 * time.Hour
+
+	cases := []struct {
+		name string
+		in   string
+		exp  time.Duration
+		err  bool
+	}{
+		{
+			name: "go_duration",
+			in:   "720h",
+			exp:  30 * day,
+		},
+		{
+			name: "days",
+			in:   "30d",
+			exp:  30 * day,
+		},
+		{
+			name: "weeks",
+			in:   "2w",
+			exp:  14 * day,
+		},
+		{
+			name: "combined",
+			in:   "1w2d3h30m",
+			exp:  9*day + 3*time.Hour + 30*time.Minute,
+		},
+		{
+			name: "fractional",
+			in:   "1.5d",
+			exp:  36 * time.Hour,
+		},
+		{
+			name: "negative",
+			in:   "-2d",
+			exp:  -2 * day,
+		},
+		{
+			name: "missing_number",
+			in:   "d",
+			err:  true,
+		},
+		{
+			name: "unknown_unit",
+			in:   "2d3y",
+			err:  true,
+		},
+		{
+			name: "trailing_number",
+			in:   "2d3",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			d, err := ParseDuration(tc.in)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := d, tc.exp; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPayload_Policy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		in       string
+		expGrace time.Duration
+		expQuota int64
+		err      bool
+	}{
+		{
+			name:     "days",
+			in:       `{"grace": "30d"}`,
+			expGrace: 30 * 24 * time.Hour,
+		},
+		{
+			name: "cutoffs",
+			in:   `{"older_than": "2024-10-01T00:00:00Z", "newer_than": "2024-09-01T00:00:00Z"}`,
+		},
+		{
+			name: "inverted_cutoffs",
+			in:   `{"older_than": "2024-09-01T00:00:00Z", "newer_than": "2024-10-01T00:00:00Z"}`,
+			err:  true,
+		},
+		{
+			name:     "quota",
+			in:       `{"quota": "50GiB"}`,
+			expQuota: 50 << 30,
+		},
+		{
+			name:     "quota_bytes",
+			in:       `{"quota": 1000000}`,
+			expQuota: 1_000_000,
+		},
+		{
+			name: "negative_quota",
+			in:   `{"quota": -1}`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var p Payload
+			if err := json.Unmarshal([]byte(tc.in), &p); err != nil {
+				t.Fatal(err)
+			}
+
+			policy, err := p.policy()
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := policy.Grace, tc.expGrace; got != want {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+			if got, want := policy.Quota, tc.expQuota; got != want {
+				t.Errorf("expected %d to be %d", got, want)
+			}
+		})
+	}
+}
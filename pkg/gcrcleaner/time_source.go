@@ -0,0 +1,177 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// TimeSourceCreated dates images by their creation time.
+	TimeSourceCreated = "created"
+
+	// TimeSourceUploaded dates images by their upload time.
+	TimeSourceUploaded = "uploaded"
+
+	// TimeSourceAnnotation dates images by the org.opencontainers.image.created
+	// annotation.
+	TimeSourceAnnotation = "annotation"
+
+	// TimeSourceLabel dates images by the value of a label or annotation.
+	TimeSourceLabel = "label"
+
+	// TimeSourceTag dates images by a timestamp in one of their tags.
+	TimeSourceTag = "tag"
+
+	// timeSourceGroupName is the name of the capture group that contains the
+	// timestamp in a tag.
+	timeSourceGroupName = "time"
+)
+
+// TimeSource is where the time of an image comes from. The time replaces both
+// the creation and upload time of the image, so it decides both whether the
+// image is inside the grace period and its position for keep. Images without
+// a time from the source use their upload time.
+type TimeSource struct {
+	typ    string
+	label  string
+	re     *regexp.Regexp
+	layout string
+}
+
+// TimeSourceSpec is the JSON and YAML representation of a TimeSource.
+type TimeSourceSpec struct {
+	Type    string `json:"type"`
+	Label   string `json:"label,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Layout  string `json:"layout,omitempty"`
+}
+
+// source builds the time source. It returns nil if s is nil.
+func (s *TimeSourceSpec) source() (*TimeSource, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return BuildTimeSource(s.Type, s.Label, s.Pattern, s.Layout)
+}
+
+// BuildTimeSource builds a time source of the given type. Label sources need
+// the name of the label and tag sources need a regular expression and a Go
+// time layout (e.g. "^nightly-(\d{8})$" and "20060102"). The timestamp is the
+// capture group named "time", or else the first capture group, or else the
+// entire match. Label values are parsed with the layout, or RFC 3339 if it is
+// empty. If typ is empty, it returns nil.
+func BuildTimeSource(typ, label, pattern, layout string) (*TimeSource, error) {
+	switch typ {
+	case "":
+		return nil, nil
+	case TimeSourceCreated, TimeSourceUploaded, TimeSourceAnnotation:
+		if label != "" || pattern != "" || layout != "" {
+			return nil, fmt.Errorf("time source %q does not take a label, pattern, or layout", typ)
+		}
+		return &TimeSource{typ: typ}, nil
+	case TimeSourceLabel:
+		if label == "" {
+			return nil, fmt.Errorf("time source %q requires a label", typ)
+		}
+		if pattern != "" {
+			return nil, fmt.Errorf("time source %q does not take a pattern", typ)
+		}
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return &TimeSource{typ: typ, label: label, layout: layout}, nil
+	case TimeSourceTag:
+		if pattern == "" || layout == "" {
+			return nil, fmt.Errorf("time source %q requires a pattern and a layout", typ)
+		}
+		if label != "" {
+			return nil, fmt.Errorf("time source %q does not take a label", typ)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile time source regular expression %q: %w", pattern, err)
+		}
+		return &TimeSource{typ: typ, re: re, layout: layout}, nil
+	default:
+		return nil, fmt.Errorf("unknown time source %q, must be one of %q, %q, %q, %q, or %q", typ,
+			TimeSourceCreated, TimeSourceUploaded, TimeSourceAnnotation, TimeSourceLabel, TimeSourceTag)
+	}
+}
+
+// String returns a human-readable description of the source.
+func (s *TimeSource) String() string {
+	switch {
+	case s == nil:
+		return "(default)"
+	case s.typ == TimeSourceLabel:
+		return fmt.Sprintf("label(%s, %s)", s.label, s.layout)
+	case s.typ == TimeSourceTag:
+		return fmt.Sprintf("tag(%s, %s)", s.re, s.layout)
+	default:
+		return s.typ
+	}
+}
+
+// needsLabels returns true if the source reads the labels of images. It is
+// safe to call on a nil source.
+func (s *TimeSource) needsLabels() bool {
+	return s != nil && (s.typ == TimeSourceAnnotation || s.typ == TimeSourceLabel)
+}
+
+// resolve returns the time of the manifest and a description of where it came
+// from. If the source has no time for the manifest, it returns the upload
+// time.
+func (s *TimeSource) resolve(m *manifest) (time.Time, string) {
+	switch s.typ {
+	case TimeSourceCreated:
+		if !m.Info.Created.IsZero() {
+			return m.Info.Created.UTC(), TimeSourceCreated
+		}
+	case TimeSourceUploaded:
+		return m.Info.Uploaded.UTC(), TimeSourceUploaded
+	case TimeSourceAnnotation:
+		if t, err := time.Parse(time.RFC3339, m.Info.Labels[annotationCreated]); err == nil {
+			return t.UTC(), TimeSourceAnnotation
+		}
+	case TimeSourceLabel:
+		if v, ok := m.Info.Labels[s.label]; ok {
+			if t, err := time.Parse(s.layout, v); err == nil {
+				return t.UTC(), fmt.Sprintf("label %s", s.label)
+			}
+		}
+	case TimeSourceTag:
+		for _, tag := range m.Info.Tags {
+			matches := s.re.FindStringSubmatch(tag)
+			if matches == nil {
+				continue
+			}
+
+			v := matches[0]
+			if i := s.re.SubexpIndex(timeSourceGroupName); i >= 0 {
+				v = matches[i]
+			} else if len(matches) > 1 {
+				v = matches[1]
+			}
+
+			if t, err := time.Parse(s.layout, v); err == nil {
+				return t.UTC(), fmt.Sprintf("tag %s", tag)
+			}
+		}
+	}
+	return m.Info.Uploaded.UTC(), TimeSourceUploaded + " (fallback)"
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildTimeSource(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		typ     string
+		label   string
+		pattern string
+		layout  string
+		none    bool
+		err     bool
+	}{
+		{
+			name: "empty",
+			none: true,
+		},
+		{
+			name: "created",
+			typ:  "created",
+		},
+		{
+			name:  "label",
+			typ:   "label",
+			label: "build-date",
+		},
+		{
+			name: "label_without_name",
+			typ:  "label",
+			err:  true,
+		},
+		{
+			name:    "tag",
+			typ:     "tag",
+			pattern: `^nightly-(\d{8})$`,
+			layout:  "20060102",
+		},
+		{
+			name:    "tag_without_layout",
+			typ:     "tag",
+			pattern: `^nightly-(\d{8})$`,
+			err:     true,
+		},
+		{
+			name:    "tag_invalid_pattern",
+			typ:     "tag",
+			pattern: `(`,
+			layout:  "20060102",
+			err:     true,
+		},
+		{
+			name:  "uploaded_with_label",
+			typ:   "uploaded",
+			label: "build-date",
+			err:   true,
+		},
+		{
+			name: "unknown",
+			typ:  "pushed",
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := BuildTimeSource(tc.typ, tc.label, tc.pattern, tc.layout)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := s == nil, tc.none; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestTimeSource_Resolve(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(1970, 1, 1, 0, 0, 1, 0, time.UTC)
+	uploaded := time.Date(2024, 10, 5, 12, 0, 0, 0, time.UTC)
+
+	m := &manifest{
+		Repo:   "gcr.io/p/r",
+		Digest: "sha256:abc",
+		Info: ManifestInfo{
+			Created:  created,
+			Uploaded: uploaded,
+			Tags:     []string{"latest", "nightly-20241001"},
+			Labels: map[string]string{
+				annotationCreated: "2024-10-02T08:00:00Z",
+				"build-date":      "2024-10-03",
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		typ     string
+		label   string
+		pattern string
+		layout  string
+		exp     time.Time
+		expFrom string
+	}{
+		{
+			name:    "created",
+			typ:     "created",
+			exp:     created,
+			expFrom: "created",
+		},
+		{
+			name:    "uploaded",
+			typ:     "uploaded",
+			exp:     uploaded,
+			expFrom: "uploaded",
+		},
+		{
+			name:    "annotation",
+			typ:     "annotation",
+			exp:     time.Date(2024, 10, 2, 8, 0, 0, 0, time.UTC),
+			expFrom: "annotation",
+		},
+		{
+			name:    "label",
+			typ:     "label",
+			label:   "build-date",
+			layout:  "2006-01-02",
+			exp:     time.Date(2024, 10, 3, 0, 0, 0, 0, time.UTC),
+			expFrom: "label build-date",
+		},
+		{
+			name:    "missing_label",
+			typ:     "label",
+			label:   "vcs-date",
+			exp:     uploaded,
+			expFrom: "uploaded (fallback)",
+		},
+		{
+			name:    "tag",
+			typ:     "tag",
+			pattern: `^nightly-(\d{8})$`,
+			layout:  "20060102",
+			exp:     time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC),
+			expFrom: "tag nightly-20241001",
+		},
+		{
+			name:    "tag_named_group",
+			typ:     "tag",
+			pattern: `^(nightly)-(?P<time>\d{6})\d\d$`,
+			layout:  "200601",
+			exp:     time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC),
+			expFrom: "tag nightly-20241001",
+		},
+		{
+			name:    "tag_invalid_time",
+			typ:     "tag",
+			pattern: `^nightly-(\d{8})$`,
+			layout:  "2006-01-02",
+			exp:     uploaded,
+			expFrom: "uploaded (fallback)",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := BuildTimeSource(tc.typ, tc.label, tc.pattern, tc.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, from := s.resolve(m)
+			if want := tc.exp; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+			if got, want := from, tc.expFrom; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCleaner_CleanWithResult_TimeSourceLabels(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	listed := now.Add(-48 * time.Hour)
+	aa := "sha256:" + strings.Repeat("a", 64)
+	bb := "sha256:" + strings.Repeat("b", 64)
+
+	// Like GCR and Artifact Registry, the listing has no annotations.
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	manifest := func(digest string, created time.Time) *RawManifest {
+		return &RawManifest{
+			Digest:    digest,
+			MediaType: mediaType,
+			Body: []byte(fmt.Sprintf(`{"schemaVersion": 2, "annotations": {%q: %q}}`,
+				annotationCreated, created.Format(time.RFC3339))),
+		}
+	}
+	registry := &fakeRegistry{
+		manifests: map[string]ManifestInfo{
+			aa: {MediaType: mediaType, Created: listed, Uploaded: listed},
+			bb: {MediaType: mediaType, Created: listed, Uploaded: listed},
+		},
+		raw: map[string]*RawManifest{
+			aa: manifest(aa, now.Add(-time.Hour)),
+			bb: manifest(bb, now.Add(-72*time.Hour)),
+		},
+	}
+
+	source, err := BuildTimeSource(TimeSourceAnnotation, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCleaner(t, WithRegistry(registry))
+	result, err := c.CleanWithResult(ctx, "registry.example/a/b", &Policy{
+		Grace:      24 * time.Hour,
+		TagFilter:  &TagFilterNull{},
+		TimeSource: source,
+		DryRun:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(result.Deleted))
+	for _, ref := range result.Deleted {
+		got = append(got, ref.Digest)
+	}
+	if want := []string{bb}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
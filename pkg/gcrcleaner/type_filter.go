@@ -0,0 +1,150 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TypeFilter selects the manifests that a policy applies to by media type and
+// artifact type. Manifests that it does not select are kept and do not count
+// against keep. Patterns use shell syntax (e.g. "application/vnd.cncf.helm.*").
+//
+// The artifact type is the artifactType field of the manifest or, for
+// artifacts that predate it, the media type of the config (e.g.
+// "application/vnd.buildkit.cacheconfig.v0"). Container images have no
+// artifact type and never match artifact type patterns.
+type TypeFilter struct {
+	mediaTypes           []string
+	excludeMediaTypes    []string
+	artifactTypes        []string
+	excludeArtifactTypes []string
+}
+
+// TypeFilterSpec is the JSON and YAML representation of a TypeFilter.
+type TypeFilterSpec struct {
+	MediaTypes           []string `json:"media_types,omitempty"`
+	ExcludeMediaTypes    []string `json:"exclude_media_types,omitempty"`
+	ArtifactTypes        []string `json:"artifact_types,omitempty"`
+	ExcludeArtifactTypes []string `json:"exclude_artifact_types,omitempty"`
+}
+
+// filter builds the type filter. It returns nil if s is nil.
+func (s *TypeFilterSpec) filter() (*TypeFilter, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return BuildTypeFilter(s.MediaTypes, s.ExcludeMediaTypes, s.ArtifactTypes, s.ExcludeArtifactTypes)
+}
+
+// BuildTypeFilter builds a type filter. If media types or artifact types are
+// given, a manifest must match one of each to be selected. A manifest that
+// matches any of the excluded types is never selected. If all lists are
+// empty, it returns nil, which selects every manifest.
+func BuildTypeFilter(mediaTypes, excludeMediaTypes, artifactTypes, excludeArtifactTypes []string) (*TypeFilter, error) {
+	if len(mediaTypes) == 0 && len(excludeMediaTypes) == 0 &&
+		len(artifactTypes) == 0 && len(excludeArtifactTypes) == 0 {
+		return nil, nil
+	}
+
+	for _, patterns := range [][]string{mediaTypes, excludeMediaTypes, artifactTypes, excludeArtifactTypes} {
+		for _, pattern := range patterns {
+			if pattern == "" {
+				return nil, fmt.Errorf("type patterns cannot be empty")
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid type pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return &TypeFilter{
+		mediaTypes:           mediaTypes,
+		excludeMediaTypes:    excludeMediaTypes,
+		artifactTypes:        artifactTypes,
+		excludeArtifactTypes: excludeArtifactTypes,
+	}, nil
+}
+
+// String returns a human-readable description of the filter.
+func (f *TypeFilter) String() string {
+	if f == nil {
+		return "(all)"
+	}
+
+	var parts []string
+	for _, p := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"media_types", f.mediaTypes},
+		{"exclude_media_types", f.excludeMediaTypes},
+		{"artifact_types", f.artifactTypes},
+		{"exclude_artifact_types", f.excludeArtifactTypes},
+	} {
+		if len(p.patterns) > 0 {
+			parts = append(parts, fmt.Sprintf("%s(%s)", p.name, strings.Join(p.patterns, ", ")))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Matches returns true if the filter selects a manifest with the given media
+// type and artifact type. A nil filter selects every manifest.
+func (f *TypeFilter) Matches(mediaType, artifactType string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.mediaTypes) > 0 && !matchType(f.mediaTypes, mediaType) {
+		return false
+	}
+	if matchType(f.excludeMediaTypes, mediaType) {
+		return false
+	}
+	if len(f.artifactTypes) > 0 && !matchType(f.artifactTypes, artifactType) {
+		return false
+	}
+	if matchType(f.excludeArtifactTypes, artifactType) {
+		return false
+	}
+	return true
+}
+
+// needsMediaType returns true if the filter matches on media types.
+func (f *TypeFilter) needsMediaType() bool {
+	return f != nil && (len(f.mediaTypes) > 0 || len(f.excludeMediaTypes) > 0)
+}
+
+// needsArtifactType returns true if the filter matches on artifact types.
+func (f *TypeFilter) needsArtifactType() bool {
+	return f != nil && (len(f.artifactTypes) > 0 || len(f.excludeArtifactTypes) > 0)
+}
+
+// matchType returns true if the type matches any of the patterns. The empty
+// type never matches.
+func matchType(patterns []string, typ string) bool {
+	if typ == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, typ); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"testing"
+)
+
+func TestTypeFilter_Matches(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ociImage  = "application/vnd.oci.image.manifest.v1+json"
+		ociIndex  = "application/vnd.oci.image.index.v1+json"
+		helmChart = "application/vnd.cncf.helm.config.v1+json"
+		cache     = "application/vnd.buildkit.cacheconfig.v0"
+	)
+
+	cases := []struct {
+		name         string
+		spec         *TypeFilterSpec
+		mediaType    string
+		artifactType string
+		exp          bool
+	}{
+		{
+			name:      "nil",
+			mediaType: ociImage,
+			exp:       true,
+		},
+		{
+			name:      "media_type_glob",
+			spec:      &TypeFilterSpec{MediaTypes: []string{"application/vnd.oci.image.*"}},
+			mediaType: ociIndex,
+			exp:       true,
+		},
+		{
+			name:      "media_type_no_match",
+			spec:      &TypeFilterSpec{MediaTypes: []string{ociIndex}},
+			mediaType: ociImage,
+			exp:       false,
+		},
+		{
+			name:      "unknown_media_type",
+			spec:      &TypeFilterSpec{MediaTypes: []string{"*/*"}},
+			mediaType: "",
+			exp:       false,
+		},
+		{
+			name:      "exclude_media_type",
+			spec:      &TypeFilterSpec{ExcludeMediaTypes: []string{ociImage}},
+			mediaType: ociImage,
+			exp:       false,
+		},
+		{
+			name:         "artifact_type",
+			spec:         &TypeFilterSpec{ArtifactTypes: []string{helmChart}},
+			mediaType:    ociImage,
+			artifactType: helmChart,
+			exp:          true,
+		},
+		{
+			name:      "artifact_type_image",
+			spec:      &TypeFilterSpec{ArtifactTypes: []string{"*/*"}},
+			mediaType: ociImage,
+			exp:       false,
+		},
+		{
+			name:         "exclude_all_artifacts",
+			spec:         &TypeFilterSpec{ExcludeArtifactTypes: []string{"*/*"}},
+			mediaType:    ociImage,
+			artifactType: cache,
+			exp:          false,
+		},
+		{
+			name:      "exclude_all_artifacts_image",
+			spec:      &TypeFilterSpec{ExcludeArtifactTypes: []string{"*/*"}},
+			mediaType: ociImage,
+			exp:       true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := tc.spec.filter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.Matches(tc.mediaType, tc.artifactType), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildTypeFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := BuildTypeFilter(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Errorf("expected %s to be nil", f)
+	}
+
+	if _, err := BuildTypeFilter([]string{""}, nil, nil, nil); err == nil {
+		t.Errorf("expected error for empty pattern")
+	}
+	if _, err := BuildTypeFilter(nil, nil, []string{"application/[vnd"}, nil); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+
+	f, err = BuildTypeFilter([]string{"a/*"}, nil, nil, []string{"b/*", "c/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.String(), "media_types(a/*) exclude_artifact_types(b/*, c/*)"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}